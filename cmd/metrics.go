@@ -16,6 +16,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -24,12 +25,19 @@ import (
 	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/discovery"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/replay"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/validation"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
@@ -64,6 +72,18 @@ into prometheus format, will be the exactly information you will see as a metric
 		},
 	}
 
+	metricsValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the metrics queries files without calling AWS CloudWatch API.",
+		Long: `Using this command you can validate the metrics queries files before use them, every problem
+found is shown with its file and line number and the command exit with a non-zero code, so it
+could be used in your CI pipelines. The prometheus metrics collisions between the metrics queries
+are reported too.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			validateCmd(cmd, args)
+		},
+	}
+
 	metricsCollectCmd = &cobra.Command{
 		Use:   "collect",
 		Short: "Start a basic web server with the collector working and every request is sent to AWS CloudWatch API to collect metrics.",
@@ -82,6 +102,7 @@ func init() {
 	metricsCmd.AddCommand(metricsGetCmd)
 	metricsCmd.AddCommand(metricsDisplayPromDescCmd)
 	metricsCmd.AddCommand(metricsCollectCmd)
+	metricsCmd.AddCommand(metricsValidateCmd)
 
 	// Behavior parameters
 	metricsGetCmd.PersistentFlags().StringVar(&conf.Application.MetricStatPeriod, "metricStatPeriod", "5m", "The AWS CloudWatch metrics query stats period")
@@ -96,9 +117,11 @@ func init() {
 	// local flags
 	metricsGetCmd.Flags().StringP("outFormat", "", "yaml", "Output format for results, possible values: [yaml|json]")
 	metricsGetCmd.Flags().StringP("outFile", "", "", "Output file where to store the results.")
+	metricsGetCmd.Flags().StringP("record", "", "", "The directory where to save every AWS CloudWatch GetMetricData request and response, and the ones used to discover the metrics, as JSON fixture, to be replayed with --replay")
 
 	metricsCollectCmd.Flags().StringP("address", "", appIP, "Server address, empty means all addresses")
 	metricsCollectCmd.Flags().Uint16P("port", "", appPort, "Server port")
+	metricsCollectCmd.Flags().StringP("replay", "", "", "The directory with the AWS CloudWatch responses recorded by \"metrics get --record\", the scrapes are served from them instead of calling AWS")
 }
 
 func getCmd(cmd *cobra.Command, args []string) {
@@ -114,16 +137,51 @@ func getCmd(cmd *cobra.Command, args []string) {
 	log.Debugf("End Time: %s", endTime.Format(time.RFC3339))
 	log.Debugf("Period in seconds: %v s", int64(period/time.Second))
 
-	m := metrics.New(&conf)
-	mdi := m.GetMetricDataInput(startTime, endTime, period, "")
+	sess := newSession(&conf)
 
-	log.Debugf("Metrics queries: %s", mdi.String())
+	// the GetMetricData requests and responses are saved as fixtures to be replayed
+	recordDir, _ := cmd.Flags().GetString("record")
+	if len(recordDir) > 0 {
+		log.Infof("Recording the AWS CloudWatch responses into the directory: %s", recordDir)
+	}
 
-	sess := awshelper.NewSession()
-	svc := cloudwatch.New(sess)
-	mdo, err := svc.GetMetricData(mdi)
-	if err != nil {
-		log.Fatalf("Error getting metrics: %v", err)
+	// every region is queried with its own AWS CloudWatch client and its results are appended
+	mdo := &cloudwatch.GetMetricDataOutput{}
+	groups, regions := config.ByRegion(conf.MetricDataQueries, aws.StringValue(sess.Config.Region))
+	for _, r := range regions {
+		awsConf := aws.NewConfig().WithRegion(r)
+		var svc cloudwatchiface.CloudWatchAPI = cloudwatch.New(sess, awsConf)
+		var tagging resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI = resourcegroupstaggingapi.New(sess, awsConf)
+		if len(recordDir) > 0 {
+			svc = replay.NewRecorder(svc, recordDir, r)
+			tagging = replay.NewTaggingRecorder(tagging, recordDir, r)
+		}
+
+		// replace the metrics queries with dimensions to be discovered with the ones found
+		d := discovery.New(svc, tagging)
+		qs, _, err := d.Expand(groups[r])
+		if err != nil {
+			log.Fatalf("Error discovering metrics in region %s: %v", r, err)
+		}
+
+		rc := conf
+		rc.MetricDataQueriesConf = config.MetricDataQueriesConf{MetricDataQueries: qs}
+
+		m := metrics.New(&rc)
+		mdis := m.GetMetricDataInputs(startTime, endTime, period)
+
+		for _, mdi := range mdis {
+			log.Debugf("Metrics queries in region %s: %s", r, mdi.String())
+		}
+
+		rmdo, pages, err := collector.GetMetricDataBatches(context.Background(), svc, mdis, collector.NewRetryer(conf.Application.Retry, nil, nil))
+		if err != nil {
+			log.Fatalf("Error getting metrics in region %s: %v", r, err)
+		}
+		log.Debugf("Pages fetched in region %s: %v", r, pages)
+
+		mdo.MetricDataResults = append(mdo.MetricDataResults, rmdo.MetricDataResults...)
+		mdo.Messages = append(mdo.Messages, rmdo.Messages...)
 	}
 
 	var outMetrics []byte
@@ -170,6 +228,51 @@ func displayPromDescCmd(cmd *cobra.Command, args []string) {
 	}
 }
 
+func validateCmd(cmd *cobra.Command, args []string) {
+
+	files, err := expandMetricsFiles(conf.Application.MetricsFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("No metrics queries files found in: %s", conf.Application.MetricsFiles)
+	}
+
+	ps := validation.New().ValidateFiles(files)
+	for _, p := range ps {
+		log.Error(p.String())
+	}
+	if len(ps) > 0 {
+		log.Errorf("Found %v problems in %v metrics queries files", len(ps), len(files))
+		os.Exit(1)
+	}
+
+	// the collisions are found between the metrics queries of all the files
+	if err := readMetricsFiles(&conf); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkLabels(&conf); err != nil {
+		log.Fatal(err)
+	}
+	region, err := defaultRegion(&conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs := metrics.Collisions(&conf, region)
+	for _, c := range cs {
+		log.Error(c.String())
+	}
+	if len(cs) > 0 {
+		log.Errorf("Found %v prometheus metrics collisions, use --collisionLabels period,unit to tell apart the metrics queries which only differ by them", len(cs))
+		os.Exit(1)
+	}
+	if err := metrics.ValidateGroups(&conf, region); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("The %v metrics queries files are valid", len(files))
+}
+
 func collectCmd(cmd *cobra.Command, args []string) {
 
 	loadFromMetricsFiles(&conf)
@@ -178,11 +281,10 @@ func collectCmd(cmd *cobra.Command, args []string) {
 	log.Debugf("Available configuration: %s", conf.ToJSON())
 	log.Debugf("Available Env Vars: %s", os.Environ())
 
-	m := metrics.New(&conf)
-	sess := awshelper.NewSession()
-	cwc := cloudwatch.New(sess)
+	sess := newSession(&conf)
 
-	c := collector.New(&conf, m, cwc)
+	replayDir, _ := cmd.Flags().GetString("replay")
+	c := collector.NewWithClients(&conf, sess, replayClients(replayDir))
 
 	prometheus.MustRegister(c)
 	mux := http.NewServeMux()
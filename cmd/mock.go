@@ -0,0 +1,65 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/cwmock"
+	"github.com/spf13/cobra"
+)
+
+const mockPort = 9691
+
+// mockCmd represents the mock-cloudwatch command, it is hidden because it is only useful for testing
+var (
+	mockCmd = &cobra.Command{
+		Use:   "mock-cloudwatch",
+		Short: "Start an http server serving the AWS CloudWatch API from the datasets files",
+		Long: `This command start an http server serving the AWS CloudWatch Query API actions GetMetricData, ListMetrics and DescribeAlarms
+with the metrics and alarms of the datasets files. Usefully to test the exporter end to end without AWS.`,
+		Hidden: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			mockCloudWatchCmd(cmd, args)
+		},
+	}
+
+	mockDatasets []string
+	mockAddress  string
+	mockPortFlag uint16
+)
+
+func init() {
+	rootCmd.AddCommand(mockCmd)
+
+	mockCmd.Flags().StringSliceVar(&mockDatasets, "dataset", []string{}, "The yaml files with the metrics and alarms served, they are merged in order")
+	mockCmd.Flags().StringVar(&mockAddress, "address", appIP, "IP Address in the host where you want the mock listen")
+	mockCmd.Flags().Uint16Var(&mockPortFlag, "port", mockPort, "Port in the host where you want the mock listen")
+}
+
+func mockCloudWatchCmd(cmd *cobra.Command, args []string) {
+	d, err := cwmock.LoadDatasets(mockDatasets)
+	if err != nil {
+		log.Fatalf("Error loading the datasets: %v", err)
+	}
+
+	addr := fmt.Sprintf("%s:%d", mockAddress, mockPortFlag)
+	log.Infof("Serving %d metrics and %d alarms of the AWS CloudWatch API mock on http://%s", len(d.Metrics), len(d.Alarms), addr)
+	if err := http.ListenAndServe(addr, cwmock.New(d)); err != nil {
+		log.Fatalf("The mock server could not be started: %v", err)
+	}
+}
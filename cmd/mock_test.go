@@ -0,0 +1,149 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/cwmock"
+)
+
+const mockDatasetYaml = `
+PageSize: 1
+Metrics:
+  - Namespace: AWS/EC2
+    MetricName: CPUUtilization
+    Dimensions:
+      - Name: InstanceId
+        Value: i-1
+    Values: [42]
+  - Namespace: AWS/EC2
+    MetricName: CPUUtilization
+    Dimensions:
+      - Name: InstanceId
+        Value: i-2
+    Values: [24]
+  - Namespace: AWS/EC2
+    MetricName: NetworkIn
+    Dimensions:
+      - Name: InstanceId
+        Value: i-1
+    Values: [1000]
+`
+
+const mockMetricsYaml = `
+MetricDataQueries:
+  - Id: m1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: NetworkIn
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1
+      Stat: Sum
+  - Id: m2
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: "*"
+      Stat: Average
+`
+
+const mockServerYaml = `
+application:
+  metricStatPeriod: 5m
+  metricTimeWindow: 10m
+  concurrency: 1
+  metricsFiles:
+    - %s
+aws:
+  region: eu-west-1
+  endpoint: %s
+`
+
+func TestMockCloudWatch(t *testing.T) {
+	d, err := cwmock.ReadDataset([]byte(mockDatasetYaml))
+	if err != nil {
+		t.Fatalf("ReadDataset(): %v", err)
+	}
+	mock := cwmock.New(d)
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	// the exporter calls the mock with the configuration of the files, the same as server start
+	dir := t.TempDir()
+	metricsFile := writeFile(t, dir, "metrics.yaml", mockMetricsYaml)
+	serverFile := writeFile(t, dir, "server.yaml", fmt.Sprintf(mockServerYaml, metricsFile, ts.URL))
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	previous := conf
+	t.Cleanup(func() { conf = previous })
+	conf.Application.Name = appName
+	if err := readConfigFile(serverFile, &conf); err != nil {
+		t.Fatalf("readConfigFile(): %v", err)
+	}
+	if err := readMetricsFiles(&conf); err != nil {
+		t.Fatalf("readMetricsFiles(): %v", err)
+	}
+	if err := checkMetricsQueries(&conf); err != nil {
+		t.Fatalf("checkMetricsQueries(): %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector.New(defaultModuleConfig(&conf), newSession(&conf)))
+	es := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer es.Close()
+
+	resp, err := http.Get(es.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get(): %v", err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll(): %v", err)
+	}
+	body := string(bs)
+
+	// the instances of m2 are discovered with ListMetrics, one page for every metric
+	for _, want := range []string{
+		`aws_ec_2_network_in_sum{dimension_value="i-1",instance_id="i-1",region="eu-west-1"} 1000`,
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-1",instance_id="i-1",region="eu-west-1"} 42`,
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-2",instance_id="i-2",region="eu-west-1"} 24`,
+		`aws_cloudwatch_exporter_up 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics: got: %s --> want: %s", body, want)
+		}
+	}
+
+	if got := mock.Calls(cwmock.ActionListMetrics); got != 2 {
+		t.Errorf("Calls(): got: %v ListMetrics calls --> want: %v", got, 2)
+	}
+}
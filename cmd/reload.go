@@ -0,0 +1,136 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/web"
+)
+
+// reloader re-read the server and metrics files and replace the configuration of the
+// collector and handlers when the new configuration is valid, else the old one keeps running
+type reloader struct {
+	mutex     sync.Mutex
+	collector *collector.Collector
+	handlers  *web.Handlers
+
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+	reloads     *prometheus.CounterVec
+}
+
+func newReloader(c *config.All, col *collector.Collector, h *web.Handlers) *reloader {
+	return &reloader{
+		collector: col,
+		handlers:  h,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: c.Application.Name,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		}),
+		successTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: c.Application.Name,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: c.Application.Name,
+			Name:      "config_reloads_total",
+			Help:      "The total number of configuration reloads by result, success or failure.",
+		}, []string{"result"}),
+	}
+}
+
+// this register the reload metrics into the prometheus default registry, the start is a successful load
+func (r *reloader) register() {
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	prometheus.MustRegister(r.success, r.successTime, r.reloads)
+}
+
+// this reload the configuration, the reloads are executed one by one
+func (r *reloader) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	c, err := readConfig()
+	if err != nil {
+		log.Errorf("Error reloading the configuration, the previous configuration keeps running: %v", err)
+		r.success.Set(0)
+		r.reloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.collector.Reload(defaultModuleConfig(c))
+	r.handlers.SetConfig(c)
+
+	log.Infof("Configuration reloaded, total metrics queries: %v", len(c.MetricDataQueries))
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	r.reloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// ServeHTTP reload the configuration on POST requests, the error of an invalid configuration is returned
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		http.Error(w, "Error reloading the configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+}
+
+// this read the server and metrics files again into a new configuration and validate it,
+// the values not read from files (flags defaults and application info) are taken from the current one
+func readConfig() (*config.All, error) {
+	c := conf
+	// the slices must be empty or the old values could be kept by the unmarshal
+	c.MetricDataQueriesConf = config.MetricDataQueriesConf{}
+	c.TargetsConf = config.TargetsConf{}
+	c.Application.MetricsFiles = nil
+	c.Application.CollisionLabels = nil
+	c.Application.ProbeRoles = nil
+	c.Application.DimensionLabelsMap = nil
+
+	if err := readConfigFile(c.Application.ServerFile, &c); err != nil {
+		return nil, err
+	}
+	if err := readMetricsFiles(&c); err != nil {
+		return nil, err
+	}
+	if err := checkMetricsQueries(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// this return a copy of c with only the metrics queries without module, the ones scraped by the metrics endpoint
+func defaultModuleConfig(c *config.All) *config.All {
+	mc := *c
+	mc.MetricDataQueriesConf = config.MetricDataQueriesConf{MetricDataQueries: config.ByModule(c.MetricDataQueries)[""]}
+	return &mc
+}
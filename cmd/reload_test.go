@@ -0,0 +1,229 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/web"
+)
+
+const reloadMetricsYaml = `
+MetricDataQueries:
+  - Id: %s
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: %s
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Stat: Sum
+`
+
+const reloadServerYaml = `
+application:
+  metricsFiles:
+    - %s
+`
+
+// this write the file name of the directory dir with the content s
+func writeFile(t *testing.T, dir, name, s string) string {
+	t.Helper()
+	f := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(f, []byte(s), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	return f
+}
+
+// this create a reloader of the server file of the directory dir, the collector doesn't call AWS
+func prepareReloader(t *testing.T, dir string) *reloader {
+	t.Helper()
+
+	metricsFile := writeFile(t, dir, "metrics.yaml", fmt.Sprintf(reloadMetricsYaml, "m1", "CPUUtilization"))
+	serverFile := writeFile(t, dir, "server.yaml", fmt.Sprintf(reloadServerYaml, metricsFile))
+
+	// the global configuration is restored after the test
+	previous := conf
+	t.Cleanup(func() { conf = previous })
+	conf.Application.Name = appName
+	conf.Application.ServerFile = serverFile
+	if err := readConfigFile(serverFile, &conf); err != nil {
+		t.Fatalf("readConfigFile(): %v", err)
+	}
+	if err := readMetricsFiles(&conf); err != nil {
+		t.Fatalf("readMetricsFiles(): %v", err)
+	}
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("eu-west-1").WithCredentials(credentials.AnonymousCredentials))
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	clients := func(*session.Session, string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) {
+		return nil, nil
+	}
+	c := collector.NewWithClients(defaultModuleConfig(&conf), sess, clients)
+	return newReloader(&conf, c, web.NewHandlers(&conf, sess, clients))
+}
+
+// this return the names of the prometheus metrics described by the collector c
+func describedNames(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+
+	var names []string
+	for d := range ch {
+		names = append(names, d.String())
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
+
+// this return the values of the reload metrics of r by its name and labels
+func reloadValues(t *testing.T, r *reloader) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(r.success, r.reloads)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			k := mf.GetName()
+			for _, l := range m.GetLabel() {
+				k += fmt.Sprintf("{%s=%q}", l.GetName(), l.GetValue())
+			}
+			switch {
+			case m.GetGauge() != nil:
+				values[k] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[k] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func Test_reloader_ServeHTTP(t *testing.T) {
+	dir := t.TempDir()
+	r := prepareReloader(t, dir)
+
+	if names := describedNames(r.collector); !strings.Contains(names, "aws_ec_2_cpu_utilization_sum") {
+		t.Fatalf("Describe(): got: %s --> want: aws_ec_2_cpu_utilization_sum", names)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		metrics    string
+		aws        string
+		wantStatus int
+		wantMetric string
+		want       map[string]float64
+	}{
+		{
+			name:       "OnlyPost",
+			method:     http.MethodGet,
+			metrics:    fmt.Sprintf(reloadMetricsYaml, "m2", "NetworkIn"),
+			wantStatus: http.StatusMethodNotAllowed,
+			wantMetric: "aws_ec_2_cpu_utilization_sum",
+			want:       map[string]float64{},
+		},
+		{
+			name:       "Valid",
+			method:     http.MethodPost,
+			metrics:    fmt.Sprintf(reloadMetricsYaml, "m2", "NetworkIn"),
+			wantStatus: http.StatusOK,
+			wantMetric: "aws_ec_2_network_in_sum",
+			want: map[string]float64{
+				`aws_cloudwatch_exporter_config_last_reload_successful`:          1,
+				`aws_cloudwatch_exporter_config_reloads_total{result="success"}`: 1,
+				`aws_cloudwatch_exporter_config_reloads_total{result="failure"}`: 0,
+			},
+		},
+		{
+			// the previous configuration keeps running
+			name:       "Invalid",
+			method:     http.MethodPost,
+			metrics:    "MetricDataQueries:\n  - Id: m3\n",
+			wantStatus: http.StatusInternalServerError,
+			wantMetric: "aws_ec_2_network_in_sum",
+			want: map[string]float64{
+				`aws_cloudwatch_exporter_config_last_reload_successful`:          0,
+				`aws_cloudwatch_exporter_config_reloads_total{result="success"}`: 1,
+				`aws_cloudwatch_exporter_config_reloads_total{result="failure"}`: 1,
+			},
+		},
+		{
+			// the invalid aws section doesn't stop the exporter
+			name:       "InvalidAWS",
+			method:     http.MethodPost,
+			metrics:    fmt.Sprintf(reloadMetricsYaml, "m4", "DiskReadOps"),
+			aws:        "aws:\n  caBundle: " + filepath.Join(dir, "nonexistent.pem") + "\n",
+			wantStatus: http.StatusInternalServerError,
+			wantMetric: "aws_ec_2_network_in_sum",
+			want: map[string]float64{
+				`aws_cloudwatch_exporter_config_last_reload_successful`:          0,
+				`aws_cloudwatch_exporter_config_reloads_total{result="success"}`: 1,
+				`aws_cloudwatch_exporter_config_reloads_total{result="failure"}`: 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricsFile := writeFile(t, dir, "metrics.yaml", tt.metrics)
+			writeFile(t, dir, "server.yaml", fmt.Sprintf(reloadServerYaml, metricsFile)+tt.aws)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, appReloadPath, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP(): got: %v --> want: %v", w.Code, tt.wantStatus)
+			}
+
+			if names := describedNames(r.collector); !strings.Contains(names, tt.wantMetric) || (tt.wantStatus != http.StatusOK && strings.Contains(names, "disk_read_ops")) {
+				t.Errorf("Describe(): got: %s --> want: %s", names, tt.wantMetric)
+			}
+
+			got := reloadValues(t, r)
+			for k, v := range tt.want {
+				if gv := got[k]; gv != v {
+					t.Errorf("reload(): %s got: %v --> want: %v", k, gv, v)
+				}
+			}
+		})
+	}
+}
@@ -21,12 +21,22 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 	"github.com/imdario/mergo"
 	"github.com/prometheus/common/version"
 	"github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/replay"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/validation"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
@@ -36,13 +46,14 @@ const (
 	appName        = "aws_cloudwatch_exporter"
 	appDescription = `AWS CloudWatch exporter for prometheus.io
 This exporter use GetMetricData API to get the metrics from AWS CloudWatch`
-	appDescriptionShort  = "AWS CloudWatch exporter for prometheus.io"
-	appGitRepository     = "https://github.com/slashdevops/aws_cloudwatch_exporter"
-	appMetricsPath       = "/metrics"
-	appHealthPath        = "/health"
-	appIP                = "127.0.0.1"
-	appPort              = 9690
-	appMaxMetricsQueries = 500
+	appDescriptionShort = "AWS CloudWatch exporter for prometheus.io"
+	appGitRepository    = "https://github.com/slashdevops/aws_cloudwatch_exporter"
+	appMetricsPath      = "/metrics"
+	appHealthPath       = "/health"
+	appProbePath        = "/probe"
+	appReloadPath       = "/-/reload"
+	appIP               = "127.0.0.1"
+	appPort             = 9690
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -80,10 +91,32 @@ func init() {
 		log.Error(err)
 	}
 
-	rootCmd.PersistentFlags().StringSliceVar(&conf.Application.MetricsFiles, "metricsFiles", []string{"metrics.yaml"}, "Metrics queries files, the file or files with the metrics queries. example: --metricsFiles ~/tmp/queries/m1.yaml --metricsFiles ~/tmp/queries/m2.yml")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Application.MetricsFiles, "metricsFiles", []string{"metrics.yaml"}, "Metrics queries files, the files, directories or glob patterns with the metrics queries. example: --metricsFiles ~/tmp/queries/m1.yaml --metricsFiles ~/tmp/queries/ --metricsFiles '~/tmp/queries/*.yml'")
 	if err := viper.BindPFlag("application.metricsFiles", rootCmd.PersistentFlags().Lookup("metricsFiles")); err != nil {
 		log.Error(err)
 	}
+
+	// Metrics
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Application.CollisionLabels, "collisionLabels", nil, "The labels added to tell apart the metrics queries which only differ by them, allowed labels: period, unit. example: --collisionLabels period,unit")
+	if err := viper.BindPFlag("application.collisionLabels", rootCmd.PersistentFlags().Lookup("collisionLabels")); err != nil {
+		log.Error(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&conf.Application.StatsMode, "statsMode", metrics.StatsModeSuffix, "The mode used to tell apart the statistics of the metrics queries with Stats, allowed modes: suffix (aws_ec_2_cpu_utilization_p99), label (aws_ec_2_cpu_utilization{statistic=\"p99\"})")
+	if err := viper.BindPFlag("application.statsMode", rootCmd.PersistentFlags().Lookup("statsMode")); err != nil {
+		log.Error(err)
+	}
+
+	rootCmd.PersistentFlags().StringVar(&conf.Application.DimensionLabels, "dimensionLabels", metrics.DimensionLabelsSnake, "The mode used to create the prometheus labels names from the dimensions names, allowed modes: snake (AutoScalingGroupName --> auto_scaling_group_name), original")
+	if err := viper.BindPFlag("application.dimensionLabels", rootCmd.PersistentFlags().Lookup("dimensionLabels")); err != nil {
+		log.Error(err)
+	}
+
+	// AWS
+	rootCmd.PersistentFlags().StringVar(&conf.AWS.Endpoint, "awsEndpoint", "", "The URL used for all the AWS services in place of the AWS endpoints. example: --awsEndpoint http://localhost:4566")
+	if err := viper.BindPFlag("aws.endpoint", rootCmd.PersistentFlags().Lookup("awsEndpoint")); err != nil {
+		log.Error(err)
+	}
 }
 
 func initConfig() {
@@ -111,6 +144,7 @@ func initConfig() {
 	conf.Application.GitRepository = appGitRepository
 	conf.Application.MetricsPath = appMetricsPath
 	conf.Application.HealthPath = appHealthPath
+	conf.Application.ProbePath = appProbePath
 	conf.Application.Version = version.Version
 	conf.Application.Revision = version.Revision
 	conf.Application.GoVersion = version.GoVersion
@@ -122,6 +156,13 @@ func initConfig() {
 
 // Unmarshall Yaml files into c config structure
 func loadFromConfigFiles(fileName string, c *config.All) {
+	if err := readConfigFile(fileName, c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Unmarshall Yaml file fileName into c config structure, returning the error instead of exit
+func readConfigFile(fileName string, c *config.All) error {
 
 	if !fileExists(fileName) {
 		log.Warnf("The file %s doesn't exist, I will try to use configuration values from flags or ENV vars", fileName)
@@ -152,46 +193,136 @@ func loadFromConfigFiles(fileName string, c *config.All) {
 
 	log.Debugf("Loading configuration from file: %s", fileName)
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file, %s", err)
+		return fmt.Errorf("error reading config file, %s", err)
 	}
 
 	log.Debugf("Filling configuration structure from file: %s", fileName)
-	err := viper.Unmarshal(&c)
-	if err != nil {
-		log.Fatalf("Unable to decode into struct, %v", err)
+	if err := viper.Unmarshal(&c); err != nil {
+		return fmt.Errorf("unable to decode into struct, %v", err)
 	}
 
+	return nil
 }
 
 // Unmarshall Yaml files into c config structure
+func loadFromMetricsFiles(c *config.All) {
+	if err := readMetricsFiles(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Unmarshall Yaml files into c config structure, returning the error instead of exit
 // NOTE: Unfortunately viper.MergeInConfig() does the merge using override, so
 // this is the reason to do not user it.
-func loadFromMetricsFiles(c *config.All) {
+func readMetricsFiles(c *config.All) error {
+
+	if len(c.Application.MetricsFiles) == 0 {
+		return fmt.Errorf("metrics queries files don't provided, you need to provide at least one to continue")
+	}
+
+	files, err := expandMetricsFiles(c.Application.MetricsFiles)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no metrics queries files found in: %s", c.Application.MetricsFiles)
+	}
 
-	metricsQueries := MergeMetricsFiles(c.Application.MetricsFiles)
+	// the files are rejected before reach AWS CloudWatch
+	if err := validateMetricsFiles(files); err != nil {
+		return err
+	}
+
+	metricsQueries, err := MergeMetricsFiles(files)
+	if err != nil {
+		return err
+	}
 
 	if err := viper.MergeConfigMap(metricsQueries); err != nil {
-		log.Fatalf("Error merging MetricsQueries read from files into config structure, check your metrics queries: %s", err.Error())
+		return fmt.Errorf("error merging MetricsQueries read from files into config structure, check your metrics queries: %s", err.Error())
 	}
 
-	if len(c.Application.MetricsFiles) > 0 {
-		log.Debugf("Filling configuration structure from metrics queries file: %s", c.Application.MetricsFiles)
-		err := viper.Unmarshal(&c)
-		if err != nil {
-			log.Fatalf("Unable to unmarshal Metrics queries files into config struct, %s", err.Error())
+	log.Debugf("Filling configuration structure from metrics queries file: %s", c.Application.MetricsFiles)
+	if err := viper.Unmarshal(&c); err != nil {
+		return fmt.Errorf("unable to unmarshal Metrics queries files into config struct, %s", err.Error())
+	}
+
+	return nil
+}
+
+// The extensions of the metrics queries files read from directories and glob patterns
+var metricsFilesExts = []string{".yaml", ".yml", ".json"}
+
+// This function return the metrics queries files of the paths, every path could be a file, a directory
+// or a glob pattern, i.e.: /etc/exporter/queries/*.yaml. From the directories and glob patterns only the
+// files with extensions .yaml, .yml and .json are returned, sorted by name and without duplicates.
+func expandMetricsFiles(paths []string) ([]string, error) {
+	var files []string
+	unique := make(map[string]bool)
+
+	add := func(f string) {
+		if !unique[f] {
+			unique[f] = true
+			files = append(files, f)
 		}
-	} else {
-		log.Fatal("Metrics queries files don't provided, you need to provide at least one to continue")
 	}
+
+	for _, p := range paths {
+		var matches []string
+
+		switch info, err := os.Stat(p); {
+		case err == nil && info.IsDir():
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, fmt.Errorf("error reading metrics queries directory: %s, %s", p, err.Error())
+			}
+			for _, e := range entries {
+				matches = append(matches, filepath.Join(p, e.Name()))
+			}
+		case err == nil:
+			add(p)
+			continue
+		case strings.ContainsAny(p, `*?[`):
+			matches, err = filepath.Glob(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid metrics queries files pattern: %s, %s", p, err.Error())
+			}
+			if len(matches) == 0 {
+				log.Warnf("No metrics queries files match the pattern: %s", p)
+			}
+		default:
+			return nil, fmt.Errorf("the file %s does not exist, you need to provide valid metrics queries file", p)
+		}
+
+		sort.Strings(matches)
+		for _, m := range matches {
+			if fileExists(m) && isMetricsFile(m) {
+				add(m)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// this return if the file f has one of the extensions of the metrics queries files
+func isMetricsFile(f string) bool {
+	ext := strings.ToLower(filepath.Ext(f))
+	for _, e := range metricsFilesExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
 }
 
 // This function merge files with metrics queries into a map without override keys
-func MergeMetricsFiles(files []string) map[string]interface{} {
+func MergeMetricsFiles(files []string) (map[string]interface{}, error) {
 	var resultValues map[string]interface{}
 	for _, file := range files {
 
 		if !fileExists(file) {
-			log.Fatalf("The file %s does not exist, you need to provide valid metrics queries file", file)
+			return nil, fmt.Errorf("the file %s does not exist, you need to provide valid metrics queries file", file)
 		}
 
 		fileExt := strings.ToLower(filepath.Ext(file)[1:])
@@ -224,25 +355,143 @@ func MergeMetricsFiles(files []string) map[string]interface{} {
 		default:
 			log.Errorf("Unknown file: %s, this cannot be processed", file)
 		}
+		applyFileDefaults(override)
+
 		if err := mergo.Map(&resultValues, override, mergo.WithAppendSlice); err != nil {
 			log.Errorf("Error merging file: %s, %s", file, err.Error())
 			continue
 		}
 	}
-	return resultValues
+	return resultValues, nil
+}
+
+// The keys which could be defined at the top level of the metrics files as default for all its metrics queries
+var metricsFileDefaults = []string{"Module", "Region", "AccountId"}
+
+// This function set the defaults (Module, Region, AccountId) defined at the top level of the metrics file into all
+// its metrics queries without them, so every file could have the metrics queries of a different module, region or account
+func applyFileDefaults(values map[string]interface{}) {
+	qs, _ := values["MetricDataQueries"].([]interface{})
+
+	for _, key := range metricsFileDefaults {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		delete(values, key)
+
+		for _, q := range qs {
+			mq, ok := q.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := mq[key]; !ok {
+				mq[key] = value
+			}
+		}
+	}
 }
 
 func validateMetricsQueries(c *config.All) {
+	if err := checkMetricsQueries(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// This function validate the schema of the metrics queries files, the error has all the problems
+// found with its file and line number
+func validateMetricsFiles(files []string) error {
+	ps := validation.New().ValidateFiles(files)
+	if len(ps) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, p := range ps {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Errorf("the metrics queries files have %v problems:\n%s", len(ps), strings.Join(msgs, "\n"))
+}
+
+// This function validate the metrics queries of c, returning the error instead of exit
+func checkMetricsQueries(c *config.All) error {
 	log.Info("Validating Metrics Queries")
-	if len(c.MetricDataQueries) > 0 {
-		log.Infof("Total metrics queries: %v", len(c.MetricDataQueries))
-	} else {
-		log.Fatal("Metrics Queries are empty, you need to define at least one metric in metrics file")
+	if len(c.MetricDataQueries) == 0 {
+		return fmt.Errorf("the metrics queries are empty, you need to define at least one metric in metrics file")
+	}
+	log.Infof("Total metrics queries: %v", len(c.MetricDataQueries))
+
+	if err := checkLabels(c); err != nil {
+		return err
+	}
+
+	// the registry would fail at scrape time with the colliding metrics
+	region, err := defaultRegion(c)
+	if err != nil {
+		return err
+	}
+	if cs := metrics.Collisions(c, region); len(cs) > 0 {
+		var msgs []string
+		for _, c := range cs {
+			msgs = append(msgs, c.String())
+		}
+		return fmt.Errorf("the metrics queries have %v prometheus metrics collisions:\n%s", len(cs), strings.Join(msgs, "\n"))
+	}
+
+	// every metric math expression must be sent with its queries into a legal GetMetricData call
+	return metrics.ValidateGroups(c, region)
+}
+
+// This function return the AWS Region of the metrics queries without Region, the region of the AWS session,
+// the error is returned when the aws section of c is invalid
+func defaultRegion(c *config.All) (string, error) {
+	sess, err := awshelper.NewSession(c.AWS)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(sess.Config.Region), nil
+}
+
+// This function create the AWS session of the aws section of c or exit when it is invalid
+func newSession(c *config.All) *session.Session {
+	sess, err := awshelper.NewSession(c.AWS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the GetMetricData calls are retried by the collector, the AWS SDK retries are disabled for them
+	if c.AWS.MaxRetries != nil {
+		log.Warnf("The aws.maxRetries: %v doesn't apply to the AWS CloudWatch GetMetricData calls, they are retried using application.retry.maxAttempts: %v", *c.AWS.MaxRetries, c.Application.Retry.MaxAttempts)
+	}
+	return sess
+}
+
+// This function validate the options of the prometheus labels of the metrics
+func checkLabels(c *config.All) error {
+	if err := metrics.ValidateCollisionLabels(c.Application.CollisionLabels); err != nil {
+		return err
+	}
+	if err := metrics.ValidateStatsMode(c.Application.StatsMode); err != nil {
+		return err
+	}
+	return metrics.ValidateDimensionLabels(c.Application.DimensionLabels)
+}
+
+// this return the AWS clients of the collectors which replay the fixtures of the directory dir,
+// or nil when dir is empty and the AWS clients must be used
+func replayClients(dir string) collector.Clients {
+	if len(dir) == 0 {
+		return nil
+	}
+
+	fs, err := replay.Load(dir)
+	if err != nil {
+		log.Fatalf("Error loading the fixtures to replay: %v", err)
 	}
+	log.Warnf("Replaying the AWS CloudWatch responses of the directory %s, AWS CloudWatch is not called", dir)
 
-	// TODO: Allow more that 500 metrics queries and remove it
-	if len(c.MetricDataQueries) > appMaxMetricsQueries {
-		log.Fatalf("You have defined %v metrics queries, the limits is %v", len(c.MetricDataQueries), appMaxMetricsQueries)
+	return func(sess *session.Session, r string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) {
+		return fs.Client(r), fs.Tagging(r)
 	}
 }
 
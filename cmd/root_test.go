@@ -0,0 +1,129 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+func Test_expandMetricsFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.yml", "a.yaml", "c.json", "notes.txt"} {
+		writeFile(t, dir, name, "")
+	}
+	// the files of the subdirectories are not returned
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir(): %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "sub"), "d.yaml", "")
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			// the files are returned no matter its extension
+			name:  "File",
+			paths: []string{path("notes.txt")},
+			want:  []string{path("notes.txt")},
+		},
+		{
+			name:  "Directory",
+			paths: []string{dir},
+			want:  []string{path("a.yaml"), path("b.yml"), path("c.json")},
+		},
+		{
+			name:  "Glob",
+			paths: []string{path("*.y*ml")},
+			want:  []string{path("a.yaml"), path("b.yml")},
+		},
+		{
+			name:  "GlobNoMatch",
+			paths: []string{path("*.toml")},
+			want:  nil,
+		},
+		{
+			name:  "Duplicates",
+			paths: []string{path("c.json"), dir},
+			want:  []string{path("c.json"), path("a.yaml"), path("b.yml")},
+		},
+		{
+			name:    "InvalidPattern",
+			paths:   []string{path("[")},
+			wantErr: true,
+		},
+		{
+			name:    "MissingPath",
+			paths:   []string{path("missing.yaml")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandMetricsFiles(tt.paths)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandMetricsFiles(): got error: %v --> want error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandMetricsFiles(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newSessionMaxRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries *int
+		wantWarn   bool
+	}{
+		{name: "Undefined", maxRetries: nil, wantWarn: false},
+		{name: "Defined", maxRetries: new(int), wantWarn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewLocal(log)
+			defer hook.Reset()
+
+			c := &config.All{}
+			c.AWS = config.AWS{Region: "eu-west-1", MaxRetries: tt.maxRetries}
+			newSession(c)
+
+			// the GetMetricData calls don't use aws.maxRetries, so it is warned
+			gotWarn := false
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "aws.maxRetries") {
+					gotWarn = true
+				}
+			}
+			if gotWarn != tt.wantWarn {
+				t.Errorf("newSession(): got warning: %v --> want: %v", gotWarn, tt.wantWarn)
+			}
+		})
+	}
+}
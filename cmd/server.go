@@ -16,23 +16,26 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
-	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/server"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/watcher"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/web"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// The time without changes in the metrics queries files before reload them, so the files changed together are reloaded once
+const watchDelay = 2 * time.Second
+
 // serverCmd represents the server command
 var (
 	serverCmd = &cobra.Command{
@@ -105,6 +108,51 @@ func init() {
 		log.Error(err)
 	}
 
+	// Concurrency
+	serverCmd.PersistentFlags().IntVar(&conf.Application.Concurrency, "concurrency", 1, "The maximum number of AWS CloudWatch GetMetricData calls executed in parallel by all the targets and regions together, the metrics queries are split in batches of 500")
+	if err := viper.BindPFlag("application.concurrency", serverCmd.PersistentFlags().Lookup("concurrency")); err != nil {
+		log.Error(err)
+	}
+
+	// DiscoveryInterval
+	serverCmd.PersistentFlags().StringVar(&conf.Application.DiscoveryInterval, "discoveryInterval", "10m", "The interval used to discover the metrics of the metrics queries with dimensions values defined as wildcard or regex")
+	if err := viper.BindPFlag("application.discoveryInterval", serverCmd.PersistentFlags().Lookup("discoveryInterval")); err != nil {
+		log.Error(err)
+	}
+
+	// ScrapeTimeout
+	serverCmd.PersistentFlags().StringVar(&conf.Application.ScrapeTimeout, "scrapeTimeout", "", "The maximum duration of the scrapes, the failed AWS CloudWatch calls are not retried beyond it, empty means without deadline")
+	if err := viper.BindPFlag("application.scrapeTimeout", serverCmd.PersistentFlags().Lookup("scrapeTimeout")); err != nil {
+		log.Error(err)
+	}
+
+	// BackgroundPolling
+	serverCmd.PersistentFlags().BoolVar(&conf.Application.BackgroundPolling, "backgroundPolling", false, "If enabled, the metrics are refreshed from AWS CloudWatch in background every metricStatPeriod and the scrapes are served from the last refresh")
+	if err := viper.BindPFlag("application.backgroundPolling", serverCmd.PersistentFlags().Lookup("backgroundPolling")); err != nil {
+		log.Error(err)
+	}
+
+	// ReloadEndpoint
+	serverCmd.PersistentFlags().BoolVar(&conf.Application.ReloadEndpoint, "reloadEndpoint", false, "If enabled, the configuration is reloaded with a POST request to "+appReloadPath+", it is always reloaded with the signal SIGHUP")
+	if err := viper.BindPFlag("application.reloadEndpoint", serverCmd.PersistentFlags().Lookup("reloadEndpoint")); err != nil {
+		log.Error(err)
+	}
+
+	// WatchMetricsFiles
+	serverCmd.PersistentFlags().BoolVar(&conf.Application.WatchMetricsFiles, "watchMetricsFiles", false, "If enabled, the configuration is reloaded when the metrics queries files, or the files of its directories and glob patterns, are created, changed or removed")
+	if err := viper.BindPFlag("application.watchMetricsFiles", serverCmd.PersistentFlags().Lookup("watchMetricsFiles")); err != nil {
+		log.Error(err)
+	}
+
+	// ProbeRoles
+	serverCmd.PersistentFlags().StringSliceVar(&conf.Application.ProbeRoles, "probeRoles", []string{}, "The roles ARNs, or patterns of them, allowed in the role parameter of the probes, i.e.: --probeRoles 'arn:aws:iam::*:role/cloudwatch-exporter'")
+	if err := viper.BindPFlag("application.probeRoles", serverCmd.PersistentFlags().Lookup("probeRoles")); err != nil {
+		log.Error(err)
+	}
+
+	// Replay
+	serverStartCmd.Flags().String("replay", "", "The directory with the AWS CloudWatch responses recorded by \"metrics get --record\", the scrapes are served from them instead of calling AWS")
+
 	// LogFormat
 	serverCmd.PersistentFlags().StringVar(&conf.Server.LogFormat, "logFormat", "text", "Define the log output format of the server, valid values [text|json]")
 	if err := viper.BindPFlag("server.logFormat", serverCmd.PersistentFlags().Lookup("logFormat")); err != nil {
@@ -120,19 +168,49 @@ func startCmd(cmd *cobra.Command, args []string) {
 	log.Debugf("Available configuration: %s", conf.ToJSON())
 	log.Debugf("Available Env Vars: %s", os.Environ())
 
-	m := metrics.New(&conf)
-	sess := awshelper.NewSession()
-	cwc := cloudwatch.New(sess)
+	sess := newSession(&conf)
+
+	// the metrics queries with module are only scraped by the probe endpoint
+	for module, qs := range config.ByModule(conf.MetricDataQueries) {
+		if len(module) > 0 {
+			log.Infof("Loaded module: %s, metrics queries: %v", module, len(qs))
+		}
+	}
 
-	c := collector.New(&conf, m, cwc)
+	replayDir, _ := cmd.Flags().GetString("replay")
+	clients := replayClients(replayDir)
 
+	c := collector.NewWithClients(defaultModuleConfig(&conf), sess, clients)
 	prometheus.MustRegister(c)
 
-	handlers := web.NewHandlers(&conf)
+	// this context stop the collector background polling when the server is shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if conf.Application.BackgroundPolling {
+		c.StartBackgroundPolling(ctx)
+	}
+
+	handlers := web.NewHandlers(&conf, sess, clients)
+
+	// the configuration is reloaded from the files on SIGHUP or POST /-/reload
+	r := newReloader(&conf, c, handlers)
+	r.register()
+
+	if conf.Application.WatchMetricsFiles {
+		// the error is logged and exposed as metric by the reloader
+		if err := watcher.Watch(ctx, conf.Application.MetricsFiles, watchDelay, func() { _ = r.reload() }); err != nil {
+			log.Fatalf("Error watching the metrics queries files: %v", err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handlers.Home)
 	mux.HandleFunc(conf.Application.HealthPath, handlers.Health)
+	mux.HandleFunc(conf.Application.ProbePath, handlers.Probe)
+	if conf.Application.ReloadEndpoint {
+		mux.Handle(appReloadPath, r)
+	}
 	mux.Handle(conf.Application.MetricsPath, promhttp.Handler())
 
 	// Debug & Profiling
@@ -154,6 +232,10 @@ func startCmd(cmd *cobra.Command, args []string) {
 	// This run a go routine to listen Operating System signals
 	// and execute a Gracefully shutdown when those occurs
 	s.ListenOSSignals(&done)
+	s.ListenReloadSignal(func() {
+		// the error is logged and exposed as metric by the reloader
+		_ = r.reload()
+	})
 
 	if err := s.Start(); err != nil {
 		log.Fatalf("The server process could not be started: %s", err.Error())
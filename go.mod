@@ -4,6 +4,7 @@ go 1.22.4
 
 require (
 	github.com/aws/aws-sdk-go v1.53.20
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/imdario/mergo v0.3.15
 	github.com/prometheus/client_golang v1.19.1
 	github.com/prometheus/common v0.54.0
@@ -16,7 +17,6 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
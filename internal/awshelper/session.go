@@ -16,21 +16,36 @@ limitations under the License.
 package awshelper
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 )
 
+// The keep alive of the connections when the connect timeout is defined, the same of http.DefaultTransport
+const keepAlive = 30 * time.Second
+
 // https://docs.Credentials.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html
 // https://docs.Credentials.amazon.com/sdk-for-go/api/aws/session/
-func NewSession() *session.Session {
+// The configuration c overrides the endpoints, region, retries and http client of the AWS SDK defaults,
+// the error is returned when the configuration c or the AWS config files are invalid
+func NewSession(c config.AWS) (*session.Session, error) {
 
 	awsConf := aws.Config{CredentialsChainVerboseErrors: aws.Bool(true)}
-	awsSessOpts := session.Options{Config: awsConf}
+	awsSessOpts := session.Options{}
 
 	// in case of assume role with MFA
 	awsSessOpts.AssumeRoleTokenProvider = stscreds.StdinTokenProvider
@@ -52,19 +67,149 @@ func NewSession() *session.Session {
 		awsSessOpts.Profile = os.Getenv("AWS_PROFILE")
 	}
 
+	if err := applyConfig(&awsConf, &awsSessOpts, c); err != nil {
+		return nil, fmt.Errorf("failed to apply the AWS configuration: %s", err)
+	}
+	awsSessOpts.Config = awsConf
+
 	// Try default credential provider chain
 	// awsSession, err := session.NewSession(&awsConf)
 	awsSession, err := session.NewSessionWithOptions(awsSessOpts)
 	if err != nil {
-		log.Fatalf("Failed to create AWS Session using default chain:%s", err)
+		return nil, fmt.Errorf("failed to create AWS Session using default chain: %s", err)
 	}
 
 	if len(os.Getenv("AWS_ROLE_ARN")) > 0 {
 		log.Debugf("Create new session assuming role: %s", os.Getenv("AWS_ROLE_ARN"))
-		// Override session AWS with the new credentials provided after assume the role
-		awsConf.Credentials = stscreds.NewCredentials(awsSession, os.Getenv("AWS_ROLE_ARN"))
-		awsSession = session.Must(session.NewSession(&awsConf))
+		// Override session AWS with the new credentials provided after assume the role,
+		// the copy keeps the endpoints and http client of the configuration
+		awsSession = awsSession.Copy(&aws.Config{Credentials: stscreds.NewCredentials(awsSession, os.Getenv("AWS_ROLE_ARN"))})
+	}
+
+	return awsSession, nil
+}
+
+// this apply the configuration c to the AWS config awsConf and the session options opts
+func applyConfig(awsConf *aws.Config, opts *session.Options, c config.AWS) error {
+	if len(c.Region) > 0 {
+		log.Debugf("Using AWS Region: %s", c.Region)
+		awsConf.Region = aws.String(c.Region)
+	}
+
+	if len(c.Endpoint) > 0 || len(c.Endpoints) > 0 {
+		log.Debugf("Using AWS endpoint: %s, endpoints: %v", c.Endpoint, c.Endpoints)
+		awsConf.EndpointResolver = newEndpointResolver(c.Endpoint, c.Endpoints)
+	}
+
+	if c.MaxRetries != nil {
+		awsConf.MaxRetries = aws.Int(*c.MaxRetries)
 	}
 
-	return awsSession
+	if c.UseFIPSEndpoint {
+		awsConf.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+
+	if c.UseDualStackEndpoint {
+		awsConf.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		awsConf.HTTPClient = client
+	}
+
+	// the AWS SDK use it in place of the system certificates authorities
+	if len(c.CABundle) > 0 {
+		bs, err := ioutil.ReadFile(c.CABundle)
+		if err != nil {
+			return fmt.Errorf("error reading the CA bundle: %v", err)
+		}
+		opts.CustomCABundle = bytes.NewReader(bs)
+	}
+
+	return nil
+}
+
+// this return the resolver of the endpoints of the services, the services without endpoint use the default one
+func newEndpointResolver(endpoint string, services map[string]string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		u, ok := services[service]
+		if !ok {
+			u = endpoint
+		}
+		if len(u) == 0 {
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		}
+		return endpoints.ResolvedEndpoint{URL: u, SigningRegion: region}, nil
+	})
+}
+
+// this return the http client with the timeouts and proxy of the configuration c,
+// or nil when they are not defined and the AWS SDK default client can be used
+func newHTTPClient(c config.AWS) (*http.Client, error) {
+	if c.ConnectTimeout == 0 && c.ReadTimeout == 0 && len(c.ProxyURL) == 0 {
+		return nil, nil
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if c.ConnectTimeout > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: keepAlive}).DialContext
+		tr.TLSHandshakeTimeout = c.ConnectTimeout
+	}
+	if c.ReadTimeout > 0 {
+		tr.ResponseHeaderTimeout = c.ReadTimeout
+	}
+	if len(c.ProxyURL) > 0 {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid proxy URL %s", c.ProxyURL)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{Transport: tr}, nil
+}
+
+// NewAssumeRoleSession return a copy of the session sess using the credentials of the role roleARN,
+// the credentials are refreshed automatically before they expire.
+// The externalID, sessionName and region are optional, when they are empty the defaults are used.
+func NewAssumeRoleSession(sess *session.Session, roleARN, externalID, sessionName, region string) *session.Session {
+	log.Debugf("Create new session assuming role: %s", roleARN)
+
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if len(externalID) > 0 {
+			p.ExternalID = aws.String(externalID)
+		}
+		if len(sessionName) > 0 {
+			p.RoleSessionName = sessionName
+		}
+	})
+
+	awsConf := aws.NewConfig().WithCredentials(creds)
+	if len(region) > 0 {
+		awsConf.WithRegion(region)
+	}
+
+	return sess.Copy(awsConf)
+}
+
+// AccountID return the AWS account id of the resource ARN a or empty when a is not a valid ARN
+func AccountID(a string) string {
+	parsed, err := arn.Parse(a)
+	if err != nil {
+		log.Errorf("Error parsing ARN: %s, %v", a, err)
+		return ""
+	}
+	return parsed.AccountID
+}
+
+// IsRegion return true when r is a region of the AWS partitions, the known ones or the ones matching the
+// regions names of the partitions
+// https://docs.aws.amazon.com/general/latest/gr/rande.html
+func IsRegion(r string) bool {
+	_, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), r)
+	return ok
 }
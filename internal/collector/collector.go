@@ -16,14 +16,21 @@ limitations under the License.
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
 )
@@ -35,6 +42,14 @@ import (
 // https://aws.amazon.com/premiumsupport/knowledge-center/cloudwatch-getmetricdata-api/
 // https://aws.amazon.com/cloudwatch/pricing/
 
+const (
+	// Used when the application.metricStatPeriod can't be used as the background polling interval
+	defaultPollingInterval = 5 * time.Minute
+
+	// Used when the application.discoveryInterval is not defined or it is invalid
+	defaultDiscoveryInterval = 10 * time.Minute
+)
+
 type OwnMetrics struct {
 	Up                     prometheus.Gauge
 	Info                   prometheus.Gauge
@@ -46,116 +61,293 @@ type OwnMetrics struct {
 	MetricsScrapesErrors   prometheus.Counter
 	MetricsScrapesEmpty    prometheus.Counter
 	MetricsScrapesMessages prometheus.Counter
+	ScrapePages            prometheus.Gauge
+	SnapshotAge            prometheus.Gauge
+	RefreshDuration        prometheus.Gauge
+	TargetUp               *prometheus.GaugeVec
+	Retries                *prometheus.CounterVec
+	Throttles              *prometheus.CounterVec
 }
 
+// Clients return the AWS CloudWatch and AWS Resource Groups Tagging clients of the region r using the session sess
+type Clients func(sess *session.Session, r string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI)
+
 type Collector struct {
-	conf       *config.All
-	svc        *cloudwatch.CloudWatch
-	metrics    metrics.Metrics
-	mutex      sync.RWMutex
-	ownMetrics *OwnMetrics
+	conf        *config.All
+	sess        *session.Session
+	clients     Clients
+	targets     []*target
+	mutex       sync.RWMutex
+	scrapeMutex sync.Mutex
+	ownMetrics  *OwnMetrics
+
+	// The metrics gotten in the last refresh and when it was done
+	snapshot     []prometheus.Metric
+	snapshotTime time.Time
+
+	// The interval used to discover the metrics queries with dimensions to be discovered
+	discoveryInterval time.Duration
+}
+
+// New create the collector of the metrics queries of c, the metrics queries are scraped
+// using one AWS CloudWatch client for every region, the metrics queries without Region
+// are scraped into the default region of the AWS session sess.
+// When c has targets, all the metrics queries are scraped in every target assuming its role.
+func New(c *config.All, sess *session.Session) *Collector {
+	return NewWithClients(c, sess, nil)
 }
 
-func New(c *config.All, m metrics.Metrics, cwc *cloudwatch.CloudWatch) *Collector {
+// NewWithClients create the collector of the metrics queries of c as New, but using the AWS clients
+// returned by clients, i.e.: to replay recorded responses. When clients is nil the AWS clients are used.
+func NewWithClients(c *config.All, sess *session.Session, clients Clients) *Collector {
+	if clients == nil {
+		clients = DefaultClients
+	}
+
 	return &Collector{
-		conf:    c,
-		svc:     cwc,
-		metrics: m,
-		ownMetrics: &OwnMetrics{
-			Up: prometheus.NewGauge(prometheus.GaugeOpts{
+		conf:              c,
+		sess:              sess,
+		clients:           clients,
+		targets:           newConfTargets(c, sess, clients),
+		discoveryInterval: parseDiscoveryInterval(c),
+		ownMetrics:        newOwnMetrics(c),
+	}
+}
+
+// DefaultClients return the AWS clients of the region r using the session sess
+func DefaultClients(sess *session.Session, r string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) {
+	awsConf := aws.NewConfig().WithRegion(r)
+	return cloudwatch.New(sess, awsConf), resourcegroupstaggingapi.New(sess, awsConf)
+}
+
+// this create the own metrics of the collector, the ones about the scrapes
+func newOwnMetrics(c *config.All) *OwnMetrics {
+	return &OwnMetrics{
+		Up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: c.Application.Name,
+			Name:      "up",
+			Help:      "Was the last scrape of " + c.Application.Name + " successful.",
+		}),
+		Info: prometheus.NewGauge(
+			prometheus.GaugeOpts{
 				Namespace: c.Application.Name,
-				Name:      "up",
-				Help:      "Was the last scrape of " + c.Application.Name + " successful.",
-			}),
-			Info: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace: c.Application.Name,
-					Name:      "build_info",
-					Help: fmt.Sprintf(
-						"A metric with a constant '1' value labeled by version, revision, branch, and goversion from which %s was built.",
-						c.Application.Name,
-					),
-					ConstLabels: prometheus.Labels{
-						"version":   c.Version,
-						"revision":  c.Revision,
-						"branch":    c.Branch,
-						"goversion": c.GoVersion,
-					},
-				},
-			),
-			MetricsTotal: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace: c.Application.Name,
-					Name:      "metrics_total",
-					Help:      "The total number of metrics to be scraped and was defined as metrics queries files.",
-				},
-			),
-			ScrapesSuccess: prometheus.NewCounter(
-				prometheus.CounterOpts{
-					Namespace:   c.Application.Name,
-					Name:        "scrapes_success_total",
-					Help:        "The total number of times AWS CloudWatch API scraped for metrics with successful results.",
-					ConstLabels: nil,
-				},
-			),
-			ScrapesErrors: prometheus.NewCounter(
-				prometheus.CounterOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "scrapes_errors_total",
-					Help:        "The total number of times AWS CloudWatch API scraped for metrics with error results.",
-					ConstLabels: nil,
-				},
-			),
-			ScrapesMessages: prometheus.NewCounter(
-				prometheus.CounterOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "scrapes_messages_total",
-					Help:        "The total number of times AWS CloudWatch API scraped for metrics and we got some message results. (see exporter logs)",
-					ConstLabels: nil,
-				},
-			),
-			MetricsScrapesSuccess: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "metrics_scrapes_success_total",
-					Help:        "The total number of metrics AWS CloudWatch API scraped with successful results.",
-					ConstLabels: nil,
-				},
-			),
-			MetricsScrapesErrors: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "metrics_scrapes_errors_total",
-					Help:        "The total number of metrics AWS CloudWatch API scraped with errors results.",
-					ConstLabels: nil,
+				Name:      "build_info",
+				Help: fmt.Sprintf(
+					"A metric with a constant '1' value labeled by version, revision, branch, and goversion from which %s was built.",
+					c.Application.Name,
+				),
+				ConstLabels: prometheus.Labels{
+					"version":   c.Version,
+					"revision":  c.Revision,
+					"branch":    c.Branch,
+					"goversion": c.GoVersion,
 				},
-			),
-			MetricsScrapesEmpty: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "metrics_scrapes_empty_total",
-					Help:        "The total number of metrics AWS CloudWatch API scraped with empty results.",
-					ConstLabels: nil,
-				},
-			),
-			MetricsScrapesMessages: prometheus.NewGauge(
-				prometheus.GaugeOpts{
-					Namespace:   c.Application.Name,
-					Subsystem:   "collector",
-					Name:        "metrics_scrapes_messages_total",
-					Help:        "The total number of metrics AWS CloudWatch API scraped and we got some messages results. (see exporter logs)",
-					ConstLabels: nil,
-				},
-			),
-		},
+			},
+		),
+		MetricsTotal: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: c.Application.Name,
+				Name:      "metrics_total",
+				Help:      "The total number of metrics to be scraped and was defined as metrics queries files.",
+			},
+		),
+		ScrapesSuccess: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   c.Application.Name,
+				Name:        "scrapes_success_total",
+				Help:        "The total number of times AWS CloudWatch API scraped for metrics with successful results.",
+				ConstLabels: nil,
+			},
+		),
+		ScrapesErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "scrapes_errors_total",
+				Help:        "The total number of times AWS CloudWatch API scraped for metrics with error results.",
+				ConstLabels: nil,
+			},
+		),
+		ScrapesMessages: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "scrapes_messages_total",
+				Help:        "The total number of times AWS CloudWatch API scraped for metrics and we got some message results. (see exporter logs)",
+				ConstLabels: nil,
+			},
+		),
+		MetricsScrapesSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "metrics_scrapes_success_total",
+				Help:        "The total number of metrics AWS CloudWatch API scraped with successful results.",
+				ConstLabels: nil,
+			},
+		),
+		MetricsScrapesErrors: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "metrics_scrapes_errors_total",
+				Help:        "The total number of metrics AWS CloudWatch API scraped with errors results.",
+				ConstLabels: nil,
+			},
+		),
+		MetricsScrapesEmpty: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "metrics_scrapes_empty_total",
+				Help:        "The total number of metrics AWS CloudWatch API scraped with empty results.",
+				ConstLabels: nil,
+			},
+		),
+		MetricsScrapesMessages: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "metrics_scrapes_messages_total",
+				Help:        "The total number of metrics AWS CloudWatch API scraped and we got some messages results. (see exporter logs)",
+				ConstLabels: nil,
+			},
+		),
+		ScrapePages: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "scrape_pages",
+				Help:        "The number of pages fetched from AWS CloudWatch API GetMetricData in the last scrape.",
+				ConstLabels: nil,
+			},
+		),
+		SnapshotAge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "snapshot_age_seconds",
+				Help:        "The age in seconds of the AWS CloudWatch metrics served, this is greater than 0 only when the background polling is enabled.",
+				ConstLabels: nil,
+			},
+		),
+		RefreshDuration: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   c.Application.Name,
+				Subsystem:   "collector",
+				Name:        "refresh_duration_seconds",
+				Help:        "The duration in seconds of the last refresh of the metrics from AWS CloudWatch API.",
+				ConstLabels: nil,
+			},
+		),
+		TargetUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: c.Application.Name,
+				Name:      "target_up",
+				Help:      "Was the last scrape of the AWS account and region successful.",
+			},
+			[]string{metrics.AccountIDLabel, metrics.RegionLabel},
+		),
+		Retries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: c.Application.Name,
+				Subsystem: "collector",
+				Name:      "retries_total",
+				Help:      "The total number of AWS CloudWatch API GetMetricData calls retried by error code.",
+			},
+			[]string{"code"},
+		),
+		Throttles: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: c.Application.Name,
+				Subsystem: "collector",
+				Name:      "throttles_total",
+				Help:      "The total number of AWS CloudWatch API GetMetricData calls throttled by error code.",
+			},
+			[]string{"code"},
+		),
 	}
 }
 
+// Reload replace the configuration and the metrics queries of the collector with the ones of conf,
+// the scrapes in progress finish using the previous ones and the own metrics and counters are kept.
+// The metrics queries discovered are discovered again in the next scrape.
+func (c *Collector) Reload(conf *config.All) {
+	targets := newConfTargets(conf, c.sess, c.clients)
+	discoveryInterval := parseDiscoveryInterval(conf)
+
+	c.mutex.Lock()
+	// the counters of the targets of the same account and region continue, so they are not reset
+	targetsCounters := make(map[string]*counters)
+	for _, t := range c.targets {
+		targetsCounters[t.accountID+","+t.region] = t.counters
+	}
+	for _, t := range targets {
+		if cs, ok := targetsCounters[t.accountID+","+t.region]; ok {
+			t.counters = cs
+		}
+	}
+
+	c.conf = conf
+	c.targets = targets
+	c.discoveryInterval = discoveryInterval
+	c.mutex.Unlock()
+
+	// the targets removed must not be notified anymore
+	c.ownMetrics.TargetUp.Reset()
+}
+
+// this create the targets of the metrics queries of c, one for every region and AWS account of the targets of c,
+// without targets the metrics queries are scraped using the session sess
+func newConfTargets(c *config.All, sess *session.Session, clients Clients) []*target {
+	if len(c.Targets) == 0 {
+		return newTargets(c, sess, "", clients)
+	}
+
+	var targets []*target
+	for _, t := range c.Targets {
+		tsess := awshelper.NewAssumeRoleSession(sess, t.RoleArn, t.ExternalID, t.SessionName, t.Region)
+		targets = append(targets, newTargets(c, tsess, awshelper.AccountID(t.RoleArn), clients)...)
+	}
+	return targets
+}
+
+// this return the application.discoveryInterval of c or the default value when it is not defined or it is invalid
+func parseDiscoveryInterval(c *config.All) time.Duration {
+	if len(c.Application.DiscoveryInterval) == 0 {
+		return defaultDiscoveryInterval
+	}
+
+	di, err := time.ParseDuration(c.Application.DiscoveryInterval)
+	if err != nil || di <= 0 {
+		log.Errorf("Error converting discovery interval: %v, %v, using the default value: %v", c.Application.DiscoveryInterval, err, defaultDiscoveryInterval)
+		return defaultDiscoveryInterval
+	}
+	return di
+}
+
+// this return the context of a scrape with the deadline of the application.scrapeTimeout of c,
+// the scrape doesn't have deadline when it is not defined or it is invalid
+func scrapeContext(c *config.All) (context.Context, context.CancelFunc) {
+	if len(c.Application.ScrapeTimeout) == 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	st, err := time.ParseDuration(c.Application.ScrapeTimeout)
+	if err != nil || st <= 0 {
+		log.Errorf("Error converting scrape timeout: %v, %v, the scrape doesn't have deadline", c.Application.ScrapeTimeout, err)
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), st)
+}
+
+// this return the configuration, targets and discovery interval used to scrape, they are replaced when the collector is reloaded
+func (c *Collector) getState() (*config.All, []*target, time.Duration) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.conf, c.targets, c.discoveryInterval
+}
+
 // Implements prometheus.Collector Interface
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.ownMetrics.Info.Desc()
@@ -168,56 +360,210 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	c.ownMetrics.MetricsScrapesErrors.Describe(ch)
 	c.ownMetrics.MetricsScrapesEmpty.Describe(ch)
 	c.ownMetrics.MetricsScrapesMessages.Describe(ch)
+	c.ownMetrics.ScrapePages.Describe(ch)
+	c.ownMetrics.SnapshotAge.Describe(ch)
+	c.ownMetrics.RefreshDuration.Describe(ch)
+	c.ownMetrics.TargetUp.Describe(ch)
+	c.ownMetrics.Retries.Describe(ch)
+	c.ownMetrics.Throttles.Describe(ch)
 
 	// Describe all metrics constructed from metrics queries files
-	for _, md := range c.metrics.GetMetricsDesc() {
-		ch <- md
+	conf, targets, _ := c.getState()
+	for _, t := range targets {
+		for _, md := range t.getMetrics().GetMetricsDesc() {
+			ch <- md
+		}
+	}
+	for _, m := range newResourcesInfo(conf.Application.Name, targets) {
+		ch <- m.Desc()
 	}
 }
 
 // Implements prometheus.Collector Interface
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	c.mutex.Lock() // To protect metrics from concurrent collects.
-	defer c.mutex.Unlock()
-
 	// this metrics is constant
 	c.ownMetrics.Info.Set(1)
 	ch <- c.ownMetrics.Info
 
-	// Going to scrape metrics from yaml files
-	c.scrape(ch)
+	// When the background polling is disabled every collect is a call to AWS CloudWatch
+	conf, _, _ := c.getState()
+	if !conf.Application.BackgroundPolling {
+		c.refresh()
+	}
+
+	c.mutex.RLock() // To protect the snapshot from concurrent refresh.
+	snapshot := c.snapshot
+	snapshotTime := c.snapshotTime
+	c.mutex.RUnlock()
+
+	if !snapshotTime.IsZero() {
+		c.ownMetrics.SnapshotAge.Set(time.Since(snapshotTime).Seconds())
+	}
+
+	// Notify scraped metrics to prometheus
+	for _, m := range snapshot {
+		ch <- m
+	}
+
+	c.collectOwnMetrics(ch)
+}
+
+// StartBackgroundPolling run a go routine which refresh the metrics from AWS CloudWatch
+// every application.metricStatPeriod, until the ctx is done.
+// The collects served meanwhile use the metrics gotten in the last refresh.
+func (c *Collector) StartBackgroundPolling(ctx context.Context) {
+	conf, _, _ := c.getState()
+	interval, err := time.ParseDuration(conf.Application.MetricStatPeriod)
+	if err != nil || interval <= 0 {
+		log.Errorf("Error converting period: %v, %v, using the default value: %v", conf.Application.MetricStatPeriod, err, defaultPollingInterval)
+		interval = defaultPollingInterval
+	}
+
+	go func() {
+		log.Infof("Collector background polling started, refreshing metrics every %v", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			c.refresh()
+
+			select {
+			case <-ctx.Done():
+				log.Info("Collector background polling stopped")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
 }
 
-// this do the job of scrape the metrics, parse the response from AWS CloudWatch and
-// create the prometheus metrics
-func (c *Collector) scrape(ch chan<- prometheus.Metric) {
+// this scrape the metrics from AWS CloudWatch and replace the snapshot with them
+func (c *Collector) refresh() {
+	c.scrapeMutex.Lock() // To avoid concurrent scrapes.
+	defer c.scrapeMutex.Unlock()
+
+	start := time.Now()
+	ms := c.scrape()
+	c.ownMetrics.RefreshDuration.Set(time.Since(start).Seconds())
+
+	c.mutex.Lock()
+	c.snapshot = ms
+	c.snapshotTime = start
+	c.mutex.Unlock()
+}
+
+// this do the job of scrape the metrics of all the targets, every target is scraped
+// in parallel and its metrics are returned in the order of the targets
+func (c *Collector) scrape() []prometheus.Metric {
+	var ms []prometheus.Metric
 	c.ownMetrics.Up.Set(1)
 
+	// the state is taken once, so a reload doesn't change the scrape in progress
+	conf, targets, discoveryInterval := c.getState()
+
 	// get the timestamps necessary to query metrics from AWS CloudWatch
 	//              points     period        now()
 	//                ↓        ↓→  ←↓         ↓
 	// [(startTime).............................(endTime)] → time
 	startTime, endTime, period := metrics.GetTimeStamps(
 		time.Now(),
-		c.conf.Application.MetricStatPeriod,
-		c.conf.Application.MetricTimeWindow)
+		conf.Application.MetricStatPeriod,
+		conf.Application.MetricTimeWindow)
 
-	// TODO: Implement the paginator using nextoken
-	mdi := c.metrics.GetMetricDataInput(startTime, endTime, period, "")
+	// the failed calls are retried until the deadline of the scrape
+	ctx, cancel := scrapeContext(conf)
+	defer cancel()
+	r := NewRetryer(conf.Application.Retry, c.ownMetrics.Retries, c.ownMetrics.Throttles)
 
-	// number of metrics to be scrape and defined in yaml files
-	c.ownMetrics.MetricsTotal.Set(float64(len(mdi.MetricDataQueries)))
+	// the application.concurrency limit the GetMetricData calls of all the targets together
+	sem := newSemaphore(conf.Application.Concurrency)
 
-	// Scrape AWS CloudWatch Metrics
-	mdo, err := c.svc.GetMetricData(mdi)
-	if err != nil {
+	results := make([]targetResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			results[i] = c.scrapeTarget(ctx, t, startTime, endTime, period, discoveryInterval, sem, r)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// the resources discovered by its tags of all the targets have the same labels
+	ms = append(ms, newResourcesInfo(conf.Application.Name, targets)...)
+
+	var total, pages, batches, failed int
+	for _, tr := range results {
+		total += tr.total
+		pages += tr.pages
+		batches += tr.batches
+		failed += tr.failed
+		ms = append(ms, tr.metrics...)
+	}
+	c.ownMetrics.MetricsTotal.Set(float64(total))
+	c.ownMetrics.ScrapePages.Set(float64(pages))
+
+	// the scrape is considered failed only when none of the batches could be scraped
+	if batches > 0 && failed == batches {
 		c.ownMetrics.Up.Set(0)
-		c.ownMetrics.ScrapesErrors.Inc()
-		log.Errorf("Error getting AWS CloudWatch Metrics %v", err)
-	} else {
+	}
+
+	return ms
+}
+
+// this scrape the metrics of the target t from AWS CloudWatch, its GetMetricData calls wait for the semaphore sem
+func (c *Collector) scrapeTarget(ctx context.Context, t *target, startTime, endTime time.Time, period, discoveryInterval time.Duration, sem chan struct{}, r *Retryer) targetResult {
+	var tr targetResult
+
+	// the metrics queries with dimensions to be discovered are refreshed every application.discoveryInterval
+	t.discover(discoveryInterval)
+	m := t.getMetrics()
+
+	// the metrics queries split in batches of legal GetMetricData calls
+	mdis := m.GetMetricDataInputs(startTime, endTime, period)
+
+	// number of metrics to be scrape and defined in yaml files
+	for _, mdi := range mdis {
+		tr.total += len(mdi.MetricDataQueries)
+	}
+
+	// Scrape AWS CloudWatch Metrics for all the batches following the NextToken until all the pages are fetched
+	results := getMetricDataConcurrently(ctx, t.svc, mdis, sem, r)
+	tr.batches = len(results)
+
+	for i, res := range results {
+		tr.pages += res.pages
+
+		// a failed batch only mark its own metrics queries as failed
+		if res.err != nil {
+			tr.failed++
+			c.ownMetrics.ScrapesErrors.Inc()
+			c.ownMetrics.MetricsScrapesErrors.Add(float64(len(mdis[i].MetricDataQueries)))
+			log.Errorf("Error getting AWS CloudWatch Metrics batch %v of %v in account: %s, region: %s: %v", i+1, len(results), t.accountID, t.region, res.err)
+			continue
+		}
 		c.ownMetrics.ScrapesSuccess.Inc()
+
+		// the results are processed in the order of the batches, so the metrics
+		// are always notified to prometheus in the same order
+		tr.metrics = append(tr.metrics, c.processMetricDataOutput(m, t.counters, startTime, res.mdo)...)
 	}
 
+	// the failures are isolated by target, so a target is down only when none of its batches could be scraped
+	up := 1.0
+	if tr.batches > 0 && tr.failed == tr.batches {
+		up = 0
+	}
+	c.ownMetrics.TargetUp.WithLabelValues(t.accountID, t.region).Set(up)
+
+	return tr
+}
+
+// this parse the response from AWS CloudWatch and return the prometheus metrics created from it,
+// the values of the counters of the time window since startTime are accumulated into cs
+func (c *Collector) processMetricDataOutput(m metrics.Metrics, cs *counters, startTime time.Time, mdo *cloudwatch.GetMetricDataOutput) []prometheus.Metric {
+	var ms []prometheus.Metric
+
 	// Some information came from the metrics scrape
 	// could be and error or a paginator message
 	if len(mdo.Messages) > 0 {
@@ -234,7 +580,7 @@ func (c *Collector) scrape(ch chan<- prometheus.Metric) {
 
 		if *mdr.StatusCode == "InternalError" {
 			c.ownMetrics.MetricsScrapesErrors.Inc()
-			log.Errorf("Error gotten when scrap metric id: %s, label: %s. Check your metrics queries files.", *mdr.Id, *mdr.Label)
+			log.Errorf("Error gotten when scrap metric id: %s, label: %s. Check your metrics queries files.", *mdr.Id, aws.StringValue(mdr.Label))
 			continue
 		}
 
@@ -258,22 +604,42 @@ func (c *Collector) scrape(ch chan<- prometheus.Metric) {
 
 		// mdr.Timestamps[0] and mdr.Values[0] because the first value into de arrays is the newest value
 		// since we set ScanBy: TimestampDescending into GetMetricDataInput()
-		nm := prometheus.NewMetricWithTimestamp(
-			*mdr.Timestamps[0],
-			prometheus.MustNewConstMetric(
-				c.metrics.GetMetricDesc(*mdr.Id),
-				prometheus.GaugeValue,
-				*mdr.Values[0],
-			),
+		vt := m.GetMetricValueType(*mdr.Id)
+		v := m.ScaleMetricValue(*mdr.Id, *mdr.Values[0])
+		ts := *mdr.Timestamps[0]
+
+		// the counters add the values of all the periods not added before
+		if vt == prometheus.CounterValue {
+			var vs []*float64
+			for _, v := range mdr.Values {
+				vs = append(vs, aws.Float64(m.ScaleMetricValue(*mdr.Id, *v)))
+			}
+			v, ts = cs.add(*mdr.Id+","+aws.StringValue(mdr.Label), startTime, mdr.Timestamps, vs)
+		}
+
+		cm, err := m.NewConstMetric(
+			*mdr.Id,
+			vt,
+			v,
+			prometheus.Labels{metrics.ExpressionLabel: aws.StringValue(mdr.Label)},
 		)
+		if err != nil {
+			c.ownMetrics.MetricsScrapesErrors.Inc()
+			log.Errorf("Error creating prometheus metric for metric id: %s, %v", *mdr.Id, err)
+			continue
+		}
+		nm := prometheus.NewMetricWithTimestamp(ts, cm)
 
 		c.ownMetrics.MetricsScrapesSuccess.Inc()
 
-		// Notify scraped metrics to prometheus
-		ch <- nm
+		ms = append(ms, nm)
 	}
 
-	// Notify own metrics
+	return ms
+}
+
+// Notify own metrics
+func (c *Collector) collectOwnMetrics(ch chan<- prometheus.Metric) {
 	ch <- c.ownMetrics.Up
 	ch <- c.ownMetrics.MetricsTotal
 	ch <- c.ownMetrics.ScrapesSuccess
@@ -283,4 +649,10 @@ func (c *Collector) scrape(ch chan<- prometheus.Metric) {
 	ch <- c.ownMetrics.MetricsScrapesErrors
 	ch <- c.ownMetrics.MetricsScrapesEmpty
 	ch <- c.ownMetrics.MetricsScrapesMessages
+	ch <- c.ownMetrics.ScrapePages
+	ch <- c.ownMetrics.SnapshotAge
+	ch <- c.ownMetrics.RefreshDuration
+	c.ownMetrics.TargetUp.Collect(ch)
+	c.ownMetrics.Retries.Collect(ch)
+	c.ownMetrics.Throttles.Collect(ch)
 }
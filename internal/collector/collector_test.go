@@ -0,0 +1,523 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/cwmock"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/replay"
+	"gopkg.in/yaml.v3"
+)
+
+func prepareConf() *config.All {
+	MetricDataQueriesYaml := `
+MetricDataQueries:
+  - Id: m1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Stat: Average
+`
+	c := &config.All{}
+	err := yaml.Unmarshal([]byte(MetricDataQueriesYaml), &c.MetricDataQueriesConf)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	c.Application.Name = "aws_cloudwatch_exporter"
+	c.Application.MetricStatPeriod = "5m"
+	c.Application.MetricTimeWindow = "10m"
+	c.Application.Concurrency = 1
+	return c
+}
+
+// the target of the collectors of the tests, by default the account 123456789012 and region eu-west-1 without tagging client
+type testTarget struct {
+	accountID string
+	region    string
+	tagging   resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+}
+
+type testCollectorOption func(*testTarget)
+
+// this set the account id of the target, empty means without the label account_id
+func withAccountID(id string) testCollectorOption {
+	return func(t *testTarget) { t.accountID = id }
+}
+
+// this set the region of the target and of its metrics queries without Region
+func withRegion(r string) testCollectorOption {
+	return func(t *testTarget) { t.region = r }
+}
+
+// this set the AWS Resource Groups Tagging client of the target
+func withTagging(tagging resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) testCollectorOption {
+	return func(t *testTarget) { t.tagging = tagging }
+}
+
+// this create a collector with one target which use the AWS CloudWatch client svc
+func newTestCollector(c *config.All, svc cloudwatchiface.CloudWatchAPI, opts ...testCollectorOption) *Collector {
+	tt := &testTarget{accountID: "123456789012", region: "eu-west-1"}
+	for _, opt := range opts {
+		opt(tt)
+	}
+
+	groups, _ := config.ByRegion(c.MetricDataQueries, tt.region)
+	return &Collector{
+		conf:              c,
+		targets:           []*target{newTargetWithClients(c, svc, tt.tagging, tt.accountID, tt.region, groups[tt.region])},
+		discoveryInterval: defaultDiscoveryInterval,
+		ownMetrics:        newOwnMetrics(c),
+	}
+}
+
+// this return the values of the metrics of the collector c by its name and sorted labels
+func gather(t *testing.T, c *Collector) map[string]float64 {
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var ls []string
+			for _, l := range m.GetLabel() {
+				ls = append(ls, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			sort.Strings(ls)
+
+			k := mf.GetName()
+			if len(ls) > 0 {
+				k += "{" + strings.Join(ls, ",") + "}"
+			}
+			switch {
+			case m.GetGauge() != nil:
+				values[k] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[k] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func newMetricDataResult(id, status string, vs ...float64) *cloudwatch.MetricDataResult {
+	mdr := &cloudwatch.MetricDataResult{
+		Id:         aws.String(id),
+		Label:      aws.String("aws_ec_2_cpu_utilization_average"),
+		StatusCode: aws.String(status),
+	}
+	ts := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+	for i, v := range vs {
+		mdr.Timestamps = append(mdr.Timestamps, aws.Time(ts.Add(time.Duration(-i)*5*time.Minute)))
+		mdr.Values = append(mdr.Values, aws.Float64(v))
+	}
+	return mdr
+}
+
+const (
+	metricName   = `aws_ec_2_cpu_utilization_average{account_id="123456789012",dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`
+	targetUp     = `aws_cloudwatch_exporter_target_up{account_id="123456789012",region="eu-west-1"}`
+	up           = "aws_cloudwatch_exporter_up"
+	pages        = "aws_cloudwatch_exporter_collector_scrape_pages"
+	success      = "aws_cloudwatch_exporter_scrapes_success_total"
+	errs         = "aws_cloudwatch_exporter_collector_scrapes_errors_total"
+	messages     = "aws_cloudwatch_exporter_collector_scrapes_messages_total"
+	mSuccess     = "aws_cloudwatch_exporter_collector_metrics_scrapes_success_total"
+	mErrors      = "aws_cloudwatch_exporter_collector_metrics_scrapes_errors_total"
+	mEmpty       = "aws_cloudwatch_exporter_collector_metrics_scrapes_empty_total"
+	mMessages    = "aws_cloudwatch_exporter_collector_metrics_scrapes_messages_total"
+	metricsTotal = "aws_cloudwatch_exporter_metrics_total"
+	snapshotAge  = "aws_cloudwatch_exporter_collector_snapshot_age_seconds"
+)
+
+func TestCollector_Collect(t *testing.T) {
+	tests := []struct {
+		name      string
+		outputs   []*cloudwatch.GetMetricDataOutput
+		err       error
+		want      map[string]float64
+		wantNotIn []string
+	}{
+		{
+			name: "Success",
+			outputs: []*cloudwatch.GetMetricDataOutput{
+				{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodeComplete, 12.5, 10)}},
+			},
+			want: map[string]float64{
+				metricName: 12.5, up: 1, targetUp: 1, pages: 1, success: 1, errs: 0, mSuccess: 1, mErrors: 0, metricsTotal: 1,
+			},
+		},
+		{
+			name: "Pages",
+			outputs: []*cloudwatch.GetMetricDataOutput{
+				{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodePartialData, 12.5)}, NextToken: aws.String("token")},
+				{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodeComplete)}},
+			},
+			want: map[string]float64{
+				metricName: 12.5, up: 1, targetUp: 1, pages: 2, success: 1, mSuccess: 1,
+			},
+		},
+		{
+			name: "APIError",
+			err:  errors.New("AccessDenied: User is not authorized to perform: cloudwatch:GetMetricData"),
+			want: map[string]float64{
+				up: 0, targetUp: 0, pages: 0, success: 0, errs: 1, mSuccess: 0, mErrors: 1,
+			},
+			wantNotIn: []string{metricName},
+		},
+		{
+			name: "InternalError",
+			outputs: []*cloudwatch.GetMetricDataOutput{
+				{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodeInternalError)}},
+			},
+			want: map[string]float64{
+				up: 1, targetUp: 1, success: 1, errs: 0, mSuccess: 0, mErrors: 1,
+			},
+			wantNotIn: []string{metricName},
+		},
+		{
+			name: "Messages",
+			outputs: []*cloudwatch.GetMetricDataOutput{
+				{
+					Messages: []*cloudwatch.MessageData{{Code: aws.String("MaxQueryTimeRangeExceed"), Value: aws.String("The time range is too long")}},
+					MetricDataResults: []*cloudwatch.MetricDataResult{func() *cloudwatch.MetricDataResult {
+						mdr := newMetricDataResult("m1", cloudwatch.StatusCodeComplete, 12.5)
+						mdr.Messages = []*cloudwatch.MessageData{{Code: aws.String("ArithmeticError"), Value: aws.String("Division by zero")}}
+						return mdr
+					}()},
+				},
+			},
+			want: map[string]float64{
+				metricName: 12.5, up: 1, targetUp: 1, messages: 1, mMessages: 1, mSuccess: 1,
+			},
+		},
+		{
+			name: "EmptyValues",
+			outputs: []*cloudwatch.GetMetricDataOutput{
+				{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodeComplete)}},
+			},
+			want: map[string]float64{
+				up: 1, targetUp: 1, mEmpty: 1, mSuccess: 0, mErrors: 0,
+			},
+			wantNotIn: []string{metricName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeCloudWatch{outputs: tt.outputs, err: tt.err}
+			got := gather(t, newTestCollector(prepareConf(), svc))
+
+			for k, want := range tt.want {
+				v, ok := got[k]
+				if !ok || v != want {
+					t.Errorf("Collect(): got: %v, %v --> want: %v for %s", v, ok, want, k)
+				}
+			}
+			for _, k := range tt.wantNotIn {
+				if _, ok := got[k]; ok {
+					t.Errorf("Collect(): got: %s --> want: not collected", k)
+				}
+			}
+		})
+	}
+}
+
+func TestCollector_CollectCounter(t *testing.T) {
+	c := prepareConf()
+	c.MetricDataQueries[0].Type = config.MetricTypeCounter
+	c.MetricDataQueries[0].MetricStat.Stat = cloudwatch.StatisticSum
+
+	mdr := func(ts time.Time, v float64) *cloudwatch.GetMetricDataOutput {
+		return &cloudwatch.GetMetricDataOutput{MetricDataResults: []*cloudwatch.MetricDataResult{{
+			Id:         aws.String("m1"),
+			Label:      aws.String("m1"),
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(ts)},
+			Values:     []*float64{aws.Float64(v)},
+		}}}
+	}
+	// the periods must be into the time window of the scrape, the older ones are not added
+	t1 := time.Now().Truncate(5 * time.Minute).Add(-5 * time.Minute)
+	svc := &fakeCloudWatch{outputs: []*cloudwatch.GetMetricDataOutput{mdr(t1, 10), mdr(t1, 10), mdr(t1.Add(5*time.Minute), 5)}}
+	col := newTestCollector(c, svc)
+
+	name := `aws_ec_2_cpu_utilization_sum_total{account_id="123456789012",dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`
+	var got []float64
+	for i := 0; i < 3; i++ {
+		got = append(got, gather(t, col)[name])
+	}
+	want := []float64{10, 10, 15}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect(): got: %v --> want: %v", got, want)
+	}
+}
+
+func TestCollector_ReloadCounter(t *testing.T) {
+	c := prepareConf()
+	c.MetricDataQueries[0].Type = config.MetricTypeCounter
+	c.MetricDataQueries[0].MetricStat.Stat = cloudwatch.StatisticSum
+
+	// the periods must be into the time window of the scrape, the older ones are not added
+	t1 := time.Now().Truncate(5 * time.Minute).Add(-5 * time.Minute)
+	svc := &fakeCloudWatch{outputs: []*cloudwatch.GetMetricDataOutput{
+		{MetricDataResults: []*cloudwatch.MetricDataResult{{
+			Id:         aws.String("m1"),
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(t1)},
+			Values:     []*float64{aws.Float64(10)},
+		}}},
+		{MetricDataResults: []*cloudwatch.MetricDataResult{{
+			Id:         aws.String("m1"),
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(t1.Add(5 * time.Minute)), aws.Time(t1)},
+			Values:     []*float64{aws.Float64(5), aws.Float64(10)},
+		}}},
+	}}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	col := NewWithClients(c, sess, fakeClients(map[string]*fakeCloudWatch{"eu-west-1": svc}))
+
+	name := `aws_ec_2_cpu_utilization_sum_total{dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`
+	var got []float64
+	got = append(got, gather(t, col)[name])
+	// the reload with the same configuration must continue the counter
+	col.Reload(c)
+	got = append(got, gather(t, col)[name])
+	want := []float64{10, 15}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect(): got: %v --> want: %v", got, want)
+	}
+}
+
+func TestCollector_CollectBackgroundPolling(t *testing.T) {
+	c := prepareConf()
+	c.Application.BackgroundPolling = true
+
+	output := func(v float64) *cloudwatch.GetMetricDataOutput {
+		return &cloudwatch.GetMetricDataOutput{MetricDataResults: []*cloudwatch.MetricDataResult{newMetricDataResult("m1", cloudwatch.StatusCodeComplete, v)}}
+	}
+	svc := &fakeCloudWatch{outputs: []*cloudwatch.GetMetricDataOutput{output(10), output(20)}}
+	col := newTestCollector(c, svc)
+
+	// the collects don't call AWS CloudWatch, they serve the last refresh
+	got := gather(t, col)
+	if _, ok := got[metricName]; ok || svc.calls() != 0 {
+		t.Errorf("Collect(): got: %v, %v calls --> want: without metrics and calls before the first refresh", got, svc.calls())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	col.StartBackgroundPolling(ctx)
+
+	// the first refresh is done when the polling starts
+	refreshed := func() bool {
+		col.mutex.RLock()
+		defer col.mutex.RUnlock()
+		return !col.snapshotTime.IsZero()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !refreshed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		got = gather(t, col)
+		if got[metricName] != 10 || svc.calls() != 1 {
+			t.Errorf("Collect(): got: %v, %v calls --> want: %v, %v calls", got[metricName], svc.calls(), 10, 1)
+		}
+	}
+	if got[snapshotAge] <= 0 {
+		t.Errorf("Collect(): got: %v --> want: the age of the snapshot", got[snapshotAge])
+	}
+
+	// the next refresh replace the snapshot
+	col.refresh()
+	if got = gather(t, col); got[metricName] != 20 || svc.calls() != 2 {
+		t.Errorf("Collect(): got: %v, %v calls --> want: %v, %v calls", got[metricName], svc.calls(), 20, 2)
+	}
+}
+
+func TestCollector_scrapeInput(t *testing.T) {
+	svc := &fakeCloudWatch{}
+	gather(t, newTestCollector(prepareConf(), svc))
+
+	if len(svc.inputs) != 1 {
+		t.Fatalf("GetMetricData(): got: %v calls --> want: %v", len(svc.inputs), 1)
+	}
+	qs := svc.inputs[0].MetricDataQueries
+	if len(qs) != 1 || aws.StringValue(qs[0].Id) != "m1" || aws.Int64Value(qs[0].MetricStat.Period) != 300 {
+		t.Errorf("GetMetricData(): got: %v --> want: the metric query m1 with period 300", qs)
+	}
+}
+
+func TestCollector_CollectReplay(t *testing.T) {
+	fs, err := replay.Load("testdata/replay")
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		region string
+		want   map[string]float64
+	}{
+		{
+			name:   "Recorded",
+			region: "eu-west-1",
+			want: map[string]float64{
+				`aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`: 12.5,
+				`aws_cloudwatch_exporter_up`: 1,
+			},
+		},
+		{
+			name:   "NotRecorded",
+			region: "us-east-1",
+			want: map[string]float64{
+				`aws_cloudwatch_exporter_up`: 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			col := newTestCollector(prepareConf(), fs.Client(tt.region), withAccountID(""), withRegion(tt.region), withTagging(fs.Tagging(tt.region)))
+
+			got := gather(t, col)
+			for k, v := range tt.want {
+				if gv, ok := got[k]; !ok || gv != v {
+					t.Errorf("Collect(): %s got: %v --> want: %v", k, gv, v)
+				}
+			}
+		})
+	}
+}
+
+func TestCollector_CollectReplayDiscovery(t *testing.T) {
+	mock := cwmock.New(&cwmock.Dataset{
+		Metrics: []cwmock.Metric{
+			{
+				Namespace:  "AWS/EC2",
+				MetricName: "CPUUtilization",
+				Dimensions: []cwmock.Dimension{{Name: "InstanceId", Value: "i-1"}},
+				Values:     []float64{42},
+			},
+			{
+				Namespace:  "AWS/EC2",
+				MetricName: "CPUUtilization",
+				Dimensions: []cwmock.Dimension{{Name: "InstanceId", Value: "i-2"}},
+				Values:     []float64{24},
+			},
+		},
+	})
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+
+	// the dimensions discovered with ListMetrics are recorded with the metrics
+	c := prepareConf()
+	c.MetricDataQueries[0].MetricStat.Metric.Dimensions[0].Value = config.DimensionWildcard
+	dir := t.TempDir()
+	recorded := gather(t, newTestCollector(c, replay.NewRecorder(cloudwatch.New(sess), dir, "eu-west-1"), withAccountID("")))
+
+	fs, err := replay.Load(dir)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	got := gather(t, newTestCollector(c, fs.Client("eu-west-1"), withAccountID(""), withTagging(fs.Tagging("eu-west-1"))))
+
+	for _, k := range []string{
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-1",instance_id="i-1",region="eu-west-1"}`,
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-2",instance_id="i-2",region="eu-west-1"}`,
+	} {
+		if gv, ok := got[k]; !ok || gv != recorded[k] {
+			t.Errorf("Collect(): %s got: %v --> want: %v", k, gv, recorded[k])
+		}
+	}
+}
+
+func TestCollector_CollectRetry(t *testing.T) {
+	mock := cwmock.New(&cwmock.Dataset{
+		Metrics: []cwmock.Metric{{
+			Namespace:  "AWS/EC2",
+			MetricName: "CPUUtilization",
+			Dimensions: []cwmock.Dimension{{Name: "InstanceId", Value: "i-1234567890"}},
+			Values:     []float64{42},
+		}},
+		Failures: []cwmock.Failure{{Action: cwmock.ActionGetMetricData, Code: "Throttling", Message: "Rate exceeded", Times: 2}},
+	})
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+
+	c := prepareConf()
+	c.Application.Retry = config.Retry{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	col := newTestCollector(c, cloudwatch.New(sess), withAccountID(""))
+
+	got := gather(t, col)
+	want := map[string]float64{
+		`aws_cloudwatch_exporter_up`:                                                                                     1,
+		`aws_cloudwatch_exporter_collector_retries_total{code="Throttling"}`:                                             2,
+		`aws_cloudwatch_exporter_collector_throttles_total{code="Throttling"}`:                                           2,
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`: 42,
+	}
+	for k, v := range want {
+		if gv, ok := got[k]; !ok || gv != v {
+			t.Errorf("Collect(): %s got: %v --> want: %v", k, gv, v)
+		}
+	}
+
+	// the AWS SDK retries are disabled, so every call is a retry of the collector
+	if calls := mock.Calls(cwmock.ActionGetMetricData); calls != 3 {
+		t.Errorf("Collect(): got: %v calls --> want: %v calls", calls, 3)
+	}
+}
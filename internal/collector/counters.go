@@ -0,0 +1,94 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// counters accumulate the values of the metrics queries with Type counter, AWS CloudWatch return the value
+// of every period (i.e.: the Sum of the requests) and the counters add every period once, the newest period
+// could be partial and its value grows until it is complete, so only the growth of a period already added is added
+type counters struct {
+	mutex  sync.Mutex
+	values map[string]*counter
+}
+
+// the accumulated value of a counter, the timestamp of the newest period added, the start of the periods
+// which could be added and the last value added of every period into the time window of the metric query
+type counter struct {
+	value     float64
+	timestamp time.Time
+	start     time.Time
+	periods   map[time.Time]float64
+}
+
+func newCounters() *counters {
+	return &counters{
+		values: make(map[string]*counter),
+	}
+}
+
+// this add the values vs of the periods not added before and the growth of the periods already added to the
+// counter of the key and return its value, the timestamps ts and the values vs are sorted from the newest one
+// and start is the start of the time window of the query. The first time only the newest period is added, so
+// the counter doesn't depend on the time window of the queries, after that a period which shows up late is
+// added while it is into the time window
+func (cs *counters) add(key string, start time.Time, ts []*time.Time, vs []*float64) (float64, time.Time) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	c, ok := cs.values[key]
+	if !ok {
+		c = &counter{value: *vs[0], timestamp: *ts[0], start: *ts[0], periods: map[time.Time]float64{*ts[0]: *vs[0]}}
+		cs.values[key] = c
+		return c.value, c.timestamp
+	}
+
+	n := len(ts)
+	if len(vs) < n {
+		n = len(vs)
+	}
+	for i := 0; i < n; i++ {
+		v, ok := c.periods[*ts[i]]
+		switch {
+		case ok && *vs[i] > v:
+			// the value of a partial period grows, the counter can't decrease when it is revised
+			c.value += *vs[i] - v
+			c.periods[*ts[i]] = *vs[i]
+		case !ok && !ts[i].Before(c.start):
+			c.value += *vs[i]
+			c.periods[*ts[i]] = *vs[i]
+		}
+	}
+	if ts[0].After(c.timestamp) {
+		c.timestamp = *ts[0]
+	}
+
+	// the periods out of the time window are not returned anymore, so they are forgotten
+	// and never added again
+	if start.After(c.start) {
+		c.start = start
+	}
+	for p := range c.periods {
+		if p.Before(c.start) {
+			delete(c.periods, p)
+		}
+	}
+
+	return c.value, c.timestamp
+}
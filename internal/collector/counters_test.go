@@ -0,0 +1,185 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func Test_counters_add(t *testing.T) {
+	t1 := time.Date(2020, 5, 10, 11, 10, 0, 0, time.UTC)
+	t2 := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+	t3 := time.Date(2020, 5, 10, 11, 0, 0, 0, time.UTC)
+	start := t3
+
+	cs := newCounters()
+
+	// every scrape has the timestamps and values sorted from the newest one
+	scrapes := []struct {
+		name          string
+		ts            []*time.Time
+		vs            []*float64
+		want          float64
+		wantTimestamp time.Time
+	}{
+		{
+			name:          "FirstOnlyNewest",
+			ts:            []*time.Time{aws.Time(t2), aws.Time(t3)},
+			vs:            []*float64{aws.Float64(10), aws.Float64(5)},
+			want:          10,
+			wantTimestamp: t2,
+		},
+		{
+			name:          "SamePeriods",
+			ts:            []*time.Time{aws.Time(t2), aws.Time(t3)},
+			vs:            []*float64{aws.Float64(10), aws.Float64(5)},
+			want:          10,
+			wantTimestamp: t2,
+		},
+		{
+			name:          "NewPeriod",
+			ts:            []*time.Time{aws.Time(t1), aws.Time(t2)},
+			vs:            []*float64{aws.Float64(7), aws.Float64(10)},
+			want:          17,
+			wantTimestamp: t1,
+		},
+	}
+	for _, tt := range scrapes {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotTimestamp := cs.add("m1,label", start, tt.ts, tt.vs)
+			if got != tt.want || !gotTimestamp.Equal(tt.wantTimestamp) {
+				t.Errorf("add(): got: %v, %v --> want: %v, %v", got, gotTimestamp, tt.want, tt.wantTimestamp)
+			}
+		})
+	}
+}
+
+func Test_counters_addPartialPeriod(t *testing.T) {
+	t1 := time.Date(2020, 5, 10, 11, 10, 0, 0, time.UTC)
+	t2 := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+	start := t2
+
+	cs := newCounters()
+
+	// the newest period is partial and its value grows until it is complete
+	scrapes := []struct {
+		name string
+		ts   []*time.Time
+		vs   []*float64
+		want float64
+	}{
+		{
+			name: "FirstPartial",
+			ts:   []*time.Time{aws.Time(t2)},
+			vs:   []*float64{aws.Float64(10)},
+			want: 10,
+		},
+		{
+			name: "PartialGrows",
+			ts:   []*time.Time{aws.Time(t2)},
+			vs:   []*float64{aws.Float64(50)},
+			want: 50,
+		},
+		{
+			name: "NewPeriod",
+			ts:   []*time.Time{aws.Time(t1), aws.Time(t2)},
+			vs:   []*float64{aws.Float64(5), aws.Float64(50)},
+			want: 55,
+		},
+		{
+			name: "NewPeriodGrows",
+			ts:   []*time.Time{aws.Time(t1), aws.Time(t2)},
+			vs:   []*float64{aws.Float64(8), aws.Float64(50)},
+			want: 58,
+		},
+		{
+			name: "RevisedDown",
+			ts:   []*time.Time{aws.Time(t1), aws.Time(t2)},
+			vs:   []*float64{aws.Float64(6), aws.Float64(50)},
+			want: 58,
+		},
+	}
+	for _, tt := range scrapes {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := cs.add("m1,label", start, tt.ts, tt.vs); got != tt.want {
+				t.Errorf("add(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_counters_addLatePeriod(t *testing.T) {
+	t1 := time.Date(2020, 5, 10, 11, 15, 0, 0, time.UTC)
+	t2 := time.Date(2020, 5, 10, 11, 10, 0, 0, time.UTC)
+	t3 := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+
+	cs := newCounters()
+
+	// a period could show up later than a newer one, it is added while it is into the time window
+	scrapes := []struct {
+		name  string
+		start time.Time
+		ts    []*time.Time
+		vs    []*float64
+		want  float64
+	}{
+		{
+			name:  "First",
+			start: t3.Add(-5 * time.Minute),
+			ts:    []*time.Time{aws.Time(t3)},
+			vs:    []*float64{aws.Float64(10)},
+			want:  10,
+		},
+		{
+			name:  "MissingPeriod",
+			start: t3,
+			ts:    []*time.Time{aws.Time(t1), aws.Time(t3)},
+			vs:    []*float64{aws.Float64(5), aws.Float64(10)},
+			want:  15,
+		},
+		{
+			name:  "LatePeriod",
+			start: t3,
+			ts:    []*time.Time{aws.Time(t1), aws.Time(t2), aws.Time(t3)},
+			vs:    []*float64{aws.Float64(5), aws.Float64(3), aws.Float64(10)},
+			want:  18,
+		},
+		{
+			name:  "WindowMoves",
+			start: t2,
+			ts:    []*time.Time{aws.Time(t1), aws.Time(t2)},
+			vs:    []*float64{aws.Float64(5), aws.Float64(3)},
+			want:  18,
+		},
+		{
+			name:  "OutOfWindowNotAddedAgain",
+			start: t2,
+			ts:    []*time.Time{aws.Time(t1), aws.Time(t2), aws.Time(t3)},
+			vs:    []*float64{aws.Float64(5), aws.Float64(3), aws.Float64(10)},
+			want:  18,
+		},
+	}
+	for _, tt := range scrapes {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := cs.add("m1,label", tt.start, tt.ts, tt.vs); got != tt.want {
+				t.Errorf("add(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
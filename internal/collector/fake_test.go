@@ -0,0 +1,153 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+)
+
+// fakeCloudWatch is an AWS CloudWatch client which return scripted responses, only the methods
+// used by the collector are implemented, the others panic because the embedded interface is nil
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	mutex sync.Mutex
+
+	// The outputs returned by GetMetricData in order, one for every call
+	outputs []*cloudwatch.GetMetricDataOutput
+
+	// The error returned by all the GetMetricData calls
+	err error
+
+	// The inputs of the GetMetricData calls received
+	inputs []*cloudwatch.GetMetricDataInput
+
+	// The metrics returned by ListMetrics into one page
+	metrics []*cloudwatch.Metric
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(_ aws.Context, in *cloudwatch.GetMetricDataInput, _ ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.inputs = append(f.inputs, in)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.outputs) == 0 {
+		return &cloudwatch.GetMetricDataOutput{}, nil
+	}
+
+	out := f.outputs[0]
+	f.outputs = f.outputs[1:]
+	return out, nil
+}
+
+func (f *fakeCloudWatch) ListMetricsPages(_ *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	f.mutex.Lock()
+	page := &cloudwatch.ListMetricsOutput{Metrics: f.metrics}
+	f.mutex.Unlock()
+
+	fn(page, true)
+	return nil
+}
+
+// this return the number of GetMetricData calls received
+func (f *fakeCloudWatch) calls() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.inputs)
+}
+
+// slowCloudWatch is an AWS CloudWatch client which take delay to return the value 1 for every metric query,
+// the batches whose first metric query Id is into fails return an error. The calls in progress are counted
+// by calls, which could be shared by several clients
+type slowCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	delay time.Duration
+	fails map[string]bool
+	calls *callsCounter
+}
+
+// callsCounter count the calls in progress and the maximum of them at the same time
+type callsCounter struct {
+	mutex   sync.Mutex
+	current int
+	max     int
+}
+
+func (c *callsCounter) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+}
+
+func (c *callsCounter) end() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current--
+}
+
+func (c *callsCounter) getMax() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.max
+}
+
+func (f *slowCloudWatch) GetMetricDataWithContext(_ aws.Context, in *cloudwatch.GetMetricDataInput, _ ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	f.calls.start()
+	defer f.calls.end()
+	time.Sleep(f.delay)
+
+	if f.fails[aws.StringValue(in.MetricDataQueries[0].Id)] {
+		return nil, errors.New("failed batch")
+	}
+
+	out := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range in.MetricDataQueries {
+		out.MetricDataResults = append(out.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC))},
+			Values:     []*float64{aws.Float64(1)},
+		})
+	}
+	return out, nil
+}
+
+// this return the AWS clients factory of the collector which use the client of svcs of every region,
+// the regions without client use an empty fake client
+func fakeClients(svcs map[string]*fakeCloudWatch) Clients {
+	return func(_ *session.Session, r string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) {
+		if svc, ok := svcs[r]; ok {
+			return svc, nil
+		}
+		return &fakeCloudWatch{}, nil
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetMetricData call the AWS CloudWatch API GetMetricData following the NextToken until
+// all the pages are fetched. The results of every page are merged by metric Id, so the
+// returned output contains only one cloudwatch.MetricDataResult per metric query.
+// The number of pages fetched is returned even when an error occurs.
+// Every page is retried by the retryer r, the AWS SDK retries are disabled so they are not added to them.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_GetMetricData.html
+func GetMetricData(ctx context.Context, svc cloudwatchiface.CloudWatchAPI, mdi *cloudwatch.GetMetricDataInput, r *Retryer) (*cloudwatch.GetMetricDataOutput, int, error) {
+	// don't modify the input of the caller when the NextToken is set
+	in := *mdi
+
+	mdo := &cloudwatch.GetMetricDataOutput{}
+	results := make(map[string]*cloudwatch.MetricDataResult)
+	pages := 0
+
+	for {
+		var page *cloudwatch.GetMetricDataOutput
+		err := r.Do(ctx, func() error {
+			var err error
+			page, err = svc.GetMetricDataWithContext(ctx, &in, withoutSDKRetries)
+			return err
+		})
+		if err != nil {
+			return nil, pages, err
+		}
+		pages++
+
+		mdo.Messages = append(mdo.Messages, page.Messages...)
+		for _, mdr := range page.MetricDataResults {
+			mergeMetricDataResult(mdo, results, mdr)
+		}
+
+		if page.NextToken == nil || len(*page.NextToken) == 0 {
+			break
+		}
+		log.Debugf("GetMetricData page %v has NextToken, fetching the next page", pages)
+		in.NextToken = page.NextToken
+	}
+
+	return mdo, pages, nil
+}
+
+// GetMetricDataBatches call GetMetricData for every one of the batches of metrics queries, one after
+// the other, and merge the results of all of them into one output. It is the sequential path used by
+// the command "metrics get", the collector use getMetricDataConcurrently to isolate the failed batches.
+// The total number of pages fetched is returned even when an error occurs.
+func GetMetricDataBatches(ctx context.Context, svc cloudwatchiface.CloudWatchAPI, mdis []*cloudwatch.GetMetricDataInput, r *Retryer) (*cloudwatch.GetMetricDataOutput, int, error) {
+	mdo := &cloudwatch.GetMetricDataOutput{}
+	results := make(map[string]*cloudwatch.MetricDataResult)
+	pages := 0
+
+	for i, mdi := range mdis {
+		log.Debugf("Getting metrics batch %v of %v with %v metrics queries", i+1, len(mdis), len(mdi.MetricDataQueries))
+
+		out, p, err := GetMetricData(ctx, svc, mdi, r)
+		pages += p
+		if err != nil {
+			return nil, pages, err
+		}
+
+		mdo.Messages = append(mdo.Messages, out.Messages...)
+		for _, mdr := range out.MetricDataResults {
+			mergeMetricDataResult(mdo, results, mdr)
+		}
+	}
+
+	return mdo, pages, nil
+}
+
+// this disable the retries of the AWS SDK of the request, they are done by the Retryer
+func withoutSDKRetries(req *request.Request) {
+	req.Retryer = client.NoOpRetryer{}
+}
+
+// batchResult is the result of the GetMetricData calls done for one batch of metrics queries
+type batchResult struct {
+	mdo   *cloudwatch.GetMetricDataOutput
+	pages int
+	err   error
+}
+
+// this return the semaphore which limit the GetMetricData calls executed in parallel to concurrency,
+// it is shared by all the targets of a scrape
+func newSemaphore(concurrency int) chan struct{} {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return make(chan struct{}, concurrency)
+}
+
+// getMetricDataConcurrently call GetMetricData for every one of the batches of metrics queries,
+// every batch waits for the semaphore sem, so at most cap(sem) batches are fetched at the same time.
+// The results are returned in the same order of the batches, no matter the order they finish.
+func getMetricDataConcurrently(ctx context.Context, svc cloudwatchiface.CloudWatchAPI, mdis []*cloudwatch.GetMetricDataInput, sem chan struct{}, r *Retryer) []batchResult {
+	results := make([]batchResult, len(mdis))
+
+	var wg sync.WaitGroup
+	for i := range mdis {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = batchResult{err: ctx.Err()}
+				return
+			}
+
+			log.Debugf("Getting metrics batch %v of %v with %v metrics queries", i+1, len(mdis), len(mdis[i].MetricDataQueries))
+			mdo, pages, err := GetMetricData(ctx, svc, mdis[i], r)
+			results[i] = batchResult{mdo: mdo, pages: pages, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// mergeMetricDataResult add the mdr to the mdo results, when a result with the same Id and Label
+// already exist (came in a previous page) its values, timestamps and messages are appended.
+// The Label is part of the key because some metric math expressions like ANOMALY_DETECTION_BAND
+// return more than one time series with the same Id.
+func mergeMetricDataResult(mdo *cloudwatch.GetMetricDataOutput, results map[string]*cloudwatch.MetricDataResult, mdr *cloudwatch.MetricDataResult) {
+	if mdr.Id == nil {
+		return
+	}
+
+	key := *mdr.Id + "\x00" + aws.StringValue(mdr.Label)
+	r, ok := results[key]
+	if !ok {
+		results[key] = mdr
+		mdo.MetricDataResults = append(mdo.MetricDataResults, mdr)
+		return
+	}
+
+	// pages are fetched in order, since we set ScanBy: TimestampDescending the values
+	// of the next page are older than the values already gotten
+	r.Values = append(r.Values, mdr.Values...)
+	r.Timestamps = append(r.Timestamps, mdr.Timestamps...)
+	r.Messages = append(r.Messages, mdr.Messages...)
+
+	// an error in any page is an error for the whole metric
+	if r.StatusCode == nil || *r.StatusCode != cloudwatch.StatusCodeInternalError {
+		r.StatusCode = mdr.StatusCode
+	}
+}
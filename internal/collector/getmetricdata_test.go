@@ -0,0 +1,232 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/replay"
+)
+
+func Test_mergeMetricDataResult(t *testing.T) {
+	t1 := time.Date(2020, 5, 10, 11, 10, 0, 0, time.UTC)
+	t2 := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+	t3 := time.Date(2020, 5, 10, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		pages [][]*cloudwatch.MetricDataResult
+		want  []*cloudwatch.MetricDataResult
+	}{
+		{
+			name: "OnePage",
+			pages: [][]*cloudwatch.MetricDataResult{
+				{
+					{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{1}), Timestamps: aws.TimeSlice([]time.Time{t1})},
+					{Id: aws.String("m2"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{2}), Timestamps: aws.TimeSlice([]time.Time{t1})},
+				},
+			},
+			want: []*cloudwatch.MetricDataResult{
+				{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{1}), Timestamps: aws.TimeSlice([]time.Time{t1})},
+				{Id: aws.String("m2"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{2}), Timestamps: aws.TimeSlice([]time.Time{t1})},
+			},
+		},
+		{
+			name: "SameIdInSeveralPages",
+			pages: [][]*cloudwatch.MetricDataResult{
+				{
+					{Id: aws.String("m1"), StatusCode: aws.String("PartialData"), Values: aws.Float64Slice([]float64{1, 2}), Timestamps: aws.TimeSlice([]time.Time{t1, t2})},
+				},
+				{
+					{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{3}), Timestamps: aws.TimeSlice([]time.Time{t3})},
+					{Id: aws.String("m2"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{4}), Timestamps: aws.TimeSlice([]time.Time{t3})},
+				},
+			},
+			want: []*cloudwatch.MetricDataResult{
+				{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{1, 2, 3}), Timestamps: aws.TimeSlice([]time.Time{t1, t2, t3})},
+				{Id: aws.String("m2"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{4}), Timestamps: aws.TimeSlice([]time.Time{t3})},
+			},
+		},
+		{
+			name: "InternalErrorIsKept",
+			pages: [][]*cloudwatch.MetricDataResult{
+				{
+					{Id: aws.String("m1"), StatusCode: aws.String("InternalError")},
+				},
+				{
+					{Id: aws.String("m1"), StatusCode: aws.String("Complete")},
+				},
+			},
+			want: []*cloudwatch.MetricDataResult{
+				{Id: aws.String("m1"), StatusCode: aws.String("InternalError")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mdo := &cloudwatch.GetMetricDataOutput{}
+			results := make(map[string]*cloudwatch.MetricDataResult)
+			for _, page := range tt.pages {
+				for _, mdr := range page {
+					mergeMetricDataResult(mdo, results, mdr)
+				}
+			}
+			if !reflect.DeepEqual(mdo.MetricDataResults, tt.want) {
+				t.Errorf("mergeMetricDataResult(): got: %v --> want: %v", mdo.MetricDataResults, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMetricDataReplay(t *testing.T) {
+	t1 := time.Date(2020, 5, 10, 11, 10, 0, 0, time.UTC)
+	t2 := time.Date(2020, 5, 10, 11, 5, 0, 0, time.UTC)
+
+	in := func(token string) *cloudwatch.GetMetricDataInput {
+		mdi := &cloudwatch.GetMetricDataInput{MetricDataQueries: []*cloudwatch.MetricDataQuery{{Id: aws.String("m1"), Expression: aws.String("SEARCH('CPUUtilization', 'Average', 300)")}}}
+		if len(token) > 0 {
+			mdi.NextToken = aws.String(token)
+		}
+		return mdi
+	}
+	pages := []replay.Fixture{
+		{
+			Region: "eu-west-1",
+			Input:  in(""),
+			Output: &cloudwatch.GetMetricDataOutput{
+				MetricDataResults: []*cloudwatch.MetricDataResult{{Id: aws.String("m1"), StatusCode: aws.String("PartialData"), Values: aws.Float64Slice([]float64{1}), Timestamps: aws.TimeSlice([]time.Time{t1})}},
+				NextToken:         aws.String("token"),
+			},
+		},
+		{
+			Region: "eu-west-1",
+			Input:  in("token"),
+			Output: &cloudwatch.GetMetricDataOutput{
+				MetricDataResults: []*cloudwatch.MetricDataResult{{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{2}), Timestamps: aws.TimeSlice([]time.Time{t2})}},
+			},
+		},
+	}
+	dir := t.TempDir()
+	for _, p := range pages {
+		if err := replay.Save(dir, p); err != nil {
+			t.Fatalf("Save(): %v", err)
+		}
+	}
+	fs, err := replay.Load(dir)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+
+	// the pages merged must not change the fixtures replayed by the next scrapes
+	want := []*cloudwatch.MetricDataResult{{Id: aws.String("m1"), StatusCode: aws.String("Complete"), Values: aws.Float64Slice([]float64{1, 2}), Timestamps: aws.TimeSlice([]time.Time{t1, t2})}}
+	for i := 0; i < 3; i++ {
+		got, p, err := GetMetricData(context.Background(), fs.Client("eu-west-1"), in(""), nil)
+		if err != nil {
+			t.Fatalf("GetMetricData(): %v", err)
+		}
+		if p != 2 || !reflect.DeepEqual(got.MetricDataResults, want) {
+			t.Errorf("GetMetricData(): got: %v pages, %v --> want: %v pages, %v", p, got.MetricDataResults, 2, want)
+		}
+	}
+}
+
+// this return the batches of GetMetricData inputs with one metric query each, with the Ids m1, m2...
+func prepareBatches(n int) []*cloudwatch.GetMetricDataInput {
+	var mdis []*cloudwatch.GetMetricDataInput
+	for i := 1; i <= n; i++ {
+		mdis = append(mdis, &cloudwatch.GetMetricDataInput{MetricDataQueries: []*cloudwatch.MetricDataQuery{{Id: aws.String(fmt.Sprintf("m%d", i))}}})
+	}
+	return mdis
+}
+
+func Test_getMetricDataConcurrentlySharedSemaphore(t *testing.T) {
+	// the targets of a scrape share the semaphore, so its calls together are limited by it
+	calls := &callsCounter{}
+	sem := newSemaphore(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc := &slowCloudWatch{delay: 10 * time.Millisecond, calls: calls}
+			getMetricDataConcurrently(context.Background(), svc, prepareBatches(4), sem, nil)
+		}()
+	}
+	wg.Wait()
+
+	if got := calls.getMax(); got < 1 || got > 2 {
+		t.Errorf("getMetricDataConcurrently(): got: %v calls at the same time --> want: at most %v", got, 2)
+	}
+}
+
+func Test_getMetricDataConcurrently(t *testing.T) {
+	tests := []struct {
+		name        string
+		batches     int
+		concurrency int
+		fails       map[string]bool
+		wantFailed  []string
+	}{
+		{name: "Sequential", batches: 4, concurrency: 1},
+		{name: "Concurrent", batches: 8, concurrency: 3},
+		{name: "MoreConcurrencyThanBatches", batches: 2, concurrency: 5},
+		{name: "FailedBatch", batches: 5, concurrency: 2, fails: map[string]bool{"m2": true, "m4": true}, wantFailed: []string{"m2", "m4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := &callsCounter{}
+			svc := &slowCloudWatch{delay: 10 * time.Millisecond, fails: tt.fails, calls: calls}
+			mdis := prepareBatches(tt.batches)
+
+			results := getMetricDataConcurrently(context.Background(), svc, mdis, newSemaphore(tt.concurrency), nil)
+			if len(results) != len(mdis) {
+				t.Fatalf("getMetricDataConcurrently(): got: %v results --> want: %v", len(results), len(mdis))
+			}
+
+			// the results are in the order of the batches and a failed batch only fail its own metrics queries
+			var failed []string
+			for i, r := range results {
+				id := aws.StringValue(mdis[i].MetricDataQueries[0].Id)
+				if r.err != nil {
+					failed = append(failed, id)
+					continue
+				}
+				if len(r.mdo.MetricDataResults) != 1 || aws.StringValue(r.mdo.MetricDataResults[0].Id) != id || r.pages != 1 {
+					t.Errorf("getMetricDataConcurrently(): got: %v --> want: the result of %s", r.mdo, id)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("getMetricDataConcurrently(): got: %v failed --> want: %v", failed, tt.wantFailed)
+			}
+
+			want := tt.concurrency
+			if tt.batches < want {
+				want = tt.batches
+			}
+			if got := calls.getMax(); got < 1 || got > want {
+				t.Errorf("getMetricDataConcurrently(): got: %v calls at the same time --> want: at most %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/CommonErrors.html
+
+// Used when the values of application.retry are not defined
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 200 * time.Millisecond
+	defaultRetryMaxDelay    = 5 * time.Second
+	defaultRetryJitter      = config.RetryJitterFull
+)
+
+// The error code used for the errors without AWS error code, i.e.: the network errors
+const unknownErrorCode = "Unknown"
+
+// The AWS error codes of the requests throttled, they are always retried
+var throttleCodes = map[string]bool{
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"ThrottledException":        true,
+	"TooManyRequests":           true,
+	"TooManyRequestsException":  true,
+	"RequestLimitExceeded":      true,
+	"RequestThrottled":          true,
+	"RequestThrottledException": true,
+}
+
+// The AWS error codes of the transient failures, they are retried
+var retryableCodes = map[string]bool{
+	"InternalFailure":              true,
+	"InternalServiceError":         true,
+	"InternalServiceFault":         true,
+	"ServiceUnavailable":           true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+}
+
+// Retryer call the AWS CloudWatch API retrying the calls failed with throttling or transient errors,
+// with exponential backoff and jitter, until the maximum attempts or the deadline of the context
+type Retryer struct {
+	policy config.Retry
+
+	// The retries and the throttled calls by error code, they are optional
+	retries   *prometheus.CounterVec
+	throttles *prometheus.CounterVec
+
+	// Used by the tests to avoid waiting and randomness
+	sleep  func(ctx context.Context, d time.Duration) error
+	random func() float64
+}
+
+// NewRetryer return the retryer of the policy p, the values not defined use the defaults.
+// The retries and throttles counters, labeled by error code, are optional.
+func NewRetryer(p config.Retry, retries, throttles *prometheus.CounterVec) *Retryer {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	switch strings.ToLower(p.Jitter) {
+	case config.RetryJitterFull, config.RetryJitterEqual, config.RetryJitterNone:
+		p.Jitter = strings.ToLower(p.Jitter)
+	case "":
+		p.Jitter = defaultRetryJitter
+	default:
+		log.Errorf("Error converting retry jitter: %v, using the default value: %v", p.Jitter, defaultRetryJitter)
+		p.Jitter = defaultRetryJitter
+	}
+
+	return &Retryer{
+		policy:    p,
+		retries:   retries,
+		throttles: throttles,
+		sleep:     sleep,
+		random:    rand.Float64,
+	}
+}
+
+// Do call f until it doesn't fail, the error is not retryable, the maximum attempts are done or the next
+// retry would be after the deadline of ctx, the last error is returned. A nil Retryer call f only once.
+func (r *Retryer) Do(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || r == nil {
+			return err
+		}
+
+		code, retryable, throttle := classifyError(err)
+		if throttle && r.throttles != nil {
+			r.throttles.WithLabelValues(code).Inc()
+		}
+		if !retryable || attempt >= r.policy.MaxAttempts {
+			return err
+		}
+
+		d := r.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+			log.Warnf("The AWS CloudWatch call failed with error code %s, the retry would exceed the scrape deadline", code)
+			return err
+		}
+
+		log.Warnf("The AWS CloudWatch call failed with error code %s, retrying in %v (attempt %v of %v)", code, d, attempt+1, r.policy.MaxAttempts)
+		if r.retries != nil {
+			r.retries.WithLabelValues(code).Inc()
+		}
+		if serr := r.sleep(ctx, d); serr != nil {
+			return err
+		}
+	}
+}
+
+// this return the delay before the retry after the attempt, BaseDelay * 2^(attempt-1) up to MaxDelay randomized by the jitter
+func (r *Retryer) delay(attempt int) time.Duration {
+	d := float64(r.policy.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if d > float64(r.policy.MaxDelay) {
+		d = float64(r.policy.MaxDelay)
+	}
+
+	switch r.policy.Jitter {
+	case config.RetryJitterFull:
+		d = d * r.random()
+	case config.RetryJitterEqual:
+		d = d/2 + d/2*r.random()
+	}
+	return time.Duration(d)
+}
+
+// this wait the duration d or until ctx is done, in that case its error is returned
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// this return the AWS error code of err and if it is retryable and a throttling error.
+// The HTTP status 429 is a throttling error and the 5xx are transient errors, the canceled
+// requests, i.e.: by the scrape deadline, are not retried.
+func classifyError(err error) (string, bool, bool) {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return unknownErrorCode, false, false
+	}
+	code := aerr.Code()
+
+	if throttleCodes[code] {
+		return code, true, true
+	}
+	if code == request.CanceledErrorCode {
+		return code, false, false
+	}
+
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case rf.StatusCode() == http.StatusTooManyRequests:
+			return code, true, true
+		case rf.StatusCode() >= http.StatusInternalServerError:
+			return code, true, false
+		}
+	}
+
+	return code, retryableCodes[code], false
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCode      string
+		wantRetryable bool
+		wantThrottle  bool
+	}{
+		{name: "Throttling", err: awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), http.StatusBadRequest, ""), wantCode: "Throttling", wantRetryable: true, wantThrottle: true},
+		{name: "TooManyRequests", err: awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), http.StatusTooManyRequests, ""), wantCode: "TooManyRequests", wantRetryable: true, wantThrottle: true},
+		{name: "Status429", err: awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), http.StatusTooManyRequests, ""), wantCode: "SlowDown", wantRetryable: true, wantThrottle: true},
+		{name: "InternalServiceError", err: awserr.NewRequestFailure(awserr.New("InternalServiceError", "", nil), http.StatusInternalServerError, ""), wantCode: "InternalServiceError", wantRetryable: true},
+		{name: "Status503", err: awserr.NewRequestFailure(awserr.New("Unavailable", "", nil), http.StatusServiceUnavailable, ""), wantCode: "Unavailable", wantRetryable: true},
+		{name: "RequestError", err: awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), wantCode: request.ErrCodeRequestError, wantRetryable: true},
+		{name: "InvalidParameterValue", err: awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "", nil), http.StatusBadRequest, ""), wantCode: "InvalidParameterValue"},
+		{name: "AccessDenied", err: awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), http.StatusForbidden, ""), wantCode: "AccessDenied"},
+		{name: "Canceled", err: awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded), wantCode: request.CanceledErrorCode},
+		{name: "Unknown", err: errors.New("failed"), wantCode: unknownErrorCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, retryable, throttle := classifyError(tt.err)
+			if code != tt.wantCode || retryable != tt.wantRetryable || throttle != tt.wantThrottle {
+				t.Errorf("classifyError(): got: %v, %v, %v --> want: %v, %v, %v", code, retryable, throttle, tt.wantCode, tt.wantRetryable, tt.wantThrottle)
+			}
+		})
+	}
+}
+
+func TestRetryer_delay(t *testing.T) {
+	tests := []struct {
+		jitter string
+		want   []time.Duration
+	}{
+		{jitter: config.RetryJitterNone, want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond}},
+		{jitter: config.RetryJitterFull, want: []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond}},
+		{jitter: config.RetryJitterEqual, want: []time.Duration{75 * time.Millisecond, 150 * time.Millisecond, 300 * time.Millisecond, 375 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.jitter, func(t *testing.T) {
+			r := NewRetryer(config.Retry{BaseDelay: 100 * time.Millisecond, MaxDelay: 500 * time.Millisecond, Jitter: tt.jitter}, nil, nil)
+			r.random = func() float64 { return 0.5 }
+
+			var got []time.Duration
+			for attempt := 1; attempt <= len(tt.want); attempt++ {
+				got = append(got, r.delay(attempt))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("delay(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// this return the value of the counter of the code of the counter vector cv, 0 when it doesn't exist
+func counterValue(t *testing.T, cv *prometheus.CounterVec, code string) float64 {
+	r := prometheus.NewRegistry()
+	r.MustRegister(cv)
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("Gather(): %v", err)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "code" && l.GetValue() == code {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestRetryer_Do(t *testing.T) {
+	throttling := awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), http.StatusBadRequest, "")
+	invalid := awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "", nil), http.StatusBadRequest, "")
+
+	tests := []struct {
+		name          string
+		errs          []error
+		timeout       time.Duration
+		wantCalls     int
+		wantErr       error
+		wantRetries   float64
+		wantThrottles float64
+	}{
+		{name: "Success", errs: nil, wantCalls: 1},
+		{name: "RetriedThrottling", errs: []error{throttling, throttling}, wantCalls: 3, wantRetries: 2, wantThrottles: 2},
+		{name: "MaxAttempts", errs: []error{throttling, throttling, throttling, throttling}, wantCalls: 3, wantErr: throttling, wantRetries: 2, wantThrottles: 3},
+		{name: "NotRetryable", errs: []error{invalid}, wantCalls: 1, wantErr: invalid},
+		{name: "Deadline", errs: []error{throttling}, timeout: 50 * time.Millisecond, wantCalls: 1, wantErr: throttling, wantThrottles: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retries := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries_total"}, []string{"code"})
+			throttles := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttles_total"}, []string{"code"})
+			r := NewRetryer(config.Retry{MaxAttempts: 3, BaseDelay: time.Second, Jitter: config.RetryJitterNone}, retries, throttles)
+			r.sleep = func(context.Context, time.Duration) error { return nil }
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			calls := 0
+			err := r.Do(ctx, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+
+			if err != tt.wantErr || calls != tt.wantCalls {
+				t.Errorf("Do(): got: %v, %v calls --> want: %v, %v calls", err, calls, tt.wantErr, tt.wantCalls)
+			}
+			if got := counterValue(t, retries, "Throttling"); got != tt.wantRetries {
+				t.Errorf("Do(): retries got: %v --> want: %v", got, tt.wantRetries)
+			}
+			if got := counterValue(t, throttles, "Throttling"); got != tt.wantThrottles {
+				t.Errorf("Do(): throttles got: %v --> want: %v", got, tt.wantThrottles)
+			}
+		})
+	}
+
+	// a nil retryer doesn't retry
+	calls := 0
+	var r *Retryer
+	if err := r.Do(context.Background(), func() error { calls++; return throttling }); err != throttling || calls != 1 {
+		t.Errorf("Do(): got: %v, %v calls --> want: %v, %v calls", err, calls, throttling, 1)
+	}
+}
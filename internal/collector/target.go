@@ -0,0 +1,223 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/discovery"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
+)
+
+// target is the set of metrics queries scraped with the same AWS CloudWatch client,
+// the ones of the same AWS account and Region
+type target struct {
+	conf       *config.All
+	accountID  string
+	region     string
+	svc        cloudwatchiface.CloudWatchAPI
+	discoverer *discovery.Discoverer
+	queries    []config.MetricDataQuery
+	metrics    metrics.Metrics
+	mutex      sync.RWMutex
+
+	// The metrics queries and resources discovered in the last discovery and when it was done,
+	// the resources are guarded by the mutex because they are described while the target is scraped
+	discoveredQueries   []config.MetricDataQuery
+	discoveredResources []discovery.Resource
+	discoveryTime       time.Time
+
+	// The accumulated values of the metrics queries with Type counter
+	counters *counters
+}
+
+// the result of the scrape of a target
+type targetResult struct {
+	metrics []prometheus.Metric
+	total   int
+	pages   int
+	batches int
+	failed  int
+}
+
+// this create one target for every region of the metrics queries of c, the AWS clients of the targets
+// are created by clients using the session sess, the metrics queries without Region are scraped into the region of sess
+func newTargets(c *config.All, sess *session.Session, accountID string, clients Clients) []*target {
+	var ts []*target
+
+	groups, regions := config.ByRegion(c.MetricDataQueries, aws.StringValue(sess.Config.Region))
+	for _, r := range regions {
+		log.Infof("Scraping %v metrics queries in AWS account: %s, region: %s", len(groups[r]), accountID, r)
+		svc, tagging := clients(sess, r)
+		ts = append(ts, newTargetWithClients(c, svc, tagging, accountID, r, groups[r]))
+	}
+
+	return ts
+}
+
+// this create the target of the metrics queries qs of the account accountID and region r using the
+// AWS CloudWatch client svc and the AWS Resource Groups Tagging client tagging
+func newTargetWithClients(c *config.All, svc cloudwatchiface.CloudWatchAPI, tagging resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI, accountID string, r string, qs []config.MetricDataQuery) *target {
+	t := &target{
+		conf:       c,
+		accountID:  accountID,
+		region:     r,
+		svc:        svc,
+		discoverer: discovery.New(svc, tagging),
+		queries:    qs,
+		counters:   newCounters(),
+	}
+	t.metrics = t.newMetrics(qs)
+
+	return t
+}
+
+// this return the constant labels of all the metrics of the target
+func (t *target) labels() prometheus.Labels {
+	l := make(prometheus.Labels)
+	if len(t.accountID) > 0 {
+		l[metrics.AccountIDLabel] = t.accountID
+	}
+	return l
+}
+
+// this create the metrics of the metrics queries qs using the application configuration of the target
+func (t *target) newMetrics(qs []config.MetricDataQuery) metrics.Metrics {
+	conf := *t.conf
+	conf.MetricDataQueriesConf = config.MetricDataQueriesConf{MetricDataQueries: qs}
+	return metrics.NewWithLabels(&conf, t.labels())
+}
+
+// this return the metrics used to scrape, they are replaced when the discovered metrics queries change
+func (t *target) getMetrics() metrics.Metrics {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.metrics
+}
+
+// this return the resources discovered by its tags, used to create the resources info metrics
+func (t *target) getResources() []discovery.Resource {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.discoveredResources
+}
+
+// this discover the metrics queries with dimensions to be discovered when the discovery interval is over.
+// The metrics, and so the prometheus metrics descriptions, are rebuilt only when the discovered
+// metrics queries changed since the last discovery.
+func (t *target) discover(interval time.Duration) {
+	if !hasDiscovery(t.queries) || time.Since(t.discoveryTime) < interval {
+		return
+	}
+	firstDiscovery := t.discoveryTime.IsZero()
+	// when the discovery fails, it is retried in the next interval
+	t.discoveryTime = time.Now()
+
+	qs, rs, err := t.discoverer.Expand(t.queries)
+	if err != nil {
+		log.Errorf("Error discovering AWS CloudWatch Metrics in account: %s, region: %s, using the metrics queries discovered before: %v", t.accountID, t.region, err)
+		return
+	}
+
+	t.mutex.Lock()
+	t.discoveredResources = rs
+	t.mutex.Unlock()
+
+	if !firstDiscovery && reflect.DeepEqual(qs, t.discoveredQueries) {
+		log.Debugf("The discovered metrics queries in region %s didn't change", t.region)
+		return
+	}
+	log.Infof("The discovered metrics queries in region %s changed, total metrics queries: %v", t.region, len(qs))
+
+	m := t.newMetrics(qs)
+
+	t.mutex.Lock()
+	t.metrics = m
+	t.mutex.Unlock()
+	t.discoveredQueries = qs
+}
+
+// this create the resource info metrics of the applications name, one for every resource discovered by its tags of
+// the targets ts with a constant '1' value and labeled by its ARN, dimension, region and all its tags. The label
+// dimension_value is the same of the metrics of the resource, so they can be joined. All of them have the labels of
+// the tags of all the resources, empty when the resource doesn't have the tag, because the prometheus metrics with
+// the same name must have the same labels names
+func newResourcesInfo(name string, ts []*target) []prometheus.Metric {
+	var ms []prometheus.Metric
+
+	// the resources are taken once, so a discovery doesn't change the labels names
+	resources := make([][]discovery.Resource, len(ts))
+	tagLabels := make(map[string]bool)
+	for i, t := range ts {
+		resources[i] = t.getResources()
+		for _, r := range resources[i] {
+			for l := range discovery.TagsLabels(r.Tags) {
+				tagLabels[l] = true
+			}
+		}
+	}
+
+	for i, t := range ts {
+		for _, r := range resources[i] {
+			labels := t.labels()
+			labels["arn"] = r.ARN
+			labels["dimension_name"] = r.DimensionName
+			labels[metrics.DimensionValueLabel] = r.DimensionValue
+			labels[metrics.RegionLabel] = t.region
+			for l := range tagLabels {
+				labels[l] = ""
+			}
+			for l, v := range discovery.TagsLabels(r.Tags) {
+				labels[l] = v
+			}
+
+			d := prometheus.NewDesc(
+				name+"_resource_info",
+				"A metric with a constant '1' value labeled by ARN, dimension and tags of the AWS resources discovered by its tags.",
+				nil,
+				labels,
+			)
+
+			m, err := prometheus.NewConstMetric(d, prometheus.GaugeValue, 1)
+			if err != nil {
+				log.Errorf("Error creating resource info metric for resource: %s, %v", r.ARN, err)
+				continue
+			}
+			ms = append(ms, m)
+		}
+	}
+
+	return ms
+}
+
+// this return if any of the metrics queries has dimensions to be discovered
+func hasDiscovery(qs []config.MetricDataQuery) bool {
+	for _, q := range qs {
+		if q.IsDiscovery() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/discovery"
+)
+
+// this return the metrics of the EC2 instances ids returned by ListMetrics
+func instancesMetrics(ids ...string) []*cloudwatch.Metric {
+	var ms []*cloudwatch.Metric
+	for _, id := range ids {
+		ms = append(ms, &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/EC2"),
+			MetricName: aws.String("CPUUtilization"),
+			Dimensions: []*cloudwatch.Dimension{{Name: aws.String("InstanceId"), Value: aws.String(id)}},
+		})
+	}
+	return ms
+}
+
+// this return the ids of the metrics queries with prometheus metrics descriptions of the target t
+func describedIDs(t *target) []string {
+	var ids []string
+	for id := range t.getMetrics().GetMetricsDesc() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func Test_target_discover(t *testing.T) {
+	c := prepareConf()
+	c.MetricDataQueries[0].MetricStat.Metric.Dimensions[0].Value = config.DimensionWildcard
+	svc := &fakeCloudWatch{metrics: instancesMetrics("i-1")}
+	tgt := newTargetWithClients(c, svc, nil, "", "eu-west-1", c.MetricDataQueries)
+
+	// the metrics of the template don't have descriptions until the first discovery
+	if got := describedIDs(tgt); len(got) != 0 {
+		t.Errorf("discover(): got: %v --> want: no descriptions before the discovery", got)
+	}
+
+	tgt.discover(0)
+	first := tgt.getMetrics()
+	if got := describedIDs(tgt); len(got) != 1 {
+		t.Errorf("discover(): got: %v --> want: the description of the instance i-1", got)
+	}
+
+	// the metrics are not rebuilt when the discovered metrics queries didn't change
+	tgt.discover(0)
+	if tgt.getMetrics() != first {
+		t.Errorf("discover(): got: the metrics rebuilt --> want: the same metrics when the discovery didn't change")
+	}
+
+	// the discovery is not repeated until the interval is over
+	svc.metrics = instancesMetrics("i-1", "i-2")
+	tgt.discover(defaultDiscoveryInterval)
+	if tgt.getMetrics() != first {
+		t.Errorf("discover(): got: the metrics rebuilt --> want: the same metrics until the interval is over")
+	}
+
+	tgt.discover(0)
+	if got := describedIDs(tgt); tgt.getMetrics() == first || len(got) != 2 {
+		t.Errorf("discover(): got: %v --> want: the descriptions of the instances i-1 and i-2", got)
+	}
+}
+
+func TestCollector_ResourcesInfo(t *testing.T) {
+	c := prepareConf()
+	c.Application.Name = "aws_cloudwatch_exporter"
+	eu := newTargetWithClients(c, &fakeCloudWatch{}, nil, "", "eu-west-1", c.MetricDataQueries)
+	eu.discoveredResources = []discovery.Resource{{
+		ARN:            "arn:aws:rds:eu-west-1:123456789012:db:payments-db",
+		DimensionName:  "DBInstanceIdentifier",
+		DimensionValue: "payments-db",
+		Tags:           map[string]string{"Env": "prod", "env": "dev", "team": "payments"},
+	}}
+	us := newTargetWithClients(c, &fakeCloudWatch{}, nil, "", "us-east-1", c.MetricDataQueries)
+	us.discoveredResources = []discovery.Resource{{
+		ARN:            "arn:aws:rds:us-east-1:123456789012:db:orders-db",
+		DimensionName:  "DBInstanceIdentifier",
+		DimensionValue: "orders-db",
+		Tags:           map[string]string{"owner": "orders"},
+	}}
+	col := &Collector{
+		conf:              c,
+		targets:           []*target{eu, us},
+		discoveryInterval: defaultDiscoveryInterval,
+		ownMetrics:        newOwnMetrics(c),
+	}
+
+	// the resources info are described, so the collector must be registered again after the discovery
+	var described int
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		col.Describe(ch)
+		close(ch)
+	}()
+	for d := range ch {
+		if strings.Contains(d.String(), "aws_cloudwatch_exporter_resource_info") {
+			described++
+		}
+	}
+	if described != 2 {
+		t.Errorf("Describe(): got: %v --> want: %v resources info descriptions", described, 2)
+	}
+
+	// all the resources info have the labels of the tags of all the resources
+	got := gather(t, col)
+	for _, k := range []string{
+		`aws_cloudwatch_exporter_resource_info{arn="arn:aws:rds:eu-west-1:123456789012:db:payments-db",dimension_name="DBInstanceIdentifier",dimension_value="payments-db",region="eu-west-1",tag_env="prod",tag_owner="",tag_team="payments"}`,
+		`aws_cloudwatch_exporter_resource_info{arn="arn:aws:rds:us-east-1:123456789012:db:orders-db",dimension_name="DBInstanceIdentifier",dimension_value="orders-db",region="us-east-1",tag_env="",tag_owner="orders",tag_team=""}`,
+	} {
+		if v, ok := got[k]; !ok || v != 1 {
+			t.Errorf("Collect(): %s got: %v --> want: %v", k, v, 1)
+		}
+	}
+}
+
+func TestCollector_CollectRegions(t *testing.T) {
+	c := prepareConf()
+	for _, r := range []string{"us-east-1", "ap-southeast-2"} {
+		q := c.MetricDataQueries[0]
+		q.ID = strings.ReplaceAll(r, "-", "_")
+		q.Region = r
+		c.MetricDataQueries = append(c.MetricDataQueries, q)
+	}
+
+	// every region has its own client, the queries without Region are scraped into the region of the session
+	svcs := map[string]*fakeCloudWatch{
+		"eu-west-1": {outputs: []*cloudwatch.GetMetricDataOutput{{MetricDataResults: []*cloudwatch.MetricDataResult{
+			newMetricDataResult("m1", cloudwatch.StatusCodeComplete, 12.5),
+		}}}},
+		"us-east-1": {outputs: []*cloudwatch.GetMetricDataOutput{{MetricDataResults: []*cloudwatch.MetricDataResult{
+			newMetricDataResult("us_east_1", cloudwatch.StatusCodeComplete, 7),
+		}}}},
+		"ap-southeast-2": {err: awserr.New("AccessDenied", "not authorized", nil)},
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	col := NewWithClients(c, sess, fakeClients(svcs))
+
+	got := gather(t, col)
+	want := map[string]float64{
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`: 12.5,
+		`aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="us-east-1"}`: 7,
+		`aws_cloudwatch_exporter_target_up{account_id="",region="eu-west-1"}`:                                            1,
+		`aws_cloudwatch_exporter_target_up{account_id="",region="us-east-1"}`:                                            1,
+		`aws_cloudwatch_exporter_target_up{account_id="",region="ap-southeast-2"}`:                                       0,
+		up: 1,
+	}
+	for k, v := range want {
+		if gv, ok := got[k]; !ok || gv != v {
+			t.Errorf("Collect(): %s got: %v --> want: %v", k, gv, v)
+		}
+	}
+
+	// every client only receive the metrics queries of its region
+	for r, svc := range svcs {
+		if len(svc.inputs) != 1 || len(svc.inputs[0].MetricDataQueries) != 1 {
+			t.Fatalf("GetMetricData(): got: %v calls in region %s --> want: one call with one metric query", len(svc.inputs), r)
+		}
+		wantID := strings.ReplaceAll(r, "-", "_")
+		if r == "eu-west-1" {
+			wantID = "m1"
+		}
+		if gotID := aws.StringValue(svc.inputs[0].MetricDataQueries[0].Id); gotID != wantID {
+			t.Errorf("GetMetricData(): got: %v in region %s --> want: %v", gotID, r, wantID)
+		}
+	}
+}
+
+func TestCollector_CollectTargets(t *testing.T) {
+	c := prepareConf()
+	c.Targets = []config.Target{
+		{RoleArn: "arn:aws:iam::111111111111:role/cloudwatch-exporter"},
+		{RoleArn: "arn:aws:iam::222222222222:role/cloudwatch-exporter"},
+	}
+
+	// the targets share the client of the region, every call return the value of the metric query m1
+	output := &cloudwatch.GetMetricDataOutput{MetricDataResults: []*cloudwatch.MetricDataResult{
+		newMetricDataResult("m1", cloudwatch.StatusCodeComplete, 12.5),
+	}}
+	svc := &fakeCloudWatch{outputs: []*cloudwatch.GetMetricDataOutput{output, output, output}}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	col := NewWithClients(c, sess, fakeClients(map[string]*fakeCloudWatch{"eu-west-1": svc}))
+
+	metricFmt := `aws_ec_2_cpu_utilization_average{account_id="%s",dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"}`
+	upFmt := `aws_cloudwatch_exporter_target_up{account_id="%s",region="eu-west-1"}`
+
+	got := gather(t, col)
+	for _, accountID := range []string{"111111111111", "222222222222"} {
+		for _, k := range []string{fmt.Sprintf(metricFmt, accountID), fmt.Sprintf(upFmt, accountID)} {
+			if _, ok := got[k]; !ok {
+				t.Errorf("Collect(): got: %v --> want: %s", got, k)
+			}
+		}
+	}
+
+	// the target removed by the reload is not notified anymore
+	rc := *c
+	rc.Targets = c.Targets[:1]
+	col.Reload(&rc)
+
+	got = gather(t, col)
+	if _, ok := got[fmt.Sprintf(upFmt, "111111111111")]; !ok {
+		t.Errorf("Collect(): got: %v --> want: %s", got, fmt.Sprintf(upFmt, "111111111111"))
+	}
+	for _, k := range []string{fmt.Sprintf(metricFmt, "222222222222"), fmt.Sprintf(upFmt, "222222222222")} {
+		if _, ok := got[k]; ok {
+			t.Errorf("Collect(): got: %s --> want: the metrics of the target removed not notified", k)
+		}
+	}
+}
@@ -17,6 +17,9 @@ package config
 
 import (
 	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -26,6 +29,8 @@ type All struct {
 	ServerConf            `mapstructure:",squash"`
 	ApplicationConf       `mapstructure:",squash"`
 	MetricDataQueriesConf `mapstructure:",squash"`
+	TargetsConf           `mapstructure:",squash"`
+	AWSConf               `mapstructure:",squash"`
 }
 
 func (c *All) ToJSON() string {
@@ -78,23 +83,114 @@ type ApplicationConf struct {
 }
 
 type Application struct {
-	Name             string   `json:"name" yaml:"name"`
-	Description      string   `json:"description" yaml:"description"`
-	GitRepository    string   `json:"gitRepository" yaml:"gitRepository"`
-	Version          string   `json:"version" yaml:"version"`
-	Revision         string   `json:"revision" yaml:"revision"`
-	Branch           string   `json:"branch" yaml:"branch"`
-	BuildUser        string   `json:"buildUser" yaml:"buildUser"`
-	BuildDate        string   `json:"buildDate" yaml:"buildDate"`
-	GoVersion        string   `json:"goVersion" yaml:"goVersion"`
-	VersionInfo      string   `json:"versionInfo" yaml:"versionInfo"`
-	BuildInfo        string   `json:"buildInfo" yaml:"buildInfo"`
-	ServerFile       string   `mapstructure:"serverFile" json:"serverFile" yaml:"serverFile"`
-	HealthPath       string   `json:"healthPath" yaml:"healthPath"`
-	MetricsPath      string   `json:"metricsPath" yaml:"metricsPath"`
-	MetricsFiles     []string `mapstructure:"metricsFiles" json:"metricsFiles" yaml:"metricsFiles"`
-	MetricStatPeriod string   `mapstructure:"metricStatPeriod" json:"metricStatPeriod" yaml:"metricStatPeriod"`
-	MetricTimeWindow string   `mapstructure:"metricTimeWindow" json:"metricTimeWindow" yaml:"metricTimeWindow"`
+	Name              string   `json:"name" yaml:"name"`
+	Description       string   `json:"description" yaml:"description"`
+	GitRepository     string   `json:"gitRepository" yaml:"gitRepository"`
+	Version           string   `json:"version" yaml:"version"`
+	Revision          string   `json:"revision" yaml:"revision"`
+	Branch            string   `json:"branch" yaml:"branch"`
+	BuildUser         string   `json:"buildUser" yaml:"buildUser"`
+	BuildDate         string   `json:"buildDate" yaml:"buildDate"`
+	GoVersion         string   `json:"goVersion" yaml:"goVersion"`
+	VersionInfo       string   `json:"versionInfo" yaml:"versionInfo"`
+	BuildInfo         string   `json:"buildInfo" yaml:"buildInfo"`
+	ServerFile        string   `mapstructure:"serverFile" json:"serverFile" yaml:"serverFile"`
+	HealthPath        string   `json:"healthPath" yaml:"healthPath"`
+	MetricsPath       string   `json:"metricsPath" yaml:"metricsPath"`
+	ProbePath         string   `json:"probePath" yaml:"probePath"`
+	MetricsFiles      []string `mapstructure:"metricsFiles" json:"metricsFiles" yaml:"metricsFiles"`
+	MetricStatPeriod  string   `mapstructure:"metricStatPeriod" json:"metricStatPeriod" yaml:"metricStatPeriod"`
+	MetricTimeWindow  string   `mapstructure:"metricTimeWindow" json:"metricTimeWindow" yaml:"metricTimeWindow"`
+	DiscoveryInterval string   `mapstructure:"discoveryInterval" json:"discoveryInterval" yaml:"discoveryInterval"`
+	Concurrency       int      `mapstructure:"concurrency" json:"concurrency" yaml:"concurrency"`
+	BackgroundPolling bool     `mapstructure:"backgroundPolling" json:"backgroundPolling" yaml:"backgroundPolling"`
+	ReloadEndpoint    bool     `mapstructure:"reloadEndpoint" json:"reloadEndpoint" yaml:"reloadEndpoint"`
+	WatchMetricsFiles bool     `mapstructure:"watchMetricsFiles" json:"watchMetricsFiles" yaml:"watchMetricsFiles"`
+	// The labels (period, unit) added to the metrics to tell apart the metrics queries which only differ by them
+	CollisionLabels []string `mapstructure:"collisionLabels" json:"collisionLabels,omitempty" yaml:"collisionLabels,omitempty"`
+	// The mode (snake, original) used to create the prometheus labels names from the dimensions names
+	DimensionLabels string `mapstructure:"dimensionLabels" json:"dimensionLabels" yaml:"dimensionLabels"`
+	// The mode (suffix, label) used to tell apart the statistics of the metrics queries with Stats
+	StatsMode string `mapstructure:"statsMode" json:"statsMode" yaml:"statsMode"`
+	// The prometheus labels names of the dimensions names, they have precedence over DimensionLabels
+	DimensionLabelsMap map[string]string `mapstructure:"dimensionLabelsMap" json:"dimensionLabelsMap,omitempty" yaml:"dimensionLabelsMap,omitempty"`
+	// The maximum duration of the scrapes, the failed AWS CloudWatch calls are not retried beyond it
+	ScrapeTimeout string `mapstructure:"scrapeTimeout" json:"scrapeTimeout" yaml:"scrapeTimeout"`
+	// The policy of the retries of the failed AWS CloudWatch GetMetricData calls
+	Retry Retry `mapstructure:"retry" json:"retry" yaml:"retry"`
+	// The roles ARNs, or patterns of them, allowed in the role parameter of the probes
+	ProbeRoles []string `mapstructure:"probeRoles" json:"probeRoles,omitempty" yaml:"probeRoles,omitempty"`
+}
+
+// The jitter modes of the delays between the retries
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+const (
+	RetryJitterFull  = "full"
+	RetryJitterEqual = "equal"
+	RetryJitterNone  = "none"
+)
+
+// Retry is the policy of the retries, the delay before every retry is BaseDelay doubled on every attempt
+// up to MaxDelay, randomized by Jitter. The values not defined use the defaults of the collector.
+type Retry struct {
+	// The maximum number of calls, including the first one, 1 disables the retries
+	MaxAttempts int           `mapstructure:"maxAttempts" json:"maxAttempts" yaml:"maxAttempts"`
+	BaseDelay   time.Duration `mapstructure:"baseDelay" json:"baseDelay" yaml:"baseDelay"`
+	MaxDelay    time.Duration `mapstructure:"maxDelay" json:"maxDelay" yaml:"maxDelay"`
+	// The mode (full, equal, none) used to randomize the delays
+	Jitter string `mapstructure:"jitter" json:"jitter" yaml:"jitter"`
+}
+
+// This is a convenient structure to allow config files nested (targets.[keys])
+// server.conf file
+// targets:
+//   - roleArn:
+//     region:
+type TargetsConf struct {
+	Targets []Target `mapstructure:"targets" json:"targets,omitempty" yaml:"targets,omitempty"`
+}
+
+// Target is an AWS account scraped assuming the role RoleArn, all the metrics queries are scraped in every target
+// https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+type Target struct {
+	RoleArn     string `mapstructure:"roleArn" json:"roleArn" yaml:"roleArn"`
+	ExternalID  string `mapstructure:"externalId" json:"externalId,omitempty" yaml:"externalId,omitempty"`
+	SessionName string `mapstructure:"sessionName" json:"sessionName,omitempty" yaml:"sessionName,omitempty"`
+	// The AWS Region of the metrics queries without Region, when it is not defined the default AWS Region is used
+	Region string `mapstructure:"region" json:"region,omitempty" yaml:"region,omitempty"`
+}
+
+// This is a convenient structure to allow config files nested (aws.[keys])
+// server.conf file
+// aws:
+//
+//	endpoint:
+//	region:
+type AWSConf struct {
+	AWS `mapstructure:"aws" json:"aws" yaml:"aws"`
+}
+
+// AWS is the configuration of the AWS sessions and its http client, the empty values use the AWS SDK defaults
+// https://docs.aws.amazon.com/sdk-for-go/api/aws/#Config
+type AWS struct {
+	// The URL used for all the AWS services, i.e.: http://localhost:4566 for LocalStack
+	Endpoint string `mapstructure:"endpoint" json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// The URLs of the AWS services by endpoint id (monitoring, tagging, sts), they have precedence over Endpoint
+	Endpoints map[string]string `mapstructure:"endpoints" json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	// The AWS Region, it has precedence over the AWS_REGION and the AWS config files
+	Region string `mapstructure:"region" json:"region,omitempty" yaml:"region,omitempty"`
+	// The maximum number of retries of the failed requests, when it is not defined the AWS SDK default is used
+	MaxRetries *int `mapstructure:"maxRetries" json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`
+	// The maximum duration of the connections establishment
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout" json:"connectTimeout,omitempty" yaml:"connectTimeout,omitempty"`
+	// The maximum duration waiting for the responses headers after the requests are sent
+	ReadTimeout time.Duration `mapstructure:"readTimeout" json:"readTimeout,omitempty" yaml:"readTimeout,omitempty"`
+	// The URL of the proxy, when it is not defined the HTTPS_PROXY, HTTP_PROXY and NO_PROXY env vars are used
+	ProxyURL string `mapstructure:"proxyURL" json:"proxyURL,omitempty" yaml:"proxyURL,omitempty"`
+	// The PEM file with the certificates authorities trusted, i.e.: the certificate of the proxy
+	CABundle             string `mapstructure:"caBundle" json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	UseFIPSEndpoint      bool   `mapstructure:"useFIPSEndpoint" json:"useFIPSEndpoint" yaml:"useFIPSEndpoint"`
+	UseDualStackEndpoint bool   `mapstructure:"useDualStackEndpoint" json:"useDualStackEndpoint" yaml:"useDualStackEndpoint"`
 }
 
 // This is a convenient structure to allow config files nested (MetricDataQueries.[keys])
@@ -108,19 +204,191 @@ type MetricDataQueriesConf struct {
 	MetricDataQueries []MetricDataQuery `mapstructure:"MetricDataQueries" json:"MetricDataQueries" yaml:"MetricDataQueries"`
 }
 
+// The dimension value used to discover all the values of the dimension
+const DimensionWildcard = "*"
+
+// Used to create the suffixes of the statistics
+var nonAlphanumericChars = regexp.MustCompile("[^a-z0-9]+")
+
+// The types of the prometheus metrics of the metrics queries
+const (
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter"
+)
+
 type MetricDataQuery struct {
-	ID         string `mapstructure:"Id" json:"Id" yaml:"Id"`
-	MetricStat struct {
-		Metric struct {
-			Namespace  string `mapstructure:"Namespace" json:"Namespace" yaml:"Namespace"`
-			MetricName string `mapstructure:"MetricName" json:"MetricName" yaml:"MetricName"`
-			Dimensions []struct {
-				Name  string `mapstructure:"Name" json:"Name" yaml:"Name"`
-				Value string `mapstructure:"Value" json:"Value" yaml:"Value"`
-			} `mapstructure:"Dimensions" json:"Dimensions" yaml:"Dimensions"`
-		} `mapstructure:"Metric" json:"Metric" yaml:"Metric"`
-		Period int64  `mapstructure:"Period" json:"Period" yaml:"Period"`
-		Stat   string `mapstructure:"Stat" json:"Stat" yaml:"Stat"`
-		Unit   string `mapstructure:"Unit" json:"Unit" yaml:"Unit"`
-	} `mapstructure:"MetricStat" json:"MetricStat" yaml:"MetricStat"`
+	ID         string     `mapstructure:"Id" json:"Id" yaml:"Id"`
+	Expression string     `mapstructure:"Expression" json:"Expression,omitempty" yaml:"Expression,omitempty"`
+	Label      string     `mapstructure:"Label" json:"Label,omitempty" yaml:"Label,omitempty"`
+	ReturnData *bool      `mapstructure:"ReturnData" json:"ReturnData,omitempty" yaml:"ReturnData,omitempty"`
+	MetricStat MetricStat `mapstructure:"MetricStat" json:"MetricStat" yaml:"MetricStat"`
+
+	// The AWS Region where the metric query is scraped, when it is not defined the region
+	// of the metrics file or the default AWS Region is used
+	Region string `mapstructure:"Region" json:"Region,omitempty" yaml:"Region,omitempty"`
+
+	// The name of the module of the metric query, the metrics queries of a module are only scraped
+	// using the probe endpoint, when it is not defined the module of the metrics file is used
+	Module string `mapstructure:"Module" json:"Module,omitempty" yaml:"Module,omitempty"`
+
+	// The AWS account of the metric when the exporter use a CloudWatch cross-account observability
+	// monitoring account, when it is not defined the account of the metrics file or the monitoring account is used
+	AccountID string `mapstructure:"AccountId" json:"AccountId,omitempty" yaml:"AccountId,omitempty"`
+
+	// When it is defined, the metric query is a template for the metrics queries of the resources
+	// discovered using the AWS Resource Groups Tagging API
+	TagDiscovery *TagDiscovery `mapstructure:"TagDiscovery" json:"TagDiscovery,omitempty" yaml:"TagDiscovery,omitempty"`
+
+	// The name of the prometheus metric, when it is not defined the name is created from the namespace,
+	// metric name and statistic or from the Label of the metric math expressions
+	PrometheusName string `mapstructure:"PrometheusName" json:"PrometheusName,omitempty" yaml:"PrometheusName,omitempty"`
+
+	// The help of the prometheus metric, when it is not defined the help is created from the metric query
+	Help string `mapstructure:"Help" json:"Help,omitempty" yaml:"Help,omitempty"`
+
+	// The static labels added to the prometheus metric, they override the others labels
+	Labels map[string]string `mapstructure:"Labels" json:"Labels,omitempty" yaml:"Labels,omitempty"`
+
+	// The new names of the labels of the prometheus metric, i.e.: instance_id: instance
+	LabelRenames map[string]string `mapstructure:"LabelRenames" json:"LabelRenames,omitempty" yaml:"LabelRenames,omitempty"`
+
+	// The type of the prometheus metric, gauge or counter, the counters accumulate the value of every period
+	Type string `mapstructure:"Type" json:"Type,omitempty" yaml:"Type,omitempty"`
+
+	// The AWS CloudWatch unit of the values converted to the prometheus base unit, i.e.: Milliseconds --> seconds
+	UnitConversion string `mapstructure:"UnitConversion" json:"UnitConversion,omitempty" yaml:"UnitConversion,omitempty"`
+
+	// The factor applied to the values after the unit conversion, when it is not defined the values are not scaled
+	Scale float64 `mapstructure:"Scale" json:"Scale,omitempty" yaml:"Scale,omitempty"`
+
+	// The tags of the discovered resource exported as prometheus labels, filled by the discovery
+	TagLabels map[string]string `mapstructure:"-" json:"-" yaml:"-"`
+}
+
+type MetricStat struct {
+	Metric Metric `mapstructure:"Metric" json:"Metric" yaml:"Metric"`
+	Period int64  `mapstructure:"Period" json:"Period" yaml:"Period"`
+	Stat   string `mapstructure:"Stat" json:"Stat" yaml:"Stat"`
+	// The statistics of the metric, the metric query is expanded into one metric query for every statistic
+	Stats []string `mapstructure:"Stats" json:"Stats,omitempty" yaml:"Stats,omitempty"`
+	Unit  string   `mapstructure:"Unit" json:"Unit" yaml:"Unit"`
+}
+
+type Metric struct {
+	Namespace  string      `mapstructure:"Namespace" json:"Namespace" yaml:"Namespace"`
+	MetricName string      `mapstructure:"MetricName" json:"MetricName" yaml:"MetricName"`
+	Dimensions []Dimension `mapstructure:"Dimensions" json:"Dimensions" yaml:"Dimensions"`
+}
+
+// https://docs.aws.amazon.com/resourcegroupstagging/latest/APIReference/API_GetResources.html
+type TagDiscovery struct {
+	// Override the resource type used by default for the metric namespace, i.e.: rds:db
+	ResourceType string      `mapstructure:"ResourceType" json:"ResourceType,omitempty" yaml:"ResourceType,omitempty"`
+	TagFilters   []TagFilter `mapstructure:"TagFilters" json:"TagFilters" yaml:"TagFilters"`
+	// The tags keys of the resources to be added as labels to its prometheus metrics
+	ExportedTags []string `mapstructure:"ExportedTags" json:"ExportedTags,omitempty" yaml:"ExportedTags,omitempty"`
+}
+
+type TagFilter struct {
+	Key    string   `mapstructure:"Key" json:"Key" yaml:"Key"`
+	Values []string `mapstructure:"Values" json:"Values,omitempty" yaml:"Values,omitempty"`
+}
+
+// The Value of the dimension could be the wildcard "*" or it could has a Regex,
+// in both cases its values are discovered using the AWS CloudWatch API ListMetrics
+type Dimension struct {
+	Name  string `mapstructure:"Name" json:"Name" yaml:"Name"`
+	Value string `mapstructure:"Value" json:"Value" yaml:"Value"`
+	Regex string `mapstructure:"Regex" json:"Regex,omitempty" yaml:"Regex,omitempty"`
+}
+
+// IsReturnData return if the values of the metric query are returned by AWS CloudWatch,
+// when ReturnData is not defined the values are returned
+func (m *MetricDataQuery) IsReturnData() bool {
+	return m.ReturnData == nil || *m.ReturnData
+}
+
+// IsCounter return if the prometheus metric of the metric query is a counter, by default it is a gauge
+func (m *MetricDataQuery) IsCounter() bool {
+	return m.Type == MetricTypeCounter
+}
+
+// IsDiscovery return if the metric query is a template for the metrics queries discovered
+// using the AWS CloudWatch API ListMetrics or the AWS Resource Groups Tagging API
+func (m *MetricDataQuery) IsDiscovery() bool {
+	if m.TagDiscovery != nil {
+		return true
+	}
+	for _, d := range m.MetricStat.Metric.Dimensions {
+		if d.IsDiscovery() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDiscovery return if the values of the dimension must be discovered
+func (d *Dimension) IsDiscovery() bool {
+	return d.Value == DimensionWildcard || len(d.Regex) > 0
+}
+
+// IsStats return if the metric query was expanded from a metric query with Stats, it has the Stat
+// of the expanded metric query and the Stats of the original one
+func (m *MetricDataQuery) IsStats() bool {
+	return len(m.MetricStat.Stats) > 0 && len(m.MetricStat.Stat) > 0
+}
+
+// ExpandStats return the metrics queries qs with the metrics queries with Stats expanded into one metric
+// query for every statistic, the Id of the expanded metrics queries is the Id with the suffix of the
+// statistic, i.e.: m1 with Stats [Average, p99.9] --> m1_average, m1_p99_9
+func ExpandStats(qs []MetricDataQuery) []MetricDataQuery {
+	var eqs []MetricDataQuery
+	for _, q := range qs {
+		if len(q.MetricStat.Stats) == 0 || len(q.MetricStat.Stat) > 0 {
+			eqs = append(eqs, q)
+			continue
+		}
+		for _, s := range q.MetricStat.Stats {
+			eq := q
+			eq.ID = q.ID + "_" + StatSuffix(s)
+			eq.MetricStat.Stat = s
+			eqs = append(eqs, eq)
+		}
+	}
+	return eqs
+}
+
+// StatSuffix return the statistic s as a suffix of Ids and names, i.e.: Average --> average, p99.9 --> p99_9, TM(10%:90%) --> tm_10_90
+func StatSuffix(s string) string {
+	return strings.Trim(nonAlphanumericChars.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+// ByRegion return the metrics queries qs grouped by its Region and the sorted list of regions,
+// the metrics queries without Region are grouped into the region r with its Region set to r
+func ByRegion(qs []MetricDataQuery, r string) (map[string][]MetricDataQuery, []string) {
+	groups := make(map[string][]MetricDataQuery)
+	var regions []string
+
+	for _, q := range qs {
+		if len(q.Region) == 0 {
+			q.Region = r
+		}
+		if _, ok := groups[q.Region]; !ok {
+			regions = append(regions, q.Region)
+		}
+		groups[q.Region] = append(groups[q.Region], q)
+	}
+	sort.Strings(regions)
+
+	return groups, regions
+}
+
+// ByModule return the metrics queries qs grouped by its Module, the metrics queries without Module
+// are grouped into the empty module, the default one scraped by the metrics endpoint
+func ByModule(qs []MetricDataQuery) map[string][]MetricDataQuery {
+	groups := make(map[string][]MetricDataQuery)
+	for _, q := range qs {
+		groups[q.Module] = append(groups[q.Module], q)
+	}
+	return groups
 }
@@ -0,0 +1,166 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cwmock
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The default range of the synthetic values of the metrics without Values
+const (
+	defaultMin = 0
+	defaultMax = 100
+)
+
+// Dataset is the data served by the mock server, the metrics, its values and the alarms
+type Dataset struct {
+	// The metrics returned by ListMetrics and GetMetricData
+	Metrics []Metric `yaml:"Metrics"`
+
+	// The alarms returned by DescribeAlarms
+	Alarms []Alarm `yaml:"Alarms"`
+
+	// The maximum number of results of every page, when it is 0 the AWS CloudWatch limits are used
+	PageSize int `yaml:"PageSize"`
+
+	// The errors returned by the first calls to the actions
+	Failures []Failure `yaml:"Failures"`
+}
+
+// Metric is an AWS CloudWatch metric, its values are the same for all the statistics
+type Metric struct {
+	Namespace  string      `yaml:"Namespace"`
+	MetricName string      `yaml:"MetricName"`
+	Dimensions []Dimension `yaml:"Dimensions"`
+
+	// The values of the periods from the newest one, they are repeated when there are more periods than values.
+	// When they are not defined the values are synthetic, created from the metric and the timestamp of the period
+	Values []float64 `yaml:"Values"`
+
+	// The range of the synthetic values, by default from 0 to 100
+	Min float64 `yaml:"Min"`
+	Max float64 `yaml:"Max"`
+}
+
+type Dimension struct {
+	Name  string `yaml:"Name"`
+	Value string `yaml:"Value"`
+}
+
+// Alarm is an AWS CloudWatch metric alarm
+type Alarm struct {
+	AlarmName   string      `yaml:"AlarmName"`
+	StateValue  string      `yaml:"StateValue"`
+	StateReason string      `yaml:"StateReason"`
+	Namespace   string      `yaml:"Namespace"`
+	MetricName  string      `yaml:"MetricName"`
+	Dimensions  []Dimension `yaml:"Dimensions"`
+	Statistic   string      `yaml:"Statistic"`
+	Period      int64       `yaml:"Period"`
+	Threshold   float64     `yaml:"Threshold"`
+}
+
+// Failure is an AWS error returned by the first Times calls to the Action, i.e.: Throttling
+type Failure struct {
+	Action  string `yaml:"Action"`
+	Code    string `yaml:"Code"`
+	Message string `yaml:"Message"`
+	// The HTTP status code, by default 400
+	Status int `yaml:"Status"`
+	Times  int `yaml:"Times"`
+}
+
+// LoadDatasets read the datasets of the yaml files and merge them into one
+func LoadDatasets(files []string) (*Dataset, error) {
+	d := &Dataset{}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := ReadDataset(bs)
+		if err != nil {
+			return nil, fmt.Errorf("error reading dataset file %s: %v", f, err)
+		}
+
+		d.Metrics = append(d.Metrics, fd.Metrics...)
+		d.Alarms = append(d.Alarms, fd.Alarms...)
+		d.Failures = append(d.Failures, fd.Failures...)
+		if fd.PageSize > 0 {
+			d.PageSize = fd.PageSize
+		}
+	}
+	return d, nil
+}
+
+// ReadDataset read the dataset of the yaml content bs
+func ReadDataset(bs []byte) (*Dataset, error) {
+	d := &Dataset{}
+	if err := yaml.Unmarshal(bs, d); err != nil {
+		return nil, err
+	}
+	for _, m := range d.Metrics {
+		if len(m.Namespace) == 0 || len(m.MetricName) == 0 {
+			return nil, fmt.Errorf("the metrics must have Namespace and MetricName")
+		}
+	}
+	return d, nil
+}
+
+// this return the metric of the dataset with the namespace, name and the same set of dimensions
+func (d *Dataset) findMetric(namespace, name string, dims []Dimension) (Metric, bool) {
+	k := metricKey(namespace, name, dims)
+	for _, m := range d.Metrics {
+		if metricKey(m.Namespace, m.MetricName, m.Dimensions) == k {
+			return m, true
+		}
+	}
+	return Metric{}, false
+}
+
+// this return the value of the metric m for the i-th period from the newest one starting at ts
+func (m Metric) value(i int, ts time.Time) float64 {
+	if len(m.Values) > 0 {
+		return m.Values[i%len(m.Values)]
+	}
+
+	min, max := m.Min, m.Max
+	if min == 0 && max == 0 {
+		min, max = defaultMin, defaultMax
+	}
+
+	// the synthetic values are deterministic, the same metric and period have always the same value
+	h := fnv.New32a()
+	h.Write([]byte(metricKey(m.Namespace, m.MetricName, m.Dimensions) + ts.UTC().Format(time.RFC3339)))
+	return min + (max-min)*float64(h.Sum32()%10000)/10000
+}
+
+// this return the key of the metric, the dimensions are sorted because its order doesn't matter
+func metricKey(namespace, name string, dims []Dimension) string {
+	var ds []string
+	for _, d := range dims {
+		ds = append(ds, d.Name+"="+d.Value)
+	}
+	sort.Strings(ds)
+	return namespace + "," + name + "," + strings.Join(ds, ",")
+}
@@ -0,0 +1,449 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cwmock
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The AWS CloudWatch API limits of the results of every page
+// see: https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_Operations.html
+const (
+	MaxListMetricsResults    = 500
+	MaxDescribeAlarmsResults = 100
+	MaxDatapoints            = 100800
+)
+
+// The actions of the AWS CloudWatch Query API served
+const (
+	ActionGetMetricData  = "GetMetricData"
+	ActionListMetrics    = "ListMetrics"
+	ActionDescribeAlarms = "DescribeAlarms"
+)
+
+const xmlNamespace = "http://monitoring.amazonaws.com/doc/2010-08-01/"
+
+// Server is an http.Handler serving the AWS CloudWatch Query API with the metrics and alarms of a Dataset
+type Server struct {
+	dataset *Dataset
+
+	// The current time, the newest period returned by GetMetricData is before it
+	Now func() time.Time
+
+	mu       sync.Mutex
+	calls    map[string]int
+	requests int
+}
+
+// New return a Server of the dataset d
+func New(d *Dataset) *Server {
+	return &Server{
+		dataset: d,
+		Now:     time.Now,
+		calls:   make(map[string]int),
+	}
+}
+
+// Calls return the number of requests received of the action
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+	action := r.Form.Get("Action")
+	log.Debugf("Mock CloudWatch request %s", action)
+
+	s.mu.Lock()
+	s.calls[action]++
+	s.requests++
+	calls := s.calls[action]
+	s.mu.Unlock()
+
+	if f, ok := s.failure(action, calls); ok {
+		status := f.Status
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		s.writeError(w, status, f.Code, f.Message)
+		return
+	}
+
+	var err error
+	var result interface{}
+	switch action {
+	case ActionGetMetricData:
+		result, err = s.getMetricData(r.Form)
+	case ActionListMetrics:
+		result, err = s.listMetrics(r.Form)
+	case ActionDescribeAlarms:
+		result, err = s.describeAlarms(r.Form)
+	default:
+		err = fmt.Errorf("the action %s is not valid for this web service", action)
+		s.writeError(w, http.StatusBadRequest, "InvalidAction", err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+
+	s.writeResponse(w, action, result)
+}
+
+// this return the failure of the dataset for the calls-th call to the action
+func (s *Server) failure(action string, calls int) (Failure, bool) {
+	for _, f := range s.dataset.Failures {
+		if f.Action == action && (f.Times == 0 || calls <= f.Times) {
+			return f, true
+		}
+	}
+	return Failure{}, false
+}
+
+type getMetricDataResult struct {
+	XMLName           xml.Name           `xml:"GetMetricDataResult"`
+	MetricDataResults []metricDataResult `xml:"MetricDataResults>member"`
+	NextToken         string             `xml:"NextToken,omitempty"`
+}
+
+type metricDataResult struct {
+	Id         string    `xml:"Id"`
+	Label      string    `xml:"Label"`
+	StatusCode string    `xml:"StatusCode"`
+	Timestamps []string  `xml:"Timestamps>member"`
+	Values     []float64 `xml:"Values>member"`
+	Messages   []message `xml:"Messages>member,omitempty"`
+}
+
+type message struct {
+	Code  string `xml:"Code"`
+	Value string `xml:"Value"`
+}
+
+// this return the values of the metrics queries, the metrics not found in the dataset don't have values
+func (s *Server) getMetricData(f url.Values) (interface{}, error) {
+	start, err := time.Parse(time.RFC3339, f.Get("StartTime"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid StartTime %s", f.Get("StartTime"))
+	}
+	end, err := time.Parse(time.RFC3339, f.Get("EndTime"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EndTime %s", f.Get("EndTime"))
+	}
+	if now := s.Now(); now.Before(end) {
+		end = now
+	}
+
+	res := &getMetricDataResult{}
+	for _, p := range members(f, "MetricDataQueries") {
+		if f.Get(p+".ReturnData") == "false" {
+			continue
+		}
+
+		mdr := metricDataResult{Id: f.Get(p + ".Id"), Label: f.Get(p + ".Label"), StatusCode: "Complete"}
+		if len(f.Get(p+".Expression")) > 0 {
+			mdr.Messages = append(mdr.Messages, message{Code: "Unsupported", Value: "the expressions are not supported by the mock server"})
+			res.MetricDataResults = append(res.MetricDataResults, mdr)
+			continue
+		}
+
+		namespace := f.Get(p + ".MetricStat.Metric.Namespace")
+		name := f.Get(p + ".MetricStat.Metric.MetricName")
+		if len(mdr.Label) == 0 {
+			mdr.Label = name
+		}
+		period, err := strconv.ParseInt(f.Get(p+".MetricStat.Period"), 10, 64)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid Period of the metric query %s", mdr.Id)
+		}
+
+		if m, ok := s.dataset.findMetric(namespace, name, dimensions(f, p+".MetricStat.Metric.Dimensions")); ok {
+			mdr.Timestamps, mdr.Values = datapoints(m, start, end, time.Duration(period)*time.Second)
+		}
+		if f.Get("ScanBy") == "TimestampAscending" {
+			reverse(mdr.Timestamps, mdr.Values)
+		}
+		res.MetricDataResults = append(res.MetricDataResults, mdr)
+	}
+
+	from, to, next, err := page(len(res.MetricDataResults), f.Get("NextToken"), s.dataset.PageSize, len(res.MetricDataResults))
+	if err != nil {
+		return nil, err
+	}
+	res.MetricDataResults, res.NextToken = res.MetricDataResults[from:to], next
+	return res, nil
+}
+
+// this return the timestamps and values of the metric m, from the newest period before end to start
+func datapoints(m Metric, start, end time.Time, period time.Duration) ([]string, []float64) {
+	var tss []string
+	var vs []float64
+
+	ts := end.Truncate(period)
+	if !ts.Before(end) {
+		ts = ts.Add(-period)
+	}
+	for i := 0; !ts.Before(start) && i < MaxDatapoints; i++ {
+		tss = append(tss, ts.UTC().Format(time.RFC3339))
+		vs = append(vs, m.value(i, ts))
+		ts = ts.Add(-period)
+	}
+	return tss, vs
+}
+
+func reverse(tss []string, vs []float64) {
+	for i, j := 0, len(tss)-1; i < j; i, j = i+1, j-1 {
+		tss[i], tss[j] = tss[j], tss[i]
+		vs[i], vs[j] = vs[j], vs[i]
+	}
+}
+
+type listMetricsResult struct {
+	XMLName   xml.Name     `xml:"ListMetricsResult"`
+	Metrics   []listMetric `xml:"Metrics>member"`
+	NextToken string       `xml:"NextToken,omitempty"`
+}
+
+type listMetric struct {
+	Namespace  string      `xml:"Namespace"`
+	MetricName string      `xml:"MetricName"`
+	Dimensions []Dimension `xml:"Dimensions>member"`
+}
+
+// this return the metrics of the dataset filtered by namespace, metric name and dimensions
+func (s *Server) listMetrics(f url.Values) (interface{}, error) {
+	namespace, name := f.Get("Namespace"), f.Get("MetricName")
+	filters := dimensions(f, "Dimensions")
+
+	res := &listMetricsResult{}
+	for _, m := range s.dataset.Metrics {
+		if (len(namespace) > 0 && m.Namespace != namespace) || (len(name) > 0 && m.MetricName != name) {
+			continue
+		}
+		if !matchDimensions(m.Dimensions, filters) {
+			continue
+		}
+		res.Metrics = append(res.Metrics, listMetric{Namespace: m.Namespace, MetricName: m.MetricName, Dimensions: m.Dimensions})
+	}
+
+	from, to, next, err := page(len(res.Metrics), f.Get("NextToken"), s.dataset.PageSize, MaxListMetricsResults)
+	if err != nil {
+		return nil, err
+	}
+	res.Metrics, res.NextToken = res.Metrics[from:to], next
+	return res, nil
+}
+
+// this return true when the dimensions ds have all the filters, the filters without value match any value
+func matchDimensions(ds, filters []Dimension) bool {
+	for _, fd := range filters {
+		found := false
+		for _, d := range ds {
+			if d.Name == fd.Name && (len(fd.Value) == 0 || d.Value == fd.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type describeAlarmsResult struct {
+	XMLName      xml.Name      `xml:"DescribeAlarmsResult"`
+	MetricAlarms []metricAlarm `xml:"MetricAlarms>member"`
+	NextToken    string        `xml:"NextToken,omitempty"`
+}
+
+type metricAlarm struct {
+	AlarmName   string      `xml:"AlarmName"`
+	StateValue  string      `xml:"StateValue"`
+	StateReason string      `xml:"StateReason,omitempty"`
+	Namespace   string      `xml:"Namespace,omitempty"`
+	MetricName  string      `xml:"MetricName,omitempty"`
+	Dimensions  []Dimension `xml:"Dimensions>member,omitempty"`
+	Statistic   string      `xml:"Statistic,omitempty"`
+	Period      int64       `xml:"Period,omitempty"`
+	Threshold   float64     `xml:"Threshold"`
+}
+
+// this return the alarms of the dataset filtered by names, name prefix and state
+func (s *Server) describeAlarms(f url.Values) (interface{}, error) {
+	var names []string
+	for _, p := range members(f, "AlarmNames") {
+		names = append(names, f.Get(p))
+	}
+	prefix, state := f.Get("AlarmNamePrefix"), f.Get("StateValue")
+
+	res := &describeAlarmsResult{}
+	for _, a := range s.dataset.Alarms {
+		if len(names) > 0 && !contains(names, a.AlarmName) {
+			continue
+		}
+		if !strings.HasPrefix(a.AlarmName, prefix) || (len(state) > 0 && a.StateValue != state) {
+			continue
+		}
+		res.MetricAlarms = append(res.MetricAlarms, metricAlarm(a))
+	}
+
+	size := s.dataset.PageSize
+	if mr, err := strconv.Atoi(f.Get("MaxRecords")); err == nil && mr > 0 && (size == 0 || mr < size) {
+		size = mr
+	}
+
+	from, to, next, err := page(len(res.MetricAlarms), f.Get("NextToken"), size, MaxDescribeAlarmsResults)
+	if err != nil {
+		return nil, err
+	}
+	res.MetricAlarms, res.NextToken = res.MetricAlarms[from:to], next
+	return res, nil
+}
+
+// this return the bounds of the page of n results starting at the offset of the token, and the token of the next page
+func page(n int, token string, size, max int) (int, int, string, error) {
+	if size <= 0 || size > max {
+		size = max
+	}
+
+	offset := 0
+	if len(token) > 0 {
+		var err error
+		if offset, err = strconv.Atoi(token); err != nil || offset < 0 || offset > n {
+			return 0, 0, "", fmt.Errorf("invalid NextToken %s", token)
+		}
+	}
+
+	if offset+size >= n {
+		return offset, n, "", nil
+	}
+	return offset, offset + size, strconv.Itoa(offset + size), nil
+}
+
+// this return the prefixes of the members of the list parameter name, i.e.: Dimensions.member.1
+func members(f url.Values, name string) []string {
+	var ps []string
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s.member.%d", name, i)
+		found := false
+		for k := range f {
+			if k == p || strings.HasPrefix(k, p+".") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ps
+		}
+		ps = append(ps, p)
+	}
+}
+
+func dimensions(f url.Values, name string) []Dimension {
+	var ds []Dimension
+	for _, p := range members(f, name) {
+		ds = append(ds, Dimension{Name: f.Get(p + ".Name"), Value: f.Get(p + ".Value")})
+	}
+	return ds
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type responseMetadata struct {
+	RequestId string `xml:"RequestId"`
+}
+
+// this write the result of the action as AWS Query API response
+func (s *Server) writeResponse(w http.ResponseWriter, action string, result interface{}) {
+	resp := struct {
+		XMLName          xml.Name
+		Xmlns            string `xml:"xmlns,attr"`
+		Result           interface{}
+		ResponseMetadata responseMetadata `xml:"ResponseMetadata"`
+	}{
+		XMLName:          xml.Name{Local: action + "Response"},
+		Xmlns:            xmlNamespace,
+		Result:           result,
+		ResponseMetadata: responseMetadata{RequestId: s.requestId()},
+	}
+
+	bs, err := xml.Marshal(resp)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "InternalFailure", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(bs)
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Error   struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+	RequestId string `xml:"RequestId"`
+}
+
+// this write the AWS Query API error response
+func (s *Server) writeError(w http.ResponseWriter, status int, code, msg string) {
+	e := errorResponse{Xmlns: xmlNamespace, RequestId: s.requestId()}
+	e.Error.Type = "Sender"
+	if status >= http.StatusInternalServerError {
+		e.Error.Type = "Receiver"
+	}
+	e.Error.Code = code
+	e.Error.Message = msg
+
+	log.Debugf("Mock CloudWatch error %d %s: %s", status, code, msg)
+	bs, _ := xml.Marshal(e)
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(bs)
+}
+
+func (s *Server) requestId() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", s.requests)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cwmock
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func prepareDataset() string {
+	return `
+PageSize: 2
+Metrics:
+  - Namespace: AWS/EC2
+    MetricName: CPUUtilization
+    Dimensions:
+      - Name: InstanceId
+        Value: i-1
+    Values: [10, 20]
+  - Namespace: AWS/EC2
+    MetricName: CPUUtilization
+    Dimensions:
+      - Name: InstanceId
+        Value: i-2
+    Min: 50
+    Max: 60
+  - Namespace: AWS/EC2
+    MetricName: NetworkIn
+    Dimensions:
+      - Name: InstanceId
+        Value: i-1
+  - Namespace: AWS/ELB
+    MetricName: RequestCount
+Alarms:
+  - AlarmName: cpu-high
+    StateValue: ALARM
+    Namespace: AWS/EC2
+    MetricName: CPUUtilization
+    Threshold: 90
+  - AlarmName: cpu-low
+    StateValue: OK
+Failures:
+  - Action: DescribeAlarms
+    Code: Throttling
+    Message: Rate exceeded
+    Times: 1
+`
+}
+
+func newTestClient(t *testing.T) (*cloudwatch.CloudWatch, *Server) {
+	d, err := ReadDataset([]byte(prepareDataset()))
+	if err != nil {
+		t.Fatalf("ReadDataset(): %v", err)
+	}
+	s := New(d)
+	s.Now = func() time.Time { return time.Date(2020, 1, 1, 10, 7, 0, 0, time.UTC) }
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return cloudwatch.New(sess), s
+}
+
+func metricStatQuery(id, instance string) *cloudwatch.MetricDataQuery {
+	return &cloudwatch.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cloudwatch.MetricStat{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String("AWS/EC2"),
+				MetricName: aws.String("CPUUtilization"),
+				Dimensions: []*cloudwatch.Dimension{{Name: aws.String("InstanceId"), Value: aws.String(instance)}},
+			},
+			Period: aws.Int64(300),
+			Stat:   aws.String("Average"),
+		},
+	}
+}
+
+func TestServer_GetMetricData(t *testing.T) {
+	svc, _ := newTestClient(t)
+
+	in := &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(time.Date(2020, 1, 1, 9, 50, 0, 0, time.UTC)),
+		EndTime:   aws.Time(time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)),
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{
+			metricStatQuery("m1", "i-1"),
+			metricStatQuery("m2", "i-2"),
+			metricStatQuery("m3", "i-3"),
+			{Id: aws.String("e1"), Expression: aws.String("m1*2")},
+		},
+	}
+
+	var got []*cloudwatch.MetricDataResult
+	err := svc.GetMetricDataPages(in, func(o *cloudwatch.GetMetricDataOutput, _ bool) bool {
+		got = append(got, o.MetricDataResults...)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("GetMetricData(): %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("GetMetricData(): got: %v --> want: 4 results", len(got))
+	}
+
+	wantTs := []*time.Time{
+		aws.Time(time.Date(2020, 1, 1, 10, 5, 0, 0, time.UTC)),
+		aws.Time(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)),
+		aws.Time(time.Date(2020, 1, 1, 9, 55, 0, 0, time.UTC)),
+		aws.Time(time.Date(2020, 1, 1, 9, 50, 0, 0, time.UTC)),
+	}
+	if !reflect.DeepEqual(got[0].Timestamps, wantTs) {
+		t.Errorf("GetMetricData(): got: %v --> want: %v", got[0].Timestamps, wantTs)
+	}
+	if want := aws.Float64Slice([]float64{10, 20, 10, 20}); !reflect.DeepEqual(got[0].Values, want) {
+		t.Errorf("GetMetricData(): got: %v --> want: %v", aws.Float64ValueSlice(got[0].Values), aws.Float64ValueSlice(want))
+	}
+	for _, v := range got[1].Values {
+		if *v < 50 || *v > 60 {
+			t.Errorf("GetMetricData(): got: %v --> want: a synthetic value between 50 and 60", *v)
+		}
+	}
+	if len(got[2].Values) != 0 || *got[2].StatusCode != cloudwatch.StatusCodeComplete {
+		t.Errorf("GetMetricData(): got: %v --> want: no values of an unknown metric", got[2])
+	}
+	if len(got[3].Messages) != 1 {
+		t.Errorf("GetMetricData(): got: %v --> want: a message of the unsupported expression", got[3])
+	}
+
+	// the synthetic values are deterministic
+	again, err := svc.GetMetricData(&cloudwatch.GetMetricDataInput{
+		StartTime:         in.StartTime,
+		EndTime:           in.EndTime,
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{metricStatQuery("m2", "i-2")},
+		ScanBy:            aws.String(cloudwatch.ScanByTimestampAscending),
+	})
+	if err != nil {
+		t.Fatalf("GetMetricData(): %v", err)
+	}
+	if got, want := *again.MetricDataResults[0].Values[3], *got[1].Values[0]; got != want {
+		t.Errorf("GetMetricData(): got: %v --> want: %v", got, want)
+	}
+}
+
+func TestServer_ListMetrics(t *testing.T) {
+	svc, s := newTestClient(t)
+
+	tests := []struct {
+		name string
+		in   *cloudwatch.ListMetricsInput
+		want int
+	}{
+		{name: "All", in: &cloudwatch.ListMetricsInput{}, want: 4},
+		{name: "Namespace", in: &cloudwatch.ListMetricsInput{Namespace: aws.String("AWS/EC2")}, want: 3},
+		{name: "MetricName", in: &cloudwatch.ListMetricsInput{Namespace: aws.String("AWS/EC2"), MetricName: aws.String("NetworkIn")}, want: 1},
+		{name: "DimensionName", in: &cloudwatch.ListMetricsInput{Dimensions: []*cloudwatch.DimensionFilter{{Name: aws.String("InstanceId")}}}, want: 3},
+		{name: "DimensionValue", in: &cloudwatch.ListMetricsInput{Dimensions: []*cloudwatch.DimensionFilter{{Name: aws.String("InstanceId"), Value: aws.String("i-2")}}}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			err := svc.ListMetricsPages(tt.in, func(o *cloudwatch.ListMetricsOutput, _ bool) bool {
+				got += len(o.Metrics)
+				return true
+			})
+			if err != nil {
+				t.Fatalf("ListMetrics(): %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ListMetrics(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+
+	// the results are returned in pages of 2
+	if got := s.Calls(ActionListMetrics); got != 8 {
+		t.Errorf("Calls(): got: %v --> want: %v", got, 8)
+	}
+}
+
+func TestServer_DescribeAlarms(t *testing.T) {
+	svc, _ := newTestClient(t)
+
+	_, err := svc.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "Throttling" {
+		t.Fatalf("DescribeAlarms(): got: %v --> want: a Throttling error", err)
+	}
+
+	got, err := svc.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{StateValue: aws.String(cloudwatch.StateValueAlarm)})
+	if err != nil {
+		t.Fatalf("DescribeAlarms(): %v", err)
+	}
+	if len(got.MetricAlarms) != 1 || *got.MetricAlarms[0].AlarmName != "cpu-high" || *got.MetricAlarms[0].Threshold != 90 {
+		t.Errorf("DescribeAlarms(): got: %v --> want: the alarm cpu-high", got.MetricAlarms)
+	}
+
+	got, err = svc.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{AlarmNames: aws.StringSlice([]string{"cpu-low"})})
+	if err != nil {
+		t.Fatalf("DescribeAlarms(): %v", err)
+	}
+	if len(got.MetricAlarms) != 1 || *got.MetricAlarms[0].AlarmName != "cpu-low" {
+		t.Errorf("DescribeAlarms(): got: %v --> want: the alarm cpu-low", got.MetricAlarms)
+	}
+}
+
+func TestServer_Paging(t *testing.T) {
+	d, err := ReadDataset([]byte(prepareDataset()))
+	if err != nil {
+		t.Fatalf("ReadDataset(): %v", err)
+	}
+	d.PageSize = 1
+	d.Failures = nil
+	ts := httptest.NewServer(New(d))
+	defer ts.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	svc := cloudwatch.New(sess)
+
+	// every page has one result and the pages follow the NextToken until the last one
+	var metrics []string
+	pages := 0
+	err = svc.ListMetricsPages(&cloudwatch.ListMetricsInput{Namespace: aws.String("AWS/EC2")}, func(o *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		pages++
+		for _, m := range o.Metrics {
+			metrics = append(metrics, aws.StringValue(m.MetricName)+"/"+aws.StringValue(m.Dimensions[0].Value))
+		}
+		if lastPage != (o.NextToken == nil) {
+			t.Errorf("ListMetricsPages(): got: last page %v with NextToken %v", lastPage, aws.StringValue(o.NextToken))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ListMetricsPages(): %v", err)
+	}
+	want := []string{"CPUUtilization/i-1", "CPUUtilization/i-2", "NetworkIn/i-1"}
+	if pages != 3 || !reflect.DeepEqual(metrics, want) {
+		t.Errorf("ListMetricsPages(): got: %v pages, %v --> want: %v pages, %v", pages, metrics, 3, want)
+	}
+
+	var alarms []string
+	pages = 0
+	err = svc.DescribeAlarmsPages(&cloudwatch.DescribeAlarmsInput{}, func(o *cloudwatch.DescribeAlarmsOutput, _ bool) bool {
+		pages++
+		for _, a := range o.MetricAlarms {
+			alarms = append(alarms, aws.StringValue(a.AlarmName))
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("DescribeAlarmsPages(): %v", err)
+	}
+	want = []string{"cpu-high", "cpu-low"}
+	if pages != 2 || !reflect.DeepEqual(alarms, want) {
+		t.Errorf("DescribeAlarmsPages(): got: %v pages, %v --> want: %v pages, %v", pages, alarms, 2, want)
+	}
+}
+
+func TestServer_UnknownAction(t *testing.T) {
+	svc, _ := newTestClient(t)
+
+	_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String("Custom"),
+		MetricData: []*cloudwatch.MetricDatum{{MetricName: aws.String("m"), Value: aws.Float64(1)}},
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "InvalidAction" {
+		t.Errorf("PutMetricData(): got: %v --> want: an InvalidAction error", err)
+	}
+}
+
+func TestReadDataset(t *testing.T) {
+	if _, err := ReadDataset([]byte("Metrics:\n  - MetricName: CPUUtilization\n")); err == nil {
+		t.Errorf("ReadDataset(): got: nil --> want: an error of the metric without Namespace")
+	}
+	if _, err := ReadDataset([]byte("Metrics: [")); err == nil {
+		t.Errorf("ReadDataset(): got: nil --> want: an yaml error")
+	}
+}
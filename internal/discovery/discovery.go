@@ -0,0 +1,220 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package discovery
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_ListMetrics.html
+// https://docs.aws.amazon.com/sdk-for-go/api/service/cloudwatch/#CloudWatch.ListMetricsPages
+
+// Only the metrics with data points in the last 3 hours are discovered, the others can't have values
+const recentlyActive = "PT3H"
+
+// Resource is an AWS resource discovered by its tags
+type Resource struct {
+	ARN            string
+	DimensionName  string
+	DimensionValue string
+	Tags           map[string]string
+}
+
+type Discoverer struct {
+	cw      cloudwatchiface.CloudWatchAPI
+	tagging resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+}
+
+func New(cw cloudwatchiface.CloudWatchAPI, tagging resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) *Discoverer {
+	return &Discoverer{
+		cw:      cw,
+		tagging: tagging,
+	}
+}
+
+// Expand return the metrics queries qs where every template (metric query with dimensions to be discovered)
+// is replaced by the concrete metrics queries found using the AWS CloudWatch API ListMetrics or
+// the AWS Resource Groups Tagging API when the template has TagDiscovery.
+// The concrete metrics queries have the Id of the template plus a hash of its dimensions values,
+// so the Id of a discovered metric query is always the same between discoveries. The discovered metrics
+// queries with the Id of other metric query are skipped, the explicit metrics queries have precedence.
+// The resources discovered by its tags are returned sorted by ARN and without duplicates.
+func (d *Discoverer) Expand(qs []config.MetricDataQuery) ([]config.MetricDataQuery, []Resource, error) {
+	var expanded []config.MetricDataQuery
+	resources := make(map[string]Resource)
+
+	ids := make(map[string]bool)
+	for _, q := range qs {
+		if !q.IsDiscovery() {
+			ids[q.ID] = true
+		}
+	}
+
+	for _, q := range qs {
+		if !q.IsDiscovery() {
+			expanded = append(expanded, q)
+			continue
+		}
+
+		var dqs []config.MetricDataQuery
+		var err error
+		if q.TagDiscovery != nil {
+			var rs []Resource
+			dqs, rs, err = discoverByTags(d.tagging, q)
+			for _, r := range rs {
+				resources[r.ARN] = r
+			}
+		} else {
+			dqs, err = discover(d.cw, q)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error discovering metrics for metric query id: %s, %v", q.ID, err)
+		}
+		log.Debugf("Discovered %v metrics for metric query id: %s", len(dqs), q.ID)
+
+		for _, dq := range dqs {
+			if ids[dq.ID] {
+				log.Errorf("The metric query id: %s discovered for the metric query id: %s with dimensions: %v is the Id of other metric query, it is skipped", dq.ID, q.ID, dq.MetricStat.Metric.Dimensions)
+				continue
+			}
+			ids[dq.ID] = true
+			expanded = append(expanded, dq)
+		}
+	}
+
+	var rs []Resource
+	for _, r := range resources {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ARN < rs[j].ARN })
+
+	return expanded, rs, nil
+}
+
+// this call ListMetrics using the dimensions of the template t as filter
+// and return one metric query for every metric found
+func discover(svc cloudwatchiface.CloudWatchAPI, t config.MetricDataQuery) ([]config.MetricDataQuery, error) {
+	regexps := make(map[string]*regexp.Regexp)
+	var filters []*cloudwatch.DimensionFilter
+
+	for _, d := range t.MetricStat.Metric.Dimensions {
+		f := &cloudwatch.DimensionFilter{Name: aws.String(d.Name)}
+
+		if d.IsDiscovery() {
+			if len(d.Regex) > 0 {
+				r, err := regexp.Compile(d.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex for dimension: %s, %v", d.Name, err)
+				}
+				regexps[d.Name] = r
+			}
+		} else {
+			f.Value = aws.String(d.Value)
+		}
+
+		filters = append(filters, f)
+	}
+
+	lmi := &cloudwatch.ListMetricsInput{
+		Namespace:      aws.String(t.MetricStat.Metric.Namespace),
+		MetricName:     aws.String(t.MetricStat.Metric.MetricName),
+		Dimensions:     filters,
+		RecentlyActive: aws.String(recentlyActive),
+	}
+
+	// the metrics of the source account when the exporter use a cross-account observability monitoring account
+	if len(t.AccountID) > 0 {
+		lmi.IncludeLinkedAccounts = aws.Bool(true)
+		lmi.OwningAccount = aws.String(t.AccountID)
+	}
+
+	var qs []config.MetricDataQuery
+	err := svc.ListMetricsPages(lmi, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			if q, ok := newMetricDataQuery(t, m, regexps); ok {
+				qs = append(qs, q)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return qs, nil
+}
+
+// this create the metric query for the metric m using the template t, the metric is not valid
+// when it doesn't have exactly the dimensions of the template or when a value doesn't match its regex
+func newMetricDataQuery(t config.MetricDataQuery, m *cloudwatch.Metric, regexps map[string]*regexp.Regexp) (config.MetricDataQuery, bool) {
+	if len(m.Dimensions) != len(t.MetricStat.Metric.Dimensions) {
+		return config.MetricDataQuery{}, false
+	}
+
+	values := make(map[string]string)
+	for _, d := range m.Dimensions {
+		values[aws.StringValue(d.Name)] = aws.StringValue(d.Value)
+	}
+
+	var dims []config.Dimension
+	for _, td := range t.MetricStat.Metric.Dimensions {
+		v, ok := values[td.Name]
+		if !ok {
+			return config.MetricDataQuery{}, false
+		}
+		if r, ok := regexps[td.Name]; ok && !r.MatchString(v) {
+			return config.MetricDataQuery{}, false
+		}
+
+		dims = append(dims, config.Dimension{Name: td.Name, Value: v})
+	}
+
+	return newConcreteMetricDataQuery(t, dims), true
+}
+
+// this create the concrete metric query from the template t with the dimensions dims discovered,
+// the Id is the Id of the template plus a hash of the dimensions
+func newConcreteMetricDataQuery(t config.MetricDataQuery, dims []config.Dimension) config.MetricDataQuery {
+	var key []string
+	for _, d := range dims {
+		key = append(key, d.Name+"="+d.Value)
+	}
+
+	q := t
+	q.ID = t.ID + "_" + hash(strings.Join(key, ","))
+	q.MetricStat.Metric.Dimensions = dims
+	q.TagDiscovery = nil
+
+	return q
+}
+
+// this return a short and valid metric query id suffix from the string s
+func hash(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
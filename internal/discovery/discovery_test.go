@@ -0,0 +1,208 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package discovery
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeCloudWatch is an AWS CloudWatch client which return the ListMetrics pages and save the request
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	pages []*cloudwatch.ListMetricsOutput
+	input *cloudwatch.ListMetricsInput
+}
+
+func (f *fakeCloudWatch) ListMetricsPages(in *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	f.input = in
+	for i, p := range f.pages {
+		if !fn(p, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// this return a ListMetrics page with the metrics of the tables names
+func tablesPage(names ...string) *cloudwatch.ListMetricsOutput {
+	page := &cloudwatch.ListMetricsOutput{}
+	for _, n := range names {
+		page.Metrics = append(page.Metrics, &cloudwatch.Metric{
+			Namespace:  aws.String("AWS/DynamoDB"),
+			MetricName: aws.String("ProvisionedWriteCapacityUnits"),
+			Dimensions: []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String(n)}},
+		})
+	}
+	return page
+}
+
+func prepareTemplate() config.MetricDataQuery {
+	MetricDataQueryYaml := `
+Id: m1
+MetricStat:
+  Metric:
+    Namespace: AWS/DynamoDB
+    MetricName: ProvisionedWriteCapacityUnits
+    Dimensions:
+      - Name: TableName
+        Value: "*"
+  Stat: Maximum
+`
+	q := config.MetricDataQuery{}
+	err := yaml.Unmarshal([]byte(MetricDataQueryYaml), &q)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return q
+}
+
+func Test_newMetricDataQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  *cloudwatch.Metric
+		regexps map[string]*regexp.Regexp
+		wantOk  bool
+		wantID  string
+		wantDim []config.Dimension
+	}{
+		{
+			name: "Wildcard",
+			metric: &cloudwatch.Metric{
+				Dimensions: []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String("Player")}},
+			},
+			wantOk:  true,
+			wantID:  "m1_" + hash("TableName=Player"),
+			wantDim: []config.Dimension{{Name: "TableName", Value: "Player"}},
+		},
+		{
+			name: "RegexMatch",
+			metric: &cloudwatch.Metric{
+				Dimensions: []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String("prod-users")}},
+			},
+			regexps: map[string]*regexp.Regexp{"TableName": regexp.MustCompile("^prod-")},
+			wantOk:  true,
+			wantID:  "m1_" + hash("TableName=prod-users"),
+			wantDim: []config.Dimension{{Name: "TableName", Value: "prod-users"}},
+		},
+		{
+			name: "RegexNotMatch",
+			metric: &cloudwatch.Metric{
+				Dimensions: []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String("dev-users")}},
+			},
+			regexps: map[string]*regexp.Regexp{"TableName": regexp.MustCompile("^prod-")},
+			wantOk:  false,
+		},
+		{
+			name: "MoreDimensionsThanTemplate",
+			metric: &cloudwatch.Metric{
+				Dimensions: []*cloudwatch.Dimension{
+					{Name: aws.String("TableName"), Value: aws.String("Player")},
+					{Name: aws.String("Operation"), Value: aws.String("GetItem")},
+				},
+			},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := newMetricDataQuery(prepareTemplate(), tt.metric, tt.regexps)
+			if ok != tt.wantOk {
+				t.Fatalf("newMetricDataQuery(): got ok: %v --> want: %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("newMetricDataQuery(): got Id: %v --> want: %v", got.ID, tt.wantID)
+			}
+			if !reflect.DeepEqual(got.MetricStat.Metric.Dimensions, tt.wantDim) {
+				t.Errorf("newMetricDataQuery(): got Dimensions: %v --> want: %v", got.MetricStat.Metric.Dimensions, tt.wantDim)
+			}
+			if got.IsDiscovery() {
+				t.Errorf("newMetricDataQuery(): the discovered metric query must not be a template")
+			}
+		})
+	}
+}
+
+func Test_discover(t *testing.T) {
+	tmpl := prepareTemplate()
+	tmpl.MetricStat.Metric.Dimensions[0].Regex = "^prod-"
+	tmpl.MetricStat.Metric.Dimensions = append(tmpl.MetricStat.Metric.Dimensions, config.Dimension{Name: "Operation", Value: "GetItem"})
+
+	page := tablesPage("prod-users", "dev-users")
+	for _, m := range page.Metrics {
+		m.Dimensions = append(m.Dimensions, &cloudwatch.Dimension{Name: aws.String("Operation"), Value: aws.String("GetItem")})
+	}
+	svc := &fakeCloudWatch{pages: []*cloudwatch.ListMetricsOutput{page, tablesPage("prod-orders")}}
+
+	got, err := discover(svc, tmpl)
+	if err != nil {
+		t.Fatalf("discover(): %v", err)
+	}
+
+	// the discovered dimensions are filtered only by its name and the others by its value too
+	wantFilters := []*cloudwatch.DimensionFilter{
+		{Name: aws.String("TableName")},
+		{Name: aws.String("Operation"), Value: aws.String("GetItem")},
+	}
+	if !reflect.DeepEqual(svc.input.Dimensions, wantFilters) || aws.StringValue(svc.input.RecentlyActive) != recentlyActive {
+		t.Errorf("discover(): got input: %v --> want filters: %v", svc.input, wantFilters)
+	}
+
+	// the metrics of every page not matching the regex or without the dimensions of the template are discarded
+	var gotIDs []string
+	for _, q := range got {
+		gotIDs = append(gotIDs, q.ID)
+	}
+	wantIDs := []string{"m1_" + hash("TableName=prod-users,Operation=GetItem")}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("discover(): got: %v --> want: %v", gotIDs, wantIDs)
+	}
+}
+
+func TestDiscoverer_ExpandDuplicatedIDs(t *testing.T) {
+	// the explicit metric query has the Id of the discovered metric query of the table Player
+	explicit := prepareTemplate()
+	explicit.ID = "m1_" + hash("TableName=Player")
+	explicit.MetricStat.Metric.Dimensions[0].Value = "Other"
+
+	// the table Users is returned twice
+	svc := &fakeCloudWatch{pages: []*cloudwatch.ListMetricsOutput{tablesPage("Player", "Users"), tablesPage("Users")}}
+
+	got, _, err := New(svc, nil).Expand([]config.MetricDataQuery{prepareTemplate(), explicit})
+	if err != nil {
+		t.Fatalf("Expand(): %v", err)
+	}
+
+	var gotIDs []string
+	for _, q := range got {
+		gotIDs = append(gotIDs, q.ID)
+	}
+	wantIDs := []string{"m1_" + hash("TableName=Users"), explicit.ID}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("Expand(): got: %v --> want: %v", gotIDs, wantIDs)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// https://docs.aws.amazon.com/resourcegroupstagging/latest/APIReference/API_GetResources.html
+// https://docs.aws.amazon.com/general/latest/gr/aws-arns-and-namespaces.html
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/aws-services-cloudwatch-metrics.html
+
+// The prefix of the prometheus labels created from the exported tags
+const TagLabelPrefix = "tag_"
+
+// Used to replace the characters of the tags keys not allowed into prometheus labels names
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// resourceMapping is how the resources of an AWS CloudWatch namespace are found using the
+// AWS Resource Groups Tagging API and how its ARNs are mapped to the metrics dimension value
+type resourceMapping struct {
+	// The resource type filter used to call GetResources
+	resourceType string
+
+	// The name of the metric dimension which identify the resource
+	dimensionName string
+
+	// The first submatch of the regexp over the ARN of the resource is the dimension value
+	arnRegexp *regexp.Regexp
+}
+
+// The mapping table of the common AWS CloudWatch namespaces
+var resourceMappings = map[string]resourceMapping{
+	"AWS/ApplicationELB": {"elasticloadbalancing:loadbalancer/app", "LoadBalancer", regexp.MustCompile(`:loadbalancer/(app/.+)$`)},
+	"AWS/AutoScaling":    {"autoscaling:autoScalingGroup", "AutoScalingGroupName", regexp.MustCompile(`:autoScalingGroupName/(.+)$`)},
+	"AWS/CloudFront":     {"cloudfront:distribution", "DistributionId", regexp.MustCompile(`:distribution/(.+)$`)},
+	"AWS/DocDB":          {"rds:cluster", "DBClusterIdentifier", regexp.MustCompile(`:cluster:(.+)$`)},
+	"AWS/DynamoDB":       {"dynamodb:table", "TableName", regexp.MustCompile(`:table/(.+)$`)},
+	"AWS/EBS":            {"ec2:volume", "VolumeId", regexp.MustCompile(`:volume/(.+)$`)},
+	"AWS/EC2":            {"ec2:instance", "InstanceId", regexp.MustCompile(`:instance/(.+)$`)},
+	"AWS/ECS":            {"ecs:cluster", "ClusterName", regexp.MustCompile(`:cluster/(.+)$`)},
+	"AWS/EFS":            {"elasticfilesystem:file-system", "FileSystemId", regexp.MustCompile(`:file-system/(.+)$`)},
+	"AWS/ELB":            {"elasticloadbalancing:loadbalancer", "LoadBalancerName", regexp.MustCompile(`:loadbalancer/([^/]+)$`)},
+	"AWS/ES":             {"es:domain", "DomainName", regexp.MustCompile(`:domain/(.+)$`)},
+	"AWS/ElastiCache":    {"elasticache:cluster", "CacheClusterId", regexp.MustCompile(`:cluster:(.+)$`)},
+	"AWS/Firehose":       {"firehose:deliverystream", "DeliveryStreamName", regexp.MustCompile(`:deliverystream/(.+)$`)},
+	"AWS/Kinesis":        {"kinesis:stream", "StreamName", regexp.MustCompile(`:stream/(.+)$`)},
+	"AWS/Lambda":         {"lambda:function", "FunctionName", regexp.MustCompile(`:function:([^:]+)$`)},
+	"AWS/NATGateway":     {"ec2:natgateway", "NatGatewayId", regexp.MustCompile(`:natgateway/(.+)$`)},
+	"AWS/NetworkELB":     {"elasticloadbalancing:loadbalancer/net", "LoadBalancer", regexp.MustCompile(`:loadbalancer/(net/.+)$`)},
+	"AWS/RDS":            {"rds:db", "DBInstanceIdentifier", regexp.MustCompile(`:db:(.+)$`)},
+	"AWS/Redshift":       {"redshift:cluster", "ClusterIdentifier", regexp.MustCompile(`:cluster:(.+)$`)},
+	"AWS/S3":             {"s3", "BucketName", regexp.MustCompile(`^arn:[^:]+:s3:::(.+)$`)},
+	"AWS/SNS":            {"sns", "TopicName", regexp.MustCompile(`:([^:]+)$`)},
+	"AWS/SQS":            {"sqs", "QueueName", regexp.MustCompile(`:([^:]+)$`)},
+	"AWS/States":         {"states:stateMachine", "StateMachineArn", regexp.MustCompile(`^(arn:.+:stateMachine:.+)$`)},
+}
+
+// ResourceDimensionName return the name of the dimension which identify the resources of the namespace ns
+func ResourceDimensionName(ns string) (string, bool) {
+	rm, ok := resourceMappings[ns]
+	return rm.dimensionName, ok
+}
+
+// this call GetResources using the tags filters of the template t and return one metric query
+// for every resource found, its dimension is the one mapped for the namespace of the template
+func discoverByTags(svc resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI, t config.MetricDataQuery) ([]config.MetricDataQuery, []Resource, error) {
+	rm, ok := resourceMappings[t.MetricStat.Metric.Namespace]
+	if !ok {
+		return nil, nil, fmt.Errorf("the namespace: %s is not supported by the tag discovery", t.MetricStat.Metric.Namespace)
+	}
+
+	resourceType := rm.resourceType
+	if len(t.TagDiscovery.ResourceType) > 0 {
+		resourceType = t.TagDiscovery.ResourceType
+	}
+
+	var filters []*resourcegroupstaggingapi.TagFilter
+	for _, tf := range t.TagDiscovery.TagFilters {
+		filters = append(filters, &resourcegroupstaggingapi.TagFilter{
+			Key:    aws.String(tf.Key),
+			Values: aws.StringSlice(tf.Values),
+		})
+	}
+
+	gri := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: aws.StringSlice([]string{resourceType}),
+		TagFilters:          filters,
+	}
+
+	var qs []config.MetricDataQuery
+	var rs []Resource
+	err := svc.GetResourcesPages(gri, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		for _, rtm := range page.ResourceTagMappingList {
+			if q, ok := newTaggedMetricDataQuery(t, rm, rtm); ok {
+				qs = append(qs, q)
+				rs = append(rs, newResource(rm, rtm))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return qs, rs, nil
+}
+
+// this create the resource from rtm, rtm must be valid for the resource mapping rm
+func newResource(rm resourceMapping, rtm *resourcegroupstaggingapi.ResourceTagMapping) Resource {
+	r := Resource{
+		ARN:            aws.StringValue(rtm.ResourceARN),
+		DimensionName:  rm.dimensionName,
+		DimensionValue: rm.arnRegexp.FindStringSubmatch(aws.StringValue(rtm.ResourceARN))[1],
+		Tags:           make(map[string]string),
+	}
+	for _, tag := range rtm.Tags {
+		r.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return r
+}
+
+// this create the metric query for the resource rtm using the template t, the resource is not valid
+// when the dimension value can't be taken from its ARN
+func newTaggedMetricDataQuery(t config.MetricDataQuery, rm resourceMapping, rtm *resourcegroupstaggingapi.ResourceTagMapping) (config.MetricDataQuery, bool) {
+	match := rm.arnRegexp.FindStringSubmatch(aws.StringValue(rtm.ResourceARN))
+	if match == nil {
+		return config.MetricDataQuery{}, false
+	}
+	resourceDim := config.Dimension{Name: rm.dimensionName, Value: match[1]}
+
+	// the dimension of the resource replace the same dimension of the template, or it is the first one
+	// when the template doesn't have it
+	var dims []config.Dimension
+	found := false
+	for _, d := range t.MetricStat.Metric.Dimensions {
+		if d.Name == rm.dimensionName {
+			dims = append(dims, resourceDim)
+			found = true
+			continue
+		}
+		dims = append(dims, config.Dimension{Name: d.Name, Value: d.Value})
+	}
+	if !found {
+		dims = append([]config.Dimension{resourceDim}, dims...)
+	}
+
+	q := newConcreteMetricDataQuery(t, dims)
+
+	// all the exported tags are labels, even when the resource doesn't have the tag
+	if len(t.TagDiscovery.ExportedTags) > 0 {
+		tags := make(map[string]string)
+		for _, tag := range rtm.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		q.TagLabels = make(map[string]string)
+		for l, k := range tagLabelsKeys(t.TagDiscovery.ExportedTags) {
+			q.TagLabels[l] = tags[k]
+		}
+	}
+
+	return q, true
+}
+
+// TagLabelName return the prometheus label name of the tag key k, i.e.: aws:cloudformation:stack-name --> tag_aws_cloudformation_stack_name
+func TagLabelName(k string) string {
+	return TagLabelPrefix + strings.ToLower(invalidLabelChars.ReplaceAllString(k, "_"))
+}
+
+// TagsLabels return the prometheus labels of the tags, by its label name. The tags keys which only differ by its case
+// or by the characters not allowed into the labels names have the same label name, the key sorted first is used
+// and the others are ignored, i.e.: Env and env --> tag_env with the value of Env
+func TagsLabels(tags map[string]string) map[string]string {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	labels := make(map[string]string)
+	for l, k := range tagLabelsKeys(keys) {
+		labels[l] = tags[k]
+	}
+	return labels
+}
+
+// this return the tag key of every label name of the tags keys ks, when several keys have
+// the same label name the key sorted first is used
+func tagLabelsKeys(ks []string) map[string]string {
+	sorted := append([]string(nil), ks...)
+	sort.Strings(sorted)
+
+	keys := make(map[string]string)
+	for _, k := range sorted {
+		if _, ok := keys[TagLabelName(k)]; !ok {
+			keys[TagLabelName(k)] = k
+		}
+	}
+	return keys
+}
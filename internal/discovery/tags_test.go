@@ -0,0 +1,202 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package discovery
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func prepareTagTemplate() config.MetricDataQuery {
+	MetricDataQueryYaml := `
+Id: rds_cpu
+MetricStat:
+  Metric:
+    Namespace: AWS/RDS
+    MetricName: CPUUtilization
+  Stat: Average
+TagDiscovery:
+  TagFilters:
+    - Key: team
+      Values:
+        - payments
+  ExportedTags:
+    - team
+    - env
+`
+	q := config.MetricDataQuery{}
+	err := yaml.Unmarshal([]byte(MetricDataQueryYaml), &q)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return q
+}
+
+func Test_newTaggedMetricDataQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		namespace     string
+		arn           string
+		exportedTags  []string
+		tags          map[string]string
+		wantOk        bool
+		wantDim       []config.Dimension
+		wantTagLabels map[string]string
+	}{
+		{
+			name:          "RDSInstance",
+			namespace:     "AWS/RDS",
+			arn:           "arn:aws:rds:eu-west-1:123456789012:db:payments-db",
+			tags:          map[string]string{"team": "payments"},
+			wantOk:        true,
+			wantDim:       []config.Dimension{{Name: "DBInstanceIdentifier", Value: "payments-db"}},
+			wantTagLabels: map[string]string{"tag_team": "payments", "tag_env": ""},
+		},
+		{
+			name:          "ApplicationELB",
+			namespace:     "AWS/ApplicationELB",
+			arn:           "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/my-alb/1234567890abcdef",
+			tags:          map[string]string{"team": "payments", "env": "prod"},
+			wantOk:        true,
+			wantDim:       []config.Dimension{{Name: "LoadBalancer", Value: "app/my-alb/1234567890abcdef"}},
+			wantTagLabels: map[string]string{"tag_team": "payments", "tag_env": "prod"},
+		},
+		{
+			// the exported tags env and Env have the same label, Env is sorted first
+			name:          "ExportedTagsCaseCollision",
+			namespace:     "AWS/RDS",
+			arn:           "arn:aws:rds:eu-west-1:123456789012:db:payments-db",
+			exportedTags:  []string{"env", "Env"},
+			tags:          map[string]string{"env": "dev", "Env": "prod"},
+			wantOk:        true,
+			wantDim:       []config.Dimension{{Name: "DBInstanceIdentifier", Value: "payments-db"}},
+			wantTagLabels: map[string]string{"tag_env": "prod"},
+		},
+		{
+			name:      "ClassicELBDoesNotMatchApplicationELB",
+			namespace: "AWS/ELB",
+			arn:       "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/my-alb/1234567890abcdef",
+			wantOk:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := prepareTagTemplate()
+			tmpl.MetricStat.Metric.Namespace = tt.namespace
+			if len(tt.exportedTags) > 0 {
+				tmpl.TagDiscovery.ExportedTags = tt.exportedTags
+			}
+
+			rtm := &resourcegroupstaggingapi.ResourceTagMapping{ResourceARN: aws.String(tt.arn)}
+			for k, v := range tt.tags {
+				rtm.Tags = append(rtm.Tags, &resourcegroupstaggingapi.Tag{Key: aws.String(k), Value: aws.String(v)})
+			}
+
+			got, ok := newTaggedMetricDataQuery(tmpl, resourceMappings[tt.namespace], rtm)
+			if ok != tt.wantOk {
+				t.Fatalf("newTaggedMetricDataQuery(): got ok: %v --> want: %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(got.MetricStat.Metric.Dimensions, tt.wantDim) {
+				t.Errorf("newTaggedMetricDataQuery(): got Dimensions: %v --> want: %v", got.MetricStat.Metric.Dimensions, tt.wantDim)
+			}
+			if !reflect.DeepEqual(got.TagLabels, tt.wantTagLabels) {
+				t.Errorf("newTaggedMetricDataQuery(): got TagLabels: %v --> want: %v", got.TagLabels, tt.wantTagLabels)
+			}
+			if got.IsDiscovery() {
+				t.Errorf("newTaggedMetricDataQuery(): the discovered metric query must not be a template")
+			}
+		})
+	}
+}
+
+func TestTagLabelName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "team", want: "tag_team"},
+		{key: "Environment", want: "tag_environment"},
+		{key: "aws:cloudformation:stack-name", want: "tag_aws_cloudformation_stack_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := TagLabelName(tt.key); got != tt.want {
+				t.Errorf("TagLabelName(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagsLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want map[string]string
+	}{
+		{
+			name: "Different",
+			tags: map[string]string{"team": "payments", "Environment": "prod"},
+			want: map[string]string{"tag_team": "payments", "tag_environment": "prod"},
+		},
+		{
+			// Env is sorted before env, so its value is always used
+			name: "CaseCollision",
+			tags: map[string]string{"env": "dev", "Env": "prod"},
+			want: map[string]string{"tag_env": "prod"},
+		},
+		{
+			name: "InvalidCharsCollision",
+			tags: map[string]string{"stack_name": "b", "stack-name": "a"},
+			want: map[string]string{"tag_stack_name": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the result doesn't depend on the order of the map
+			for i := 0; i < 10; i++ {
+				if got := TagsLabels(tt.tags); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("TagsLabels(): got: %v --> want: %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_newResource(t *testing.T) {
+	rtm := &resourcegroupstaggingapi.ResourceTagMapping{
+		ResourceARN: aws.String("arn:aws:rds:eu-west-1:123456789012:db:payments-db"),
+		Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("team"), Value: aws.String("payments")}},
+	}
+	want := Resource{
+		ARN:            "arn:aws:rds:eu-west-1:123456789012:db:payments-db",
+		DimensionName:  "DBInstanceIdentifier",
+		DimensionValue: "payments-db",
+		Tags:           map[string]string{"team": "payments"},
+	}
+
+	if got := newResource(resourceMappings["AWS/RDS"], rtm); !reflect.DeepEqual(got, want) {
+		t.Errorf("newResource(): got: %v --> want: %v", got, want)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// The labels allowed into CollisionLabels
+var collisionLabels = []string{PeriodLabel, UnitLabel}
+
+// Collision is a group of metrics queries of the same module which can't be registered together,
+// the prometheus registry fails at scrape time when two metrics have the same name and labels or
+// the metrics with the same name have different labels names or help
+type Collision struct {
+	Module string
+	Name   string
+	IDs    []string
+	Reason string
+}
+
+func (c Collision) String() string {
+	module := c.Module
+	if len(module) == 0 {
+		module = "default"
+	}
+	return fmt.Sprintf("the metrics queries Ids %s of the %s module collide into the prometheus metric %s, %s",
+		strings.Join(c.IDs, ", "), module, c.Name, c.Reason)
+}
+
+// Collisions return the collisions between the prometheus metrics of the metrics queries of conf
+// sorted by module and metric name. The metrics queries which only differ by its period or unit
+// could be told apart using the CollisionLabels period and unit. The metrics queries without Region
+// are scraped into the region r, and with Targets all of them are scraped once by every target
+// with its account_id label, the same as the collector does
+func Collisions(conf *config.All, r string) []Collision {
+	var cs []Collision
+
+	modules := config.ByModule(conf.MetricDataQueries)
+	var names []string
+	for m := range modules {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+
+	for _, module := range names {
+		cs = append(cs, moduleCollisions(module, targetsMetricsDesc(conf, modules[module], r))...)
+	}
+
+	return cs
+}
+
+// this return the descriptions of the prometheus metrics of the metrics queries qs scraped by every target
+// of conf, or only by the session of the region r without targets, see collector.newConfTargets
+func targetsMetricsDesc(conf *config.All, qs []config.MetricDataQuery, r string) []metricDesc {
+	if len(conf.Targets) == 0 {
+		return regionsMetricsDesc(conf, qs, r, nil)
+	}
+
+	var mds []metricDesc
+	for _, t := range conf.Targets {
+		tr := r
+		if len(t.Region) > 0 {
+			tr = t.Region
+		}
+		cl := make(prometheus.Labels)
+		if accountID := awshelper.AccountID(t.RoleArn); len(accountID) > 0 {
+			cl[AccountIDLabel] = accountID
+		}
+		mds = append(mds, regionsMetricsDesc(conf, qs, tr, cl)...)
+	}
+	return mds
+}
+
+// this return the descriptions of the prometheus metrics of the metrics queries qs with the constant labels cl,
+// the metrics queries without Region have the region r
+func regionsMetricsDesc(conf *config.All, qs []config.MetricDataQuery, r string, cl prometheus.Labels) []metricDesc {
+	var mds []metricDesc
+
+	groups, regions := config.ByRegion(qs, r)
+	for _, region := range regions {
+		c := *conf
+		c.MetricDataQueriesConf = config.MetricDataQueriesConf{MetricDataQueries: groups[region]}
+		mds = append(mds, newMetricsDesc(&c, cl)...)
+	}
+	return mds
+}
+
+// this return the collisions between the metrics descriptions mds of the same module
+func moduleCollisions(module string, mds []metricDesc) []Collision {
+	var cs []Collision
+
+	// the descriptions grouped by name and by name and labels, in the order of the metrics queries
+	var names []string
+	byName := make(map[string][]metricDesc)
+	var series []string
+	bySeries := make(map[string][]string)
+	for _, md := range mds {
+		if _, ok := byName[md.name]; !ok {
+			names = append(names, md.name)
+		}
+		byName[md.name] = append(byName[md.name], md)
+
+		k := seriesKey(md)
+		if _, ok := bySeries[k]; !ok {
+			series = append(series, k)
+		}
+		bySeries[k] = append(bySeries[k], md.id)
+	}
+	sort.Strings(names)
+	sort.Strings(series)
+
+	// the metrics queries with the same name and labels have the same help too most of the time,
+	// so they are reported only once
+	reported := make(map[string]bool)
+	for _, k := range series {
+		if ids := bySeries[k]; len(ids) > 1 {
+			reported[strings.Join(ids, ",")] = true
+			cs = append(cs, Collision{
+				Module: module,
+				Name:   k,
+				IDs:    ids,
+				Reason: "they have the same name and labels",
+			})
+		}
+	}
+
+	// the metrics with the same name must have the same labels names, i.e.: the static labels or the
+	// AccountId of only some metrics queries
+	for _, n := range names {
+		group := byName[n]
+		var ids []string
+		for _, md := range group {
+			if labelsNames(md) != labelsNames(group[0]) && !contains(ids, md.id) {
+				ids = append(ids, md.id)
+			}
+		}
+		ids = append([]string{group[0].id}, ids...)
+		if len(ids) > 1 && !reported[strings.Join(ids, ",")] {
+			reported[strings.Join(ids, ",")] = true
+			cs = append(cs, Collision{
+				Module: module,
+				Name:   n,
+				IDs:    ids,
+				Reason: "they have different labels names",
+			})
+		}
+	}
+
+	for _, n := range names {
+		group := byName[n]
+		var ids []string
+		for _, md := range group {
+			if md.help != group[0].help && !contains(ids, md.id) {
+				ids = append(ids, md.id)
+			}
+		}
+		ids = append([]string{group[0].id}, ids...)
+		if len(ids) > 1 && !reported[strings.Join(ids, ",")] {
+			cs = append(cs, Collision{
+				Module: module,
+				Name:   n,
+				IDs:    ids,
+				Reason: "they have different help because of its dimensions, period or unit",
+			})
+		}
+	}
+
+	return cs
+}
+
+// this return the metric name with its sorted labels, i.e.: aws_ec2_cpu_utilization_average{InstanceId="i-1",region="eu-west-1"}
+func seriesKey(md metricDesc) string {
+	var ls []string
+	for k, v := range md.constLabels {
+		ls = append(ls, fmt.Sprintf("%s=%q", k, v))
+	}
+	ls = append(ls, md.variableLabelNames...)
+	sort.Strings(ls)
+	return md.name + "{" + strings.Join(ls, ",") + "}"
+}
+
+// this return the sorted names of the labels of the metric, i.e.: InstanceId,dimension_value,region
+func labelsNames(md metricDesc) string {
+	var ls []string
+	for k := range md.constLabels {
+		ls = append(ls, k)
+	}
+	ls = append(ls, md.variableLabelNames...)
+	sort.Strings(ls)
+	return strings.Join(ls, ",")
+}
+
+// ValidateCollisionLabels return an error when the labels ls are not allowed as CollisionLabels
+func ValidateCollisionLabels(ls []string) error {
+	for _, l := range ls {
+		if !contains(collisionLabels, l) {
+			return fmt.Errorf("invalid collision label %s, allowed labels: %s", l, strings.Join(collisionLabels, ", "))
+		}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func prepareCollisionMetrics() *config.MetricDataQueriesConf {
+	MetricDataQueriesYaml := `
+MetricDataQueries:
+  - Id: m1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Period: 300
+      Stat: Average
+  - Id: m2
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Period: 60
+      Stat: Average
+  - Id: m3
+    Module: ec2
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Period: 300
+      Stat: Average
+`
+	c := config.MetricDataQueriesConf{}
+	err := yaml.Unmarshal([]byte(MetricDataQueriesYaml), &c)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return &c
+}
+
+func TestCollisions(t *testing.T) {
+	tests := []struct {
+		name            string
+		collisionLabels []string
+		want            []Collision
+	}{
+		{
+			name: "SameLabels",
+			want: []Collision{
+				{
+					Name:   `aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890"}`,
+					IDs:    []string{"m1", "m2"},
+					Reason: "they have the same name and labels",
+				},
+			},
+		},
+		{
+			name:            "PeriodLabel",
+			collisionLabels: []string{PeriodLabel},
+			want:            nil,
+		},
+		{
+			// the unit is not different, so the period stay into the help
+			name:            "UnitLabel",
+			collisionLabels: []string{UnitLabel},
+			want: []Collision{
+				{
+					Name:   `aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890"}`,
+					IDs:    []string{"m1", "m2"},
+					Reason: "they have the same name and labels",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.All{MetricDataQueriesConf: *prepareCollisionMetrics()}
+			c.Application.CollisionLabels = tt.collisionLabels
+
+			if got := Collisions(c, ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Collisions(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollisionsLabelsNames(t *testing.T) {
+	MetricDataQueriesYaml := `
+MetricDataQueries:
+  - Id: m1
+    AccountId: "111111111111"
+    Region: eu-west-1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1
+      Period: 300
+      Stat: Average
+  - Id: m2
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-2
+      Period: 300
+      Stat: Average
+`
+	tests := []struct {
+		name    string
+		region  string
+		targets []config.Target
+		want    []Collision
+	}{
+		{
+			// the metrics queries are sorted by region and m2 doesn't have one
+			name: "WithoutDefaultRegionAndTargets",
+			want: []Collision{
+				{
+					Name:   "aws_ec_2_cpu_utilization_average",
+					IDs:    []string{"m2", "m1"},
+					Reason: "they have different labels names",
+				},
+			},
+		},
+		{
+			// the account_id is still missing into m2
+			name:   "WithDefaultRegion",
+			region: "eu-west-1",
+			want: []Collision{
+				{
+					Name:   "aws_ec_2_cpu_utilization_average",
+					IDs:    []string{"m1", "m2"},
+					Reason: "they have different labels names",
+				},
+			},
+		},
+		{
+			name:    "WithTargets",
+			region:  "eu-west-1",
+			targets: []config.Target{{RoleArn: "arn:aws:iam::222222222222:role/exporter"}},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.All{}
+			if err := yaml.Unmarshal([]byte(MetricDataQueriesYaml), &c.MetricDataQueriesConf); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			c.Targets = tt.targets
+
+			if got := Collisions(c, tt.region); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Collisions(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_moduleCollisionsLabelsNames(t *testing.T) {
+	mds := []metricDesc{
+		{id: "m1", name: "aws_ec_2_cpu_utilization_average", constLabels: map[string]string{"InstanceId": "i-1"}},
+		{id: "m2", name: "aws_ec_2_cpu_utilization_average", constLabels: map[string]string{"InstanceId": "i-2", "team": "a"}},
+		{id: "m3", name: "aws_ec_2_cpu_utilization_average", constLabels: map[string]string{"InstanceId": "i-3"}},
+	}
+	want := []Collision{
+		{
+			Name:   "aws_ec_2_cpu_utilization_average",
+			IDs:    []string{"m1", "m2"},
+			Reason: "they have different labels names",
+		},
+	}
+
+	if got := moduleCollisions("", mds); !reflect.DeepEqual(got, want) {
+		t.Errorf("moduleCollisions(): got: %v --> want: %v", got, want)
+	}
+}
+
+func Test_moduleCollisionsHelp(t *testing.T) {
+	mds := []metricDesc{
+		{id: "m1", name: "aws_ec_2_cpu_utilization_average", help: "Period: 300s", constLabels: map[string]string{"InstanceId": "i-1"}},
+		{id: "m2", name: "aws_ec_2_cpu_utilization_average", help: "Period: 60s", constLabels: map[string]string{"InstanceId": "i-2"}},
+	}
+	want := []Collision{
+		{
+			Module: "ec2",
+			Name:   "aws_ec_2_cpu_utilization_average",
+			IDs:    []string{"m1", "m2"},
+			Reason: "they have different help because of its dimensions, period or unit",
+		},
+	}
+
+	if got := moduleCollisions("ec2", mds); !reflect.DeepEqual(got, want) {
+		t.Errorf("moduleCollisions(): got: %v --> want: %v", got, want)
+	}
+}
+
+func TestValidateCollisionLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  []string
+		wantErr bool
+	}{
+		{name: "Empty", labels: nil, wantErr: false},
+		{name: "Allowed", labels: []string{"period", "unit"}, wantErr: false},
+		{name: "NotAllowed", labels: []string{"period", "stat"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCollisionLabels(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCollisionLabels(): got: %v --> want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
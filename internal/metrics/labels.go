@@ -0,0 +1,147 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/camelcase"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// The modes used to create the prometheus labels names from the AWS CloudWatch dimensions names
+const (
+	// AutoScalingGroupName --> auto_scaling_group_name
+	DimensionLabelsSnake = "snake"
+	// AutoScalingGroupName --> AutoScalingGroupName
+	DimensionLabelsOriginal = "original"
+)
+
+// The prefix of the dimensions labels which collide with the reserved labels, i.e.: instance --> exported_instance
+const ExportedLabelPrefix = "exported_"
+
+// The labels added by prometheus to the scraped metrics and by the exporter to the metrics of the
+// metrics queries, the dimensions can't use them
+var reservedLabels = []string{"job", "instance", RegionLabel, AccountIDLabel, DimensionValueLabel, ExpressionLabel, PeriodLabel, UnitLabel, StatisticLabel}
+
+var (
+	// Prometheus valid characters for labels names
+	invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+	// The characters used as words separators by the snake mode, i.e.: aws:cloudformation:stack-name
+	wordSeparatorChars = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+	// https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+	MetricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	LabelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ValidateDimensionLabels return an error when the mode of the dimensions labels is not allowed
+func ValidateDimensionLabels(mode string) error {
+	switch mode {
+	case "", DimensionLabelsSnake, DimensionLabelsOriginal:
+		return nil
+	}
+	return fmt.Errorf("invalid dimension labels mode %s, allowed modes: %s, %s", mode, DimensionLabelsSnake, DimensionLabelsOriginal)
+}
+
+// ValidateStatsMode return an error when the mode of the statistics of the metrics queries with Stats is not allowed
+func ValidateStatsMode(mode string) error {
+	switch mode {
+	case "", StatsModeSuffix, StatsModeLabel:
+		return nil
+	}
+	return fmt.Errorf("invalid stats mode %s, allowed modes: %s, %s", mode, StatsModeSuffix, StatsModeLabel)
+}
+
+// DimensionLabelName return the prometheus label name of the AWS CloudWatch dimension name using the
+// dimensions labels mode and names of the application configuration, the names map has precedence over
+// the mode and its keys are case insensitive because the configuration keys are lowercased.
+// The name returned is always a valid prometheus label name and it doesn't collide with the reserved labels
+func DimensionLabelName(name string, app config.Application) string {
+	var l string
+	if v, ok := lookupLabelName(app.DimensionLabelsMap, name); ok {
+		l = v
+	} else if app.DimensionLabels == DimensionLabelsOriginal {
+		l = name
+	} else {
+		l = camelcase.ToSnake(wordSeparatorChars.ReplaceAllString(name, " "))
+	}
+
+	l = invalidLabelChars.ReplaceAllString(l, "_")
+	switch {
+	case len(l) == 0:
+		l = "_"
+	case l[0] >= '0' && l[0] <= '9':
+		l = "_" + l
+	}
+
+	// the labels starting with __ are reserved for internal use of prometheus
+	if strings.HasPrefix(l, "__") || contains(reservedLabels, strings.ToLower(l)) {
+		l = ExportedLabelPrefix + strings.TrimLeft(l, "_")
+	}
+
+	return l
+}
+
+// this return the value of the key k of the map m without care of the case
+func lookupLabelName(m map[string]string, k string) (string, bool) {
+	if v, ok := m[k]; ok {
+		return v, true
+	}
+	for mk, v := range m {
+		if strings.EqualFold(mk, k) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// this return the new name of the label l when it is renamed, the keys of renames are case insensitive
+func renameLabel(renames map[string]string, l string) string {
+	if v, ok := lookupLabelName(renames, l); ok {
+		return v
+	}
+	return l
+}
+
+// this return an error when the name or the labels names of the metric description md are not valid prometheus names
+func validateNames(md metricDesc) error {
+	if !MetricNameRegexp.MatchString(md.name) {
+		return fmt.Errorf("invalid prometheus metric name %s, it must match %s", md.name, MetricNameRegexp.String())
+	}
+	for l := range md.constLabels {
+		if err := ValidateLabelName(l); err != nil {
+			return err
+		}
+	}
+	for _, l := range md.variableLabelNames {
+		if err := ValidateLabelName(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateLabelName return an error when l is not a valid prometheus label name or it is reserved for internal use
+func ValidateLabelName(l string) error {
+	if !LabelNameRegexp.MatchString(l) || strings.HasPrefix(l, "__") {
+		return fmt.Errorf("invalid prometheus label name %s, it must match %s and it can't start with __", l, LabelNameRegexp.String())
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"testing"
+
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+func TestDimensionLabelName(t *testing.T) {
+	tests := []struct {
+		name string
+		dim  string
+		app  config.Application
+		want string
+	}{
+		{name: "Snake", dim: "AutoScalingGroupName", want: "auto_scaling_group_name"},
+		{name: "SnakeMode", dim: "InstanceId", app: config.Application{DimensionLabels: DimensionLabelsSnake}, want: "instance_id"},
+		{name: "Original", dim: "AutoScalingGroupName", app: config.Application{DimensionLabels: DimensionLabelsOriginal}, want: "AutoScalingGroupName"},
+		{name: "OriginalInvalidChars", dim: "aws.service-name:v1", app: config.Application{DimensionLabels: DimensionLabelsOriginal}, want: "aws_service_name_v1"},
+		{name: "SnakeInvalidChars", dim: "aws:cloudformation:stack-name", want: "aws_cloudformation_stack_name"},
+		{name: "SnakeUnderscore", dim: "Queue_Name", want: "queue_name"},
+		{name: "StartWithDigit", dim: "1Zone", app: config.Application{DimensionLabels: DimensionLabelsOriginal}, want: "_1Zone"},
+		{name: "Custom", dim: "AutoScalingGroupName", app: config.Application{DimensionLabelsMap: map[string]string{"autoscalinggroupname": "asg"}}, want: "asg"},
+		{name: "CustomInvalidChars", dim: "AutoScalingGroupName", app: config.Application{DimensionLabelsMap: map[string]string{"AutoScalingGroupName": "asg-name"}}, want: "asg_name"},
+		{name: "ReservedInstance", dim: "Instance", want: "exported_instance"},
+		{name: "ReservedJob", dim: "job", app: config.Application{DimensionLabels: DimensionLabelsOriginal}, want: "exported_job"},
+		{name: "ReservedRegion", dim: "Region", want: "exported_region"},
+		{name: "ReservedCustom", dim: "Service", app: config.Application{DimensionLabelsMap: map[string]string{"Service": "job"}}, want: "exported_job"},
+		{name: "ReservedPrefix", dim: "__name__", app: config.Application{DimensionLabels: DimensionLabelsOriginal}, want: "exported_name__"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DimensionLabelName(tt.dim, tt.app); got != tt.want {
+				t.Errorf("DimensionLabelName(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDimensionLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		wantErr bool
+	}{
+		{name: "Empty", mode: "", wantErr: false},
+		{name: "Snake", mode: "snake", wantErr: false},
+		{name: "Original", mode: "original", wantErr: false},
+		{name: "NotAllowed", mode: "camel", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateDimensionLabels(tt.mode); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDimensionLabels(): got: %v --> want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -17,6 +17,8 @@ package metrics
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -27,15 +29,66 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/camelcase"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/discovery"
 )
 
+// The maximum number of metrics queries allowed by AWS CloudWatch into one GetMetricData call
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
+const MaxMetricsQueries = 500
+
+// The variable label of the metric math expressions metrics with the label of the AWS CloudWatch result
+const ExpressionLabel = "label"
+
+// The label with the AWS Region of the metric query, so the same metric of different regions doesn't collide
+const RegionLabel = "region"
+
+// The label with the AWS account id of the target scraped
+const AccountIDLabel = "account_id"
+
+// The label with the value of the dimension which identify the resource of the metric, i.e.: the InstanceId for AWS/EC2
+const DimensionValueLabel = "dimension_value"
+
+// The label with the statistic of the metrics queries with Stats when StatsMode is label
+const StatisticLabel = "statistic"
+
+// The modes used to tell apart the statistics of the metrics queries with Stats
+const (
+	// aws_ec_2_cpu_utilization_p99
+	StatsModeSuffix = "suffix"
+	// aws_ec_2_cpu_utilization{statistic="p99"}
+	StatsModeLabel = "label"
+)
+
+// The labels added to tell apart the metrics queries which only differ by its period or unit, see CollisionLabels
+const (
+	PeriodLabel = "period"
+	UnitLabel   = "unit"
+)
+
+// Used to find the metrics queries ids referenced into a metric math expression
+var expressionIDRegexp = regexp.MustCompile(`[a-zA-Z_][a-zA-Z0-9_]*`)
+
 type Metrics interface {
 	// Used to assemble the AWS GetMetricDataInput data structure
 	GetMetricDataInput(time.Time, time.Time, time.Duration, string) *cloudwatch.GetMetricDataInput
 
+	// Used to assemble the AWS GetMetricDataInput data structures split in batches of
+	// MaxMetricsQueries, every one of them is a legal GetMetricData call
+	GetMetricDataInputs(time.Time, time.Time, time.Duration) []*cloudwatch.GetMetricDataInput
+
 	//
 	GetMetricDesc(id string) *prometheus.Desc
 	GetMetricsDesc() map[string]*prometheus.Desc
+
+	// Used to know if the prometheus metric of the metric query id is a gauge or a counter
+	GetMetricValueType(id string) prometheus.ValueType
+
+	// Used to convert the value v of the metric query id to the unit and scale of its prometheus metric
+	ScaleMetricValue(id string, v float64) float64
+
+	// Used to create the prometheus metric of the metric query id, the values of the
+	// variable labels of its description are taken from the labels values lv
+	NewConstMetric(id string, vt prometheus.ValueType, v float64, lv prometheus.Labels) (prometheus.Metric, error)
 }
 
 type metrics struct {
@@ -44,12 +97,27 @@ type metrics struct {
 
 	// The prometheus metrics created from MetricDataQueriesConf but without values
 	PrometheusMetricsDesc map[string]*prometheus.Desc
+
+	// The variable labels names of the prometheus metrics, their values came with the scrape
+	PrometheusMetricsVariableLabels map[string][]string
+
+	// The type and the scale of the values of the prometheus metrics
+	PrometheusMetricsValueOptions map[string]valueOptions
 }
 
 func New(conf *config.All) Metrics {
+	return NewWithLabels(conf, nil)
+}
+
+// NewWithLabels create the metrics of the metrics queries of conf and all their
+// prometheus metrics have the constant labels cl, i.e.: the account_id of the target
+func NewWithLabels(conf *config.All, cl prometheus.Labels) Metrics {
+	descs, variableLabels := createPrometheusMetricsDesc(conf, cl)
 	return &metrics{
-		MetricDataQueriesConf: &conf.MetricDataQueriesConf,
-		PrometheusMetricsDesc: createPrometheusMetricsDesc(conf),
+		MetricDataQueriesConf:           &conf.MetricDataQueriesConf,
+		PrometheusMetricsDesc:           descs,
+		PrometheusMetricsVariableLabels: variableLabels,
+		PrometheusMetricsValueOptions:   createValueOptions(conf),
 	}
 }
 
@@ -73,6 +141,151 @@ func (m *metrics) GetMetricDataInput(st time.Time, et time.Time, p time.Duration
 	return mdi
 }
 
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
+func (m *metrics) GetMetricDataInputs(st time.Time, et time.Time, p time.Duration) []*cloudwatch.GetMetricDataInput {
+	var mdis []*cloudwatch.GetMetricDataInput
+
+	for _, batch := range batchMetricDataQueries(m.getMetricDataQuery(p), MaxMetricsQueries) {
+		mdis = append(mdis, &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(st),
+			EndTime:           aws.Time(et),
+			MetricDataQueries: batch,
+			ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending), // Get the fresh data first
+		})
+	}
+
+	return mdis
+}
+
+// This function split the metrics queries in batches of at most size queries.
+// A metric math expression must be in the same GetMetricData call of the queries it references,
+// so the queries are grouped with the expressions referencing them before being split and
+// a group is never split across batches. The order of the queries is preserved.
+// The groups of more than size queries can't be sent, they are rejected by ValidateGroups.
+func batchMetricDataQueries(qs []*cloudwatch.MetricDataQuery, size int) [][]*cloudwatch.MetricDataQuery {
+	var batches [][]*cloudwatch.MetricDataQuery
+	var batch []*cloudwatch.MetricDataQuery
+	for _, g := range groupMetricDataQueries(qs) {
+		if len(g) > size {
+			log.Errorf("The metric query id: %s and the queries related to it are %v, more than %v queries can't be sent into the same GetMetricData call", aws.StringValue(g[0].Id), len(g), size)
+			continue
+		}
+
+		if len(batch) > 0 && len(batch)+len(g) > size {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		batch = append(batch, g...)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// This function group every metric math expression with the queries referenced into it, directly or
+// through other expressions, the groups are sorted by its first query and the order of the queries is preserved
+func groupMetricDataQueries(qs []*cloudwatch.MetricDataQuery) [][]*cloudwatch.MetricDataQuery {
+	// every query starts in its own group, the group is identified by the index of its root query
+	parent := make([]int, len(qs))
+	index := make(map[string]int)
+	for i, q := range qs {
+		parent[i] = i
+		index[aws.StringValue(q.Id)] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// join every expression with the queries referenced into it
+	for i, q := range qs {
+		if len(aws.StringValue(q.Expression)) == 0 {
+			continue
+		}
+		for _, id := range expressionIDRegexp.FindAllString(*q.Expression, -1) {
+			if j, ok := index[id]; ok {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	// collect the groups in the order of its first query
+	var roots []int
+	groups := make(map[int][]*cloudwatch.MetricDataQuery)
+	for i, q := range qs {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], q)
+	}
+
+	var gs [][]*cloudwatch.MetricDataQuery
+	for _, r := range roots {
+		gs = append(gs, groups[r])
+	}
+	return gs
+}
+
+// this return the Id of the first metric math expression of the group g
+func groupExpressionID(g []*cloudwatch.MetricDataQuery) string {
+	for _, q := range g {
+		if len(aws.StringValue(q.Expression)) > 0 {
+			return aws.StringValue(q.Id)
+		}
+	}
+	return aws.StringValue(g[0].Id)
+}
+
+// ValidateGroups return an error with the groups of the metrics queries of conf which can't be sent into one
+// GetMetricData call, a metric math expression and the queries referenced into it can't be more than
+// MaxMetricsQueries. The metrics queries without Region are scraped into the region r, and with Targets
+// into the region of every target, the same as the collector does
+func ValidateGroups(conf *config.All, r string) error {
+	regions := []string{r}
+	if len(conf.Targets) > 0 {
+		regions = nil
+		for _, t := range conf.Targets {
+			tr := r
+			if len(t.Region) > 0 {
+				tr = t.Region
+			}
+			regions = append(regions, tr)
+		}
+	}
+
+	var msgs []string
+	seen := make(map[string]bool)
+	for _, tr := range regions {
+		groups, rs := config.ByRegion(conf.MetricDataQueries, tr)
+		for _, region := range rs {
+			m := &metrics{MetricDataQueriesConf: &config.MetricDataQueriesConf{MetricDataQueries: groups[region]}}
+			for _, g := range groupMetricDataQueries(m.getMetricDataQuery(0)) {
+				if len(g) <= MaxMetricsQueries {
+					continue
+				}
+				msg := fmt.Sprintf("the metric math expression Id %s of the region %s and the queries related to it are %v, more than %v",
+					groupExpressionID(g), region, len(g), MaxMetricsQueries)
+				if !seen[msg] {
+					seen[msg] = true
+					msgs = append(msgs, msg)
+				}
+			}
+		}
+	}
+
+	if len(msgs) > 0 {
+		return fmt.Errorf("the metrics queries have %v metric math expressions which can't be sent into one GetMetricData call:\n%s", len(msgs), strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
 // This function is used to transform the structure config.MetricDataQueriesConf which contains
 // the values read from config file metrics.yaml to a cloudwatch.MetricDataQuery structure which is
 // the default structure used to get cloudwatch metrics data
@@ -83,11 +296,39 @@ func (m *metrics) getMetricDataQuery(p time.Duration) []*cloudwatch.MetricDataQu
 
 	var dataQry []*cloudwatch.MetricDataQuery
 
-	for _, m := range m.MetricDataQueriesConf.MetricDataQueries {
+	// the metrics queries with Stats are sent as one metric query for every statistic
+	for _, m := range config.ExpandStats(m.MetricDataQueriesConf.MetricDataQueries) {
+
+		// The templates of the discovered metrics queries can't be sent to AWS CloudWatch
+		if m.IsDiscovery() {
+			continue
+		}
+
+		// Metric math expression doesn't have MetricStat
+		// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/using-metric-math.html
+		if len(m.Expression) > 0 {
+			expressionQry := &cloudwatch.MetricDataQuery{
+				Id:         aws.String(m.ID),
+				Expression: aws.String(m.Expression),
+				ReturnData: aws.Bool(m.IsReturnData()),
+			}
+
+			// Conditional field will be filled after
+			if len(m.Label) > 0 {
+				expressionQry.Label = aws.String(m.Label)
+			}
+			if len(m.AccountID) > 0 {
+				expressionQry.AccountId = aws.String(m.AccountID)
+			}
+
+			dataQry = append(dataQry, expressionQry)
+			continue
+		}
 
 		// If the metric has set the Period, override global MetricStatPeriod
+		metricPeriod := period
 		if m.MetricStat.Period != 0 {
-			period = m.MetricStat.Period
+			metricPeriod = m.MetricStat.Period
 		}
 
 		// Fill the internal struct with dimension
@@ -109,16 +350,22 @@ func (m *metrics) getMetricDataQuery(p time.Duration) []*cloudwatch.MetricDataQu
 					MetricName: aws.String(m.MetricStat.Metric.MetricName),
 					Namespace:  aws.String(m.MetricStat.Metric.Namespace),
 				},
-				Period: aws.Int64(period),
+				Period: aws.Int64(metricPeriod),
 				Stat:   aws.String(m.MetricStat.Stat),
 			},
-			ReturnData: aws.Bool(true), // Return the timestamps and raw data values of this metric.
+			ReturnData: aws.Bool(m.IsReturnData()), // Return the timestamps and raw data values of this metric.
 		}
 
 		// Conditional field will be filled after
 		if len(m.MetricStat.Unit) > 0 {
 			metricsQry.MetricStat.Unit = aws.String(m.MetricStat.Unit)
 		}
+		if len(m.Label) > 0 {
+			metricsQry.Label = aws.String(m.Label)
+		}
+		if len(m.AccountID) > 0 {
+			metricsQry.AccountId = aws.String(m.AccountID)
+		}
 
 		dataQry = append(dataQry, metricsQry)
 	}
@@ -137,6 +384,36 @@ func (m *metrics) GetMetricsDesc() map[string]*prometheus.Desc {
 	return m.PrometheusMetricsDesc
 }
 
+func (m *metrics) GetMetricValueType(id string) prometheus.ValueType {
+	vo, ok := m.PrometheusMetricsValueOptions[id]
+	if !ok {
+		return prometheus.GaugeValue
+	}
+	return vo.valueType
+}
+
+func (m *metrics) ScaleMetricValue(id string, v float64) float64 {
+	vo, ok := m.PrometheusMetricsValueOptions[id]
+	if !ok {
+		return v
+	}
+	return v * vo.scale
+}
+
+func (m *metrics) NewConstMetric(id string, vt prometheus.ValueType, v float64, lv prometheus.Labels) (prometheus.Metric, error) {
+	d, ok := m.PrometheusMetricsDesc[id]
+	if !ok {
+		return nil, fmt.Errorf("metric description id: %s does not exist", id)
+	}
+
+	var values []string
+	for _, l := range m.PrometheusMetricsVariableLabels[id] {
+		values = append(values, lv[l])
+	}
+
+	return prometheus.NewConstMetric(d, vt, v, values...)
+}
+
 // https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_concepts.html
 // Create the prometheus metrics scaffolding without any value
 //   - Id: m1
@@ -148,52 +425,245 @@ func (m *metrics) GetMetricsDesc() map[string]*prometheus.Desc {
 //   - Name: AutoScalingGroupName            aws_cloudwatch_exporter_aws_ec2_cpu_utilization_average{job="aws_cloudwatch_exporter", instance="", auto_scaling_group_name="eks-prod-01-apps-01-asg"} value_from_scrap
 //     Value: eks-prod-01-apps-01-asg
 //     Stat: Average
-func createPrometheusMetricsDesc(conf *config.All) map[string]*prometheus.Desc {
-	mdqc := conf.MetricDataQueriesConf
+//
+// Metric math expressions are named as its Label or as expression_[Id] when it doesn't have Label
+// and they have the variable label "label" with the label of the result, because some expressions like
+// ANOMALY_DETECTION_BAND return more than one time series.
+// Metrics queries with ReturnData: false are only used as inputs of the expressions, so they are not created.
+// Metrics queries with dimensions to be discovered are templates, so they are not created either.
+func createPrometheusMetricsDesc(conf *config.All, cl prometheus.Labels) (map[string]*prometheus.Desc, map[string][]string) {
 	promMetricsDesc := make(map[string]*prometheus.Desc)
+	promMetricsVariableLabels := make(map[string][]string)
+
+	for _, md := range newMetricsDesc(conf, cl) {
+		promMetricsVariableLabels[md.id] = md.variableLabels
+		promMetricsDesc[md.id] = prometheus.NewDesc(md.name, md.help, md.variableLabelNames, md.constLabels)
+	}
+
+	return promMetricsDesc, promMetricsVariableLabels
+}
+
+// the parts of the prometheus description of a metric query, they are needed to compare the descriptions
+// because prometheus.Desc doesn't expose them
+type metricDesc struct {
+	id   string
+	name string
+	help string
+	// the names used to look up the values of the variable labels and the names of the prometheus metric
+	variableLabels     []string
+	variableLabelNames []string
+	constLabels        prometheus.Labels
+}
+
+// this create the descriptions of the prometheus metrics of the metrics queries of conf in the same
+// order of the metrics queries, see createPrometheusMetricsDesc
+func newMetricsDesc(conf *config.All, cl prometheus.Labels) []metricDesc {
+	mdqc := conf.MetricDataQueriesConf
+	var mds []metricDesc
 
 	var helpTmpl = "%s represent the AWS CloudWatch Metric: %s --> %s, Dimensions: [%s], Statistic: %s%s%s"
+	var expressionHelpTmpl = "%s represent the AWS CloudWatch Metric Math Expression: %s"
 
-	// for every metric query defined into the yaml files
-	for _, mdq := range mdqc.MetricDataQueries {
+	periodLabel := contains(conf.Application.CollisionLabels, PeriodLabel)
+	unitLabel := contains(conf.Application.CollisionLabels, UnitLabel)
+
+	statisticLabel := conf.Application.StatsMode == StatsModeLabel
+
+	// for every metric query defined into the yaml files, with its statistics expanded
+	for _, mdq := range config.ExpandStats(mdqc.MetricDataQueries) {
+
+		// hidden metrics queries don't return values and the templates
+		// of the discovered metrics queries are not scraped
+		if !mdq.IsReturnData() || mdq.IsDiscovery() {
+			continue
+		}
+
+		if len(mdq.Expression) > 0 {
+			mn := "expression_" + camelcase.ToSnake(mdq.ID)
+			if len(mdq.Label) > 0 {
+				mn = camelcase.ToSnake(mdq.Label)
+			}
+			mn = metricNameSuffixes(mn, mdq)
+			if len(mdq.PrometheusName) > 0 {
+				mn = mdq.PrometheusName
+			}
+			hs := fmt.Sprintf(expressionHelpTmpl, mn, mdq.Expression)
+
+			md := metricDesc{id: mdq.ID, name: mn, help: hs, variableLabels: []string{ExpressionLabel}, constLabels: constLabels(mdq, cl)}
+			if md, ok := customizeDesc(mdq, md); ok {
+				mds = append(mds, md)
+			}
+			continue
+		}
 
 		// Add dimensions as prometheus metric labels
-		mcl := make(prometheus.Labels)
+		mcl := constLabels(mdq, cl)
 		for _, v := range mdq.MetricStat.Metric.Dimensions {
-			mcl[v.Name] = v.Value
+			mcl[DimensionLabelName(v.Name, conf.Application)] = v.Value
 		}
 
 		// necessary to put dimensions keys in the help query string
 		var dimKeys []string
-		for k := range mcl {
-			dimKeys = append(dimKeys, k)
+		for _, v := range mdq.MetricStat.Metric.Dimensions {
+			dimKeys = append(dimKeys, v.Name)
 		}
+		// the help string must be the same for all the metrics with the same name
+		sort.Strings(dimKeys)
 		dimArray := strings.Join(dimKeys, ",")
 
 		var mu, mp string
-		// Unit and Period are conditional and we want to added it to the help query string
-		if len(mdq.MetricStat.Unit) > 0 {
+		// Unit and Period are conditional and we want to added it to the help query string,
+		// when they are labels the help must not change with them
+		if unitLabel {
+			if len(mdq.MetricStat.Unit) > 0 {
+				mcl[UnitLabel] = mdq.MetricStat.Unit
+			}
+		} else if len(mdq.MetricStat.Unit) > 0 {
 			mu = ", Unit: " + mdq.MetricStat.Unit
 		}
-		if mdq.MetricStat.Period > 0 {
+		if periodLabel {
+			if p := metricPeriod(mdq, conf.Application.MetricStatPeriod); p > 0 {
+				mcl[PeriodLabel] = strconv.FormatInt(p, 10)
+			}
+		} else if mdq.MetricStat.Period > 0 {
 			mp = ", Period: " + strconv.FormatInt(mdq.MetricStat.Period, 10) + "s"
 		}
 
+		// Add the value of the dimension which identify the resource, used to join with the resource info metric
+		if v, ok := resourceDimensionValue(mdq); ok {
+			mcl[DimensionValueLabel] = v
+		}
+
+		// Add the tags of the discovered resource as prometheus metric labels
+		for k, v := range mdq.TagLabels {
+			mcl[k] = v
+		}
+
 		mn := camelcase.ToSnake(mdq.MetricStat.Metric.Namespace) + "_" + camelcase.ToSnake(mdq.MetricStat.Metric.MetricName) + "_" + camelcase.ToSnake(mdq.MetricStat.Stat)
+		stat := mdq.MetricStat.Stat
+
+		// the statistics of the metrics queries with Stats are a suffix of the name or a label of the same metric,
+		// in this case the help must be the same for all of them
+		if mdq.IsStats() {
+			mn = camelcase.ToSnake(mdq.MetricStat.Metric.Namespace) + "_" + camelcase.ToSnake(mdq.MetricStat.Metric.MetricName)
+			if statisticLabel {
+				mcl[StatisticLabel] = mdq.MetricStat.Stat
+				stat = "[" + strings.Join(mdq.MetricStat.Stats, ",") + "]"
+			} else {
+				mn += "_" + config.StatSuffix(mdq.MetricStat.Stat)
+			}
+		}
+		mn = metricNameSuffixes(mn, mdq)
+		if len(mdq.PrometheusName) > 0 {
+			mn = mdq.PrometheusName
+		}
 		hs := fmt.Sprintf(
 			helpTmpl,
 			mn,
 			mdq.MetricStat.Metric.Namespace,
 			mdq.MetricStat.Metric.MetricName,
 			dimArray,
-			mdq.MetricStat.Stat,
+			stat,
 			mu,
 			mp)
 
-		promMetricsDesc[mdq.ID] = prometheus.NewDesc(mn, hs, nil, mcl)
+		md := metricDesc{id: mdq.ID, name: mn, help: hs, constLabels: mcl}
+		if md, ok := customizeDesc(mdq, md); ok {
+			mds = append(mds, md)
+		}
+	}
+
+	return mds
+}
+
+// this apply the Help, LabelRenames and Labels of the metric query mdq to its description md, it return false
+// when the names of the metric or its labels are not valid prometheus names, so the metric query is not created
+func customizeDesc(mdq config.MetricDataQuery, md metricDesc) (metricDesc, bool) {
+	if len(mdq.Help) > 0 {
+		md.help = mdq.Help
+	}
+
+	// the values of the variable labels are looked up by its original names
+	md.variableLabelNames = md.variableLabels
+	if len(mdq.LabelRenames) > 0 {
+		mcl := make(prometheus.Labels)
+		for k, v := range md.constLabels {
+			mcl[renameLabel(mdq.LabelRenames, k)] = v
+		}
+		md.constLabels = mcl
+
+		md.variableLabelNames = nil
+		for _, l := range md.variableLabels {
+			md.variableLabelNames = append(md.variableLabelNames, renameLabel(mdq.LabelRenames, l))
+		}
+	}
+
+	// the static labels override the others
+	if len(mdq.Labels) > 0 {
+		mcl := make(prometheus.Labels)
+		for k, v := range md.constLabels {
+			mcl[k] = v
+		}
+		for k, v := range mdq.Labels {
+			mcl[k] = v
+		}
+		md.constLabels = mcl
+	}
+
+	if err := validateNames(md); err != nil {
+		log.Errorf("The metric query id: %s is not created, %v", mdq.ID, err)
+		return md, false
+	}
+
+	return md, true
+}
+
+// this return the period in seconds of the metric query, its own Period or the default period p
+func metricPeriod(mdq config.MetricDataQuery, p string) int64 {
+	if mdq.MetricStat.Period > 0 {
+		return mdq.MetricStat.Period
+	}
+	d, err := time.ParseDuration(p)
+	if err != nil {
+		return 0
+	}
+	return int64(d / time.Second)
+}
+
+// this return the constant labels cl plus the labels region and account_id when the metric query
+// has Region and AccountId, the AccountId of the metric query override the account_id of cl
+func constLabels(mdq config.MetricDataQuery, cl prometheus.Labels) prometheus.Labels {
+	l := make(prometheus.Labels)
+	for k, v := range cl {
+		l[k] = v
+	}
+	if len(mdq.Region) > 0 {
+		l[RegionLabel] = mdq.Region
+	}
+	if len(mdq.AccountID) > 0 {
+		l[AccountIDLabel] = mdq.AccountID
+	}
+	return l
+}
+
+// this return the value of the dimension which identify the resource of the metric query,
+// this is the dimension used for its namespace by the tag discovery or the first one when
+// the namespace is not supported by the tag discovery or the metric doesn't have it
+func resourceDimensionValue(mdq config.MetricDataQuery) (string, bool) {
+	dims := mdq.MetricStat.Metric.Dimensions
+	if len(dims) == 0 {
+		return "", false
+	}
+
+	if name, ok := discovery.ResourceDimensionName(mdq.MetricStat.Metric.Namespace); ok {
+		for _, d := range dims {
+			if d.Name == name {
+				return d.Value, true
+			}
+		}
 	}
 
-	return promMetricsDesc
+	return dims[0].Value, true
 }
 
 // Return the necessary inputs for function NewGetMetricDataInput
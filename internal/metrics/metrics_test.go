@@ -16,12 +16,15 @@ limitations under the License.
 package metrics
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
 	"gopkg.in/yaml.v3"
@@ -48,6 +51,43 @@ MetricDataQueries:
 	return &c
 }
 
+func prepareExpressionMetrics() *config.MetricDataQueriesConf {
+	MetricDataQueriesYaml := `
+MetricDataQueries:
+  - Id: m1
+    ReturnData: false
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: AutoScalingGroupName
+            Value: my-asg
+      Stat: Average
+  - Id: e1
+    Expression: m1/100
+    Label: CPU Ratio
+`
+	c := config.MetricDataQueriesConf{}
+	err := yaml.Unmarshal([]byte(MetricDataQueriesYaml), &c)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return &c
+}
+
+func prepareAWSExpressionMetrics() *cloudwatch.GetMetricDataInput {
+	mdi := prepareAWSMetrics()
+	mdi.MetricDataQueries[0].ReturnData = aws.Bool(false)
+	mdi.MetricDataQueries = append(mdi.MetricDataQueries, &cloudwatch.MetricDataQuery{
+		Id:         aws.String("e1"),
+		Expression: aws.String("m1/100"),
+		Label:      aws.String("CPU Ratio"),
+		ReturnData: aws.Bool(true),
+	})
+	return mdi
+}
+
 func prepareAWSMetrics() *cloudwatch.GetMetricDataInput {
 
 	return &cloudwatch.GetMetricDataInput{
@@ -105,6 +145,19 @@ func Test_metrics_GetMetricDataInput(t *testing.T) {
 			},
 			want: prepareAWSMetrics(),
 		},
+		{
+			name: "ExpressionCase",
+			fields: fields{
+				MetricDataQueriesConf: prepareExpressionMetrics(),
+			},
+			args: args{
+				st: parseDate("2020-05-10T11:00:00Z", time.RFC3339),
+				et: parseDate("2020-05-10T11:10:00Z", time.RFC3339),
+				p:  parseDuration("5m"),
+				nt: "",
+			},
+			want: prepareAWSExpressionMetrics(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -118,6 +171,433 @@ func Test_metrics_GetMetricDataInput(t *testing.T) {
 	}
 }
 
+func Test_createPrometheusMetricsDesc(t *testing.T) {
+	tests := []struct {
+		name      string
+		queries   *config.MetricDataQueriesConf
+		wantNames map[string]string
+	}{
+		{
+			name:      "MetricStat",
+			queries:   prepareMetrics(),
+			wantNames: map[string]string{"m1": "aws_ec_2_cpu_utilization_average"},
+		},
+		{
+			name:      "ExpressionAndHiddenMetricStat",
+			queries:   prepareExpressionMetrics(),
+			wantNames: map[string]string{"e1": "cpu_ratio"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			descs, _ := createPrometheusMetricsDesc(&config.All{MetricDataQueriesConf: *tt.queries}, nil)
+
+			if len(descs) != len(tt.wantNames) {
+				t.Errorf("createPrometheusMetricsDesc(): got: %v descriptions --> want: %v", len(descs), len(tt.wantNames))
+			}
+			for id, name := range tt.wantNames {
+				d, ok := descs[id]
+				if !ok {
+					t.Errorf("createPrometheusMetricsDesc(): description for id: %s not found", id)
+					continue
+				}
+				if !strings.Contains(d.String(), `fqName: "`+name+`"`) {
+					t.Errorf("createPrometheusMetricsDesc(): got: %v --> want name: %v", d.String(), name)
+				}
+			}
+		})
+	}
+}
+
+func prepareStatsMetrics() *config.MetricDataQueriesConf {
+	MetricDataQueriesYaml := `
+MetricDataQueries:
+  - Id: m1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Stats: [Average, p99.9]
+`
+	c := config.MetricDataQueriesConf{}
+	err := yaml.Unmarshal([]byte(MetricDataQueriesYaml), &c)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	return &c
+}
+
+func Test_metrics_getMetricDataQueryStats(t *testing.T) {
+	m := New(&config.All{MetricDataQueriesConf: *prepareStatsMetrics()}).(*metrics)
+
+	var got []string
+	for _, q := range m.getMetricDataQuery(5 * time.Minute) {
+		got = append(got, aws.StringValue(q.Id)+":"+aws.StringValue(q.MetricStat.Stat))
+	}
+	want := []string{"m1_average:Average", "m1_p99_9:p99.9"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getMetricDataQuery(): got: %v --> want: %v", got, want)
+	}
+}
+
+func Test_createPrometheusMetricsDescStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		statsMode string
+		want      map[string]string
+	}{
+		{
+			name:      "Suffix",
+			statsMode: StatsModeSuffix,
+			want: map[string]string{
+				"m1_average": `fqName: "aws_ec_2_cpu_utilization_average"`,
+				"m1_p99_9":   `fqName: "aws_ec_2_cpu_utilization_p99_9"`,
+			},
+		},
+		{
+			name:      "Label",
+			statsMode: StatsModeLabel,
+			want: map[string]string{
+				"m1_average": `fqName: "aws_ec_2_cpu_utilization", help: "aws_ec_2_cpu_utilization represent the AWS CloudWatch Metric: AWS/EC2 --> CPUUtilization, Dimensions: [InstanceId], Statistic: [Average,p99.9]", constLabels: {dimension_value="i-1234567890",instance_id="i-1234567890",statistic="Average"}`,
+				"m1_p99_9":   `fqName: "aws_ec_2_cpu_utilization", help: "aws_ec_2_cpu_utilization represent the AWS CloudWatch Metric: AWS/EC2 --> CPUUtilization, Dimensions: [InstanceId], Statistic: [Average,p99.9]", constLabels: {dimension_value="i-1234567890",instance_id="i-1234567890",statistic="p99.9"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.All{MetricDataQueriesConf: *prepareStatsMetrics()}
+			c.Application.StatsMode = tt.statsMode
+			descs, _ := createPrometheusMetricsDesc(c, nil)
+
+			if len(descs) != len(tt.want) {
+				t.Errorf("createPrometheusMetricsDesc(): got: %v descriptions --> want: %v", len(descs), len(tt.want))
+			}
+			for id, want := range tt.want {
+				d, ok := descs[id]
+				if !ok {
+					t.Errorf("createPrometheusMetricsDesc(): description for id: %s not found", id)
+					continue
+				}
+				if !strings.Contains(d.String(), want) {
+					t.Errorf("createPrometheusMetricsDesc(): got: %v --> want: %v", d.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_customizeDesc(t *testing.T) {
+	md := metricDesc{
+		id:             "e1",
+		name:           "cpu_ratio",
+		help:           "cpu_ratio represent the AWS CloudWatch Metric Math Expression: m1/100",
+		variableLabels: []string{ExpressionLabel},
+		constLabels:    prometheus.Labels{RegionLabel: "eu-west-1", "instance_id": "i-1"},
+	}
+	tests := []struct {
+		name   string
+		mdq    config.MetricDataQuery
+		want   metricDesc
+		wantOk bool
+	}{
+		{
+			name: "WithoutChanges",
+			mdq:  config.MetricDataQuery{ID: "e1"},
+			want: metricDesc{
+				id:                 "e1",
+				name:               "cpu_ratio",
+				help:               md.help,
+				variableLabels:     []string{ExpressionLabel},
+				variableLabelNames: []string{ExpressionLabel},
+				constLabels:        prometheus.Labels{RegionLabel: "eu-west-1", "instance_id": "i-1"},
+			},
+			wantOk: true,
+		},
+		{
+			name: "HelpLabelsAndRenames",
+			mdq: config.MetricDataQuery{
+				ID:           "e1",
+				Help:         "The CPU ratio",
+				Labels:       map[string]string{"team": "payments", RegionLabel: "eu"},
+				LabelRenames: map[string]string{"instance_id": "instance_name", ExpressionLabel: "series"},
+			},
+			want: metricDesc{
+				id:                 "e1",
+				name:               "cpu_ratio",
+				help:               "The CPU ratio",
+				variableLabels:     []string{ExpressionLabel},
+				variableLabelNames: []string{"series"},
+				constLabels:        prometheus.Labels{RegionLabel: "eu", "instance_name": "i-1", "team": "payments"},
+			},
+			wantOk: true,
+		},
+		{
+			name:   "InvalidLabel",
+			mdq:    config.MetricDataQuery{ID: "e1", Labels: map[string]string{"team-name": "payments"}},
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := customizeDesc(tt.mdq, md)
+			if ok != tt.wantOk {
+				t.Fatalf("customizeDesc(): got: %v --> want: %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("customizeDesc(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_customizeDescCollisions(t *testing.T) {
+	mdq := func(id, instance string) config.MetricDataQuery {
+		return config.MetricDataQuery{
+			ID: id,
+			MetricStat: config.MetricStat{
+				Metric: config.Metric{
+					Namespace:  "AWS/EC2",
+					MetricName: "CPUUtilization",
+					Dimensions: []config.Dimension{{Name: "InstanceId", Value: instance}},
+				},
+				Period: 300,
+				Stat:   "Average",
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(q *config.MetricDataQuery)
+	}{
+		{
+			name:   "Labels",
+			change: func(q *config.MetricDataQuery) { q.Labels = map[string]string{"team": "payments"} },
+		},
+		{
+			name:   "LabelRenames",
+			change: func(q *config.MetricDataQuery) { q.LabelRenames = map[string]string{"instance_id": "instance_name"} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m1, m2 := mdq("m1", "i-1"), mdq("m2", "i-2")
+			tt.change(&m2)
+			c := &config.All{MetricDataQueriesConf: config.MetricDataQueriesConf{MetricDataQueries: []config.MetricDataQuery{m1, m2}}}
+
+			want := []Collision{
+				{
+					Name:   "aws_ec_2_cpu_utilization_average",
+					IDs:    []string{"m1", "m2"},
+					Reason: "they have different labels names",
+				},
+			}
+			if got := Collisions(c, "eu-west-1"); !reflect.DeepEqual(got, want) {
+				t.Errorf("Collisions(): got: %v --> want: %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_resourceDimensionValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		dims      []config.Dimension
+		want      string
+		wantOk    bool
+	}{
+		{
+			name:      "ResourceDimension",
+			namespace: "AWS/RDS",
+			dims:      []config.Dimension{{Name: "Role", Value: "WRITER"}, {Name: "DBInstanceIdentifier", Value: "payments-db"}},
+			want:      "payments-db",
+			wantOk:    true,
+		},
+		{
+			name:      "FirstDimension",
+			namespace: "Custom/App",
+			dims:      []config.Dimension{{Name: "Service", Value: "api"}, {Name: "Env", Value: "prod"}},
+			want:      "api",
+			wantOk:    true,
+		},
+		{
+			name:      "WithoutDimensions",
+			namespace: "AWS/RDS",
+			wantOk:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := config.MetricDataQuery{}
+			q.MetricStat.Metric.Namespace = tt.namespace
+			q.MetricStat.Metric.Dimensions = tt.dims
+
+			got, ok := resourceDimensionValue(q)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("resourceDimensionValue(): got: %v, %v --> want: %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_constLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		region    string
+		accountID string
+		cl        prometheus.Labels
+		want      prometheus.Labels
+	}{
+		{name: "WithRegion", region: "eu-west-1", want: prometheus.Labels{RegionLabel: "eu-west-1"}},
+		{name: "WithoutRegion", region: "", want: prometheus.Labels{}},
+		{
+			name:   "WithAccountID",
+			region: "eu-west-1",
+			cl:     prometheus.Labels{AccountIDLabel: "123456789012"},
+			want:   prometheus.Labels{RegionLabel: "eu-west-1", AccountIDLabel: "123456789012"},
+		},
+		{
+			name:      "WithQueryAccountID",
+			region:    "eu-west-1",
+			accountID: "210987654321",
+			cl:        prometheus.Labels{AccountIDLabel: "123456789012"},
+			want:      prometheus.Labels{RegionLabel: "eu-west-1", AccountIDLabel: "210987654321"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := constLabels(config.MetricDataQuery{Region: tt.region, AccountID: tt.accountID}, tt.cl); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("constLabels(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_batchMetricDataQueries(t *testing.T) {
+	// build n metrics queries with ids from m1 to mn
+	queries := func(n int) []*cloudwatch.MetricDataQuery {
+		var qs []*cloudwatch.MetricDataQuery
+		for i := 1; i <= n; i++ {
+			qs = append(qs, &cloudwatch.MetricDataQuery{Id: aws.String(fmt.Sprintf("m%v", i))})
+		}
+		return qs
+	}
+
+	tests := []struct {
+		name      string
+		queries   []*cloudwatch.MetricDataQuery
+		size      int
+		wantSizes []int
+	}{
+		{
+			name:      "Empty",
+			queries:   nil,
+			size:      500,
+			wantSizes: nil,
+		},
+		{
+			name:      "LessThanSize",
+			queries:   queries(3),
+			size:      500,
+			wantSizes: []int{3},
+		},
+		{
+			name:      "MoreThanSize",
+			queries:   queries(1201),
+			size:      500,
+			wantSizes: []int{500, 500, 201},
+		},
+		{
+			name: "ExpressionKeptWithReferencedQueries",
+			queries: append(queries(3), &cloudwatch.MetricDataQuery{
+				Id:         aws.String("e1"),
+				Expression: aws.String("m1/m3*100"),
+			}),
+			size:      3,
+			wantSizes: []int{3, 1},
+		},
+		{
+			name: "OversizedGroupNotSent",
+			queries: append(queries(3), &cloudwatch.MetricDataQuery{
+				Id:         aws.String("e1"),
+				Expression: aws.String("m1/m3*100"),
+			}),
+			size:      2,
+			wantSizes: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batchMetricDataQueries(tt.queries, tt.size)
+
+			var gotSizes []int
+			for _, b := range got {
+				gotSizes = append(gotSizes, len(b))
+			}
+			if !reflect.DeepEqual(gotSizes, tt.wantSizes) {
+				t.Errorf("batchMetricDataQueries(): got sizes: %v --> want: %v", gotSizes, tt.wantSizes)
+			}
+		})
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	// build n metrics queries with ids from m1 to mn, the half of them into the region r,
+	// and the expression e1 which references all of them
+	queries := func(n int, r string) []config.MetricDataQuery {
+		var qs []config.MetricDataQuery
+		var ids []string
+		for i := 1; i <= n; i++ {
+			q := config.MetricDataQuery{ID: fmt.Sprintf("m%v", i)}
+			q.MetricStat.Metric.Namespace = "AWS/EC2"
+			q.MetricStat.Metric.MetricName = "CPUUtilization"
+			q.MetricStat.Stat = "Average"
+			if i%2 == 0 {
+				q.Region = r
+			}
+			qs = append(qs, q)
+			ids = append(ids, q.ID)
+		}
+		return append(qs, config.MetricDataQuery{ID: "e1", Expression: strings.Join(ids, "+")})
+	}
+
+	tests := []struct {
+		name    string
+		queries []config.MetricDataQuery
+		wantErr bool
+	}{
+		{
+			name:    "Legal",
+			queries: queries(MaxMetricsQueries-1, ""),
+			wantErr: false,
+		},
+		{
+			name:    "Oversized",
+			queries: queries(MaxMetricsQueries, ""),
+			wantErr: true,
+		},
+		{
+			// the queries of other region are not sent into the same GetMetricData call
+			name:    "SplitByRegion",
+			queries: queries(MaxMetricsQueries, "us-east-1"),
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.All{MetricDataQueriesConf: config.MetricDataQueriesConf{MetricDataQueries: tt.queries}}
+
+			if err := ValidateGroups(c, "eu-west-1"); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateGroups(): got: %v --> want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_GetTimeStamps(t *testing.T) {
 	type args struct {
 		now time.Time
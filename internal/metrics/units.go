@@ -0,0 +1,93 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// The suffix of the names of the counters
+const CounterSuffix = "_total"
+
+// UnitConversion convert the values of an AWS CloudWatch unit to the prometheus base unit
+// https://prometheus.io/docs/practices/naming/#base-units
+type UnitConversion struct {
+	// The factor applied to the values
+	Factor float64
+	// The suffix of the names of the metrics with the base unit
+	Suffix string
+}
+
+// The AWS CloudWatch units which could be converted to the prometheus base units
+var UnitConversions = map[string]UnitConversion{
+	cloudwatch.StandardUnitSeconds:      {Factor: 1, Suffix: "_seconds"},
+	cloudwatch.StandardUnitMilliseconds: {Factor: 1e-3, Suffix: "_seconds"},
+	cloudwatch.StandardUnitMicroseconds: {Factor: 1e-6, Suffix: "_seconds"},
+	cloudwatch.StandardUnitBytes:        {Factor: 1, Suffix: "_bytes"},
+	cloudwatch.StandardUnitBits:         {Factor: 1.0 / 8, Suffix: "_bytes"},
+	cloudwatch.StandardUnitPercent:      {Factor: 1e-2, Suffix: "_ratio"},
+}
+
+// UnitConversionNames return the sorted names of the units which could be converted
+func UnitConversionNames() []string {
+	var ns []string
+	for n := range UnitConversions {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// the type and the factor of the values of the prometheus metric of a metric query
+type valueOptions struct {
+	valueType prometheus.ValueType
+	scale     float64
+}
+
+// this create the value options of the metrics queries of conf by its Id
+func createValueOptions(conf *config.All) map[string]valueOptions {
+	vos := make(map[string]valueOptions)
+	for _, mdq := range config.ExpandStats(conf.MetricDataQueries) {
+		vo := valueOptions{valueType: prometheus.GaugeValue, scale: 1}
+		if mdq.IsCounter() {
+			vo.valueType = prometheus.CounterValue
+		}
+		if uc, ok := UnitConversions[mdq.UnitConversion]; ok {
+			vo.scale = uc.Factor
+		}
+		if mdq.Scale != 0 {
+			vo.scale *= mdq.Scale
+		}
+		vos[mdq.ID] = vo
+	}
+	return vos
+}
+
+// this return the name mn with the suffixes of the base unit and the counters, i.e.: aws_elb_latency_average_seconds
+func metricNameSuffixes(mn string, mdq config.MetricDataQuery) string {
+	if uc, ok := UnitConversions[mdq.UnitConversion]; ok && !strings.HasSuffix(mn, uc.Suffix) {
+		mn += uc.Suffix
+	}
+	if mdq.IsCounter() && !strings.HasSuffix(mn, CounterSuffix) {
+		mn += CounterSuffix
+	}
+	return mn
+}
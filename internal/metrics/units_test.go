@@ -0,0 +1,82 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+func Test_metricNameSuffixes(t *testing.T) {
+	tests := []struct {
+		name string
+		mn   string
+		mdq  config.MetricDataQuery
+		want string
+	}{
+		{name: "Gauge", mn: "aws_ec_2_cpu_utilization_average", mdq: config.MetricDataQuery{}, want: "aws_ec_2_cpu_utilization_average"},
+		{name: "Counter", mn: "aws_elb_request_count_sum", mdq: config.MetricDataQuery{Type: config.MetricTypeCounter}, want: "aws_elb_request_count_sum_total"},
+		{name: "Seconds", mn: "aws_elb_latency_average", mdq: config.MetricDataQuery{UnitConversion: "Milliseconds"}, want: "aws_elb_latency_average_seconds"},
+		{name: "Ratio", mn: "aws_ec_2_cpu_utilization_average", mdq: config.MetricDataQuery{UnitConversion: "Percent"}, want: "aws_ec_2_cpu_utilization_average_ratio"},
+		{name: "BytesCounter", mn: "aws_s_3_bytes_downloaded_sum", mdq: config.MetricDataQuery{Type: config.MetricTypeCounter, UnitConversion: "Bytes"}, want: "aws_s_3_bytes_downloaded_sum_bytes_total"},
+		{name: "SuffixAlreadyDefined", mn: "requests_total", mdq: config.MetricDataQuery{Type: config.MetricTypeCounter}, want: "requests_total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricNameSuffixes(tt.mn, tt.mdq); got != tt.want {
+				t.Errorf("metricNameSuffixes(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_metrics_ScaleMetricValue(t *testing.T) {
+	c := &config.All{}
+	c.MetricDataQueries = []config.MetricDataQuery{
+		{ID: "m1"},
+		{ID: "m2", UnitConversion: "Milliseconds"},
+		{ID: "m3", UnitConversion: "Percent", Type: config.MetricTypeCounter},
+		{ID: "m4", Scale: 60},
+		{ID: "m5", UnitConversion: "Bits", Scale: 2},
+	}
+	m := New(c)
+
+	tests := []struct {
+		id       string
+		v        float64
+		want     float64
+		wantType prometheus.ValueType
+	}{
+		{id: "m1", v: 250, want: 250, wantType: prometheus.GaugeValue},
+		{id: "m2", v: 250, want: 0.25, wantType: prometheus.GaugeValue},
+		{id: "m3", v: 50, want: 0.5, wantType: prometheus.CounterValue},
+		{id: "m4", v: 2, want: 120, wantType: prometheus.GaugeValue},
+		{id: "m5", v: 16, want: 4, wantType: prometheus.GaugeValue},
+		{id: "unknown", v: 3, want: 3, wantType: prometheus.GaugeValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := m.ScaleMetricValue(tt.id, tt.v); got != tt.want {
+				t.Errorf("ScaleMetricValue(): got: %v --> want: %v", got, tt.want)
+			}
+			if got := m.GetMetricValueType(tt.id); got != tt.wantType {
+				t.Errorf("GetMetricValueType(): got: %v --> want: %v", got, tt.wantType)
+			}
+		})
+	}
+}
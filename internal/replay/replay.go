@@ -0,0 +1,416 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// The error code of the requests without fixture
+const ErrCodeFixtureNotFound = "FixtureNotFound"
+
+// The prefixes of the fixtures files of every action and its extension
+const (
+	filePrefix             = "getmetricdata-"
+	listMetricsFilePrefix  = "listmetrics-"
+	getResourcesFilePrefix = "getresources-"
+	fileExt                = ".json"
+)
+
+// Fixture is a GetMetricData request of a region and its response
+type Fixture struct {
+	Region string
+	Input  *cloudwatch.GetMetricDataInput
+	Output *cloudwatch.GetMetricDataOutput
+}
+
+// ListMetricsFixture is a ListMetrics request of a region and all the pages of its response,
+// used to discover the dimensions of the metrics queries
+type ListMetricsFixture struct {
+	Region string
+	Input  *cloudwatch.ListMetricsInput
+	Pages  []*cloudwatch.ListMetricsOutput
+}
+
+// GetResourcesFixture is a GetResources request of a region and all the pages of its response,
+// used to discover the resources of the metrics queries by its tags
+type GetResourcesFixture struct {
+	Region string
+	Input  *resourcegroupstaggingapi.GetResourcesInput
+	Pages  []*resourcegroupstaggingapi.GetResourcesOutput
+}
+
+// Recorder is an AWS CloudWatch client which save every GetMetricData and ListMetrics request and its
+// response of the client into a JSON file of the directory
+type Recorder struct {
+	cloudwatchiface.CloudWatchAPI
+	dir    string
+	region string
+}
+
+// NewRecorder return the client which record the GetMetricData and ListMetrics requests of svc, the client of the region, into dir
+func NewRecorder(svc cloudwatchiface.CloudWatchAPI, dir string, region string) *Recorder {
+	return &Recorder{CloudWatchAPI: svc, dir: dir, region: region}
+}
+
+// GetMetricData call GetMetricData of the recorded client and save the request and its response,
+// the failed requests are not saved
+func (r *Recorder) GetMetricData(in *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+	return r.GetMetricDataWithContext(aws.BackgroundContext(), in)
+}
+
+// GetMetricDataWithContext is the same of GetMetricData with the context ctx and the request options opts
+func (r *Recorder) GetMetricDataWithContext(ctx aws.Context, in *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	out, err := r.CloudWatchAPI.GetMetricDataWithContext(ctx, in, opts...)
+	if err != nil {
+		return out, err
+	}
+
+	if err := Save(r.dir, Fixture{Region: r.region, Input: in, Output: out}); err != nil {
+		log.Errorf("Error recording the GetMetricData response: %v", err)
+	}
+	return out, nil
+}
+
+// ListMetricsPages call ListMetricsPages of the recorded client and save the request and all its pages,
+// the failed requests are not saved
+func (r *Recorder) ListMetricsPages(in *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	f := ListMetricsFixture{Region: r.region, Input: in}
+	err := r.CloudWatchAPI.ListMetricsPages(in, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		f.Pages = append(f.Pages, page)
+		return fn(page, lastPage)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := SaveListMetrics(r.dir, f); err != nil {
+		log.Errorf("Error recording the ListMetrics response: %v", err)
+	}
+	return nil
+}
+
+// TaggingRecorder is an AWS Resource Groups Tagging client which save every GetResources request and
+// its response of the client into a JSON file of the directory
+type TaggingRecorder struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	dir    string
+	region string
+}
+
+// NewTaggingRecorder return the client which record the GetResources requests of svc, the client of the region, into dir
+func NewTaggingRecorder(svc resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI, dir string, region string) *TaggingRecorder {
+	return &TaggingRecorder{ResourceGroupsTaggingAPIAPI: svc, dir: dir, region: region}
+}
+
+// GetResourcesPages call GetResourcesPages of the recorded client and save the request and all its pages,
+// the failed requests are not saved
+func (r *TaggingRecorder) GetResourcesPages(in *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool) error {
+	f := GetResourcesFixture{Region: r.region, Input: in}
+	err := r.ResourceGroupsTaggingAPIAPI.GetResourcesPages(in, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		f.Pages = append(f.Pages, page)
+		return fn(page, lastPage)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := SaveGetResources(r.dir, f); err != nil {
+		log.Errorf("Error recording the GetResources response: %v", err)
+	}
+	return nil
+}
+
+// Save write the fixture f into a JSON file of the directory dir, the file is named after its request
+// so recording the same request again replace it
+func Save(dir string, f Fixture) error {
+	return save(dir, filePrefix, f.Region, key(f.Region, f.Input), f)
+}
+
+// SaveListMetrics is the same of Save with the ListMetrics fixture f
+func SaveListMetrics(dir string, f ListMetricsFixture) error {
+	return save(dir, listMetricsFilePrefix, f.Region, listMetricsKey(f.Region, f.Input), f)
+}
+
+// SaveGetResources is the same of Save with the GetResources fixture f
+func SaveGetResources(dir string, f GetResourcesFixture) error {
+	return save(dir, getResourcesFilePrefix, f.Region, getResourcesKey(f.Region, f.Input), f)
+}
+
+// this write the fixture f of the request with the key k into the file of the directory dir with the prefix
+// of its action and the region
+func save(dir string, prefix string, region string, k string, f interface{}) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	bs, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	file := filepath.Join(dir, fmt.Sprintf("%s%s-%08x%s", prefix, region, h.Sum32(), fileExt))
+
+	log.Debugf("Recording the response into file: %s", file)
+	return ioutil.WriteFile(file, bs, 0644)
+}
+
+// Fixtures are the GetMetricData, ListMetrics and GetResources responses recorded by its request
+type Fixtures struct {
+	outputs      map[string]*cloudwatch.GetMetricDataOutput
+	listMetrics  map[string][]*cloudwatch.ListMetricsOutput
+	getResources map[string][]*resourcegroupstaggingapi.GetResourcesOutput
+}
+
+// Load read the fixtures of the JSON files of the directory dir
+func Load(dir string) (*Fixtures, error) {
+	fs := &Fixtures{
+		outputs:      make(map[string]*cloudwatch.GetMetricDataOutput),
+		listMetrics:  make(map[string][]*cloudwatch.ListMetricsOutput),
+		getResources: make(map[string][]*resourcegroupstaggingapi.GetResourcesOutput),
+	}
+
+	n, err := load(dir, filePrefix, func(file string, bs []byte) error {
+		var f Fixture
+		if err := json.Unmarshal(bs, &f); err != nil {
+			return fmt.Errorf("error reading the fixture file %s: %v", file, err)
+		}
+		if f.Input == nil || f.Output == nil {
+			return fmt.Errorf("the fixture file %s must have Input and Output", file)
+		}
+		fs.Add(f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := load(dir, listMetricsFilePrefix, func(file string, bs []byte) error {
+		var f ListMetricsFixture
+		if err := json.Unmarshal(bs, &f); err != nil {
+			return fmt.Errorf("error reading the fixture file %s: %v", file, err)
+		}
+		if f.Input == nil || len(f.Pages) == 0 {
+			return fmt.Errorf("the fixture file %s must have Input and Pages", file)
+		}
+		fs.AddListMetrics(f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gn, err := load(dir, getResourcesFilePrefix, func(file string, bs []byte) error {
+		var f GetResourcesFixture
+		if err := json.Unmarshal(bs, &f); err != nil {
+			return fmt.Errorf("error reading the fixture file %s: %v", file, err)
+		}
+		if f.Input == nil || len(f.Pages) == 0 {
+			return fmt.Errorf("the fixture file %s must have Input and Pages", file)
+		}
+		fs.AddGetResources(f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if n+ln+gn == 0 {
+		return nil, fmt.Errorf("there are no fixtures in the directory %s", dir)
+	}
+
+	log.Infof("Loaded %v GetMetricData, %v ListMetrics and %v GetResources fixtures from directory: %s", len(fs.outputs), len(fs.listMetrics), len(fs.getResources), dir)
+	return fs, nil
+}
+
+// this read the files of the directory dir with the prefix of an action with the function fn
+// and return the number of files read
+func load(dir string, prefix string, fn func(file string, bs []byte) error) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"*"+fileExt))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return 0, err
+		}
+		if err := fn(file, bs); err != nil {
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
+
+// Add add the fixture f, it replaces the fixture with the same request
+func (fs *Fixtures) Add(f Fixture) {
+	fs.outputs[key(f.Region, f.Input)] = f.Output
+}
+
+// AddListMetrics add the ListMetrics fixture f, it replaces the fixture with the same request
+func (fs *Fixtures) AddListMetrics(f ListMetricsFixture) {
+	fs.listMetrics[listMetricsKey(f.Region, f.Input)] = f.Pages
+}
+
+// AddGetResources add the GetResources fixture f, it replaces the fixture with the same request
+func (fs *Fixtures) AddGetResources(f GetResourcesFixture) {
+	fs.getResources[getResourcesKey(f.Region, f.Input)] = f.Pages
+}
+
+// Client return the AWS CloudWatch client of the region r which respond the GetMetricData and ListMetrics
+// requests with the fixtures
+func (fs *Fixtures) Client(r string) cloudwatchiface.CloudWatchAPI {
+	return &replayer{fixtures: fs, region: r}
+}
+
+// Tagging return the AWS Resource Groups Tagging client of the region r which respond the GetResources
+// requests with the fixtures
+func (fs *Fixtures) Tagging(r string) resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI {
+	return &tagging{fixtures: fs, region: r}
+}
+
+// replayer is the AWS CloudWatch client which respond with the fixtures, the other actions are not implemented
+type replayer struct {
+	cloudwatchiface.CloudWatchAPI
+	fixtures *Fixtures
+	region   string
+}
+
+func (r *replayer) GetMetricData(in *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+	return r.GetMetricDataWithContext(aws.BackgroundContext(), in)
+}
+
+func (r *replayer) GetMetricDataWithContext(_ aws.Context, in *cloudwatch.GetMetricDataInput, _ ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	out, ok := r.fixtures.outputs[key(r.region, in)]
+	if !ok {
+		return nil, awserr.New(ErrCodeFixtureNotFound, fmt.Sprintf("the GetMetricData request of the region %s with %v metrics queries is not recorded", r.region, len(in.MetricDataQueries)), nil)
+	}
+
+	// the caller could modify the output, i.e.: appending the values of the next pages to the results
+	return copyOutput(out), nil
+}
+
+// this return a deep copy of the output out, with its own results, values and timestamps
+func copyOutput(out *cloudwatch.GetMetricDataOutput) *cloudwatch.GetMetricDataOutput {
+	cp := *out
+	cp.MetricDataResults = make([]*cloudwatch.MetricDataResult, 0, len(out.MetricDataResults))
+	for _, mdr := range out.MetricDataResults {
+		r := *mdr
+		r.Values = make([]*float64, 0, len(mdr.Values))
+		for _, v := range mdr.Values {
+			r.Values = append(r.Values, aws.Float64(aws.Float64Value(v)))
+		}
+		r.Timestamps = make([]*time.Time, 0, len(mdr.Timestamps))
+		for _, ts := range mdr.Timestamps {
+			r.Timestamps = append(r.Timestamps, aws.Time(aws.TimeValue(ts)))
+		}
+		r.Messages = append([]*cloudwatch.MessageData(nil), mdr.Messages...)
+		cp.MetricDataResults = append(cp.MetricDataResults, &r)
+	}
+	cp.Messages = append([]*cloudwatch.MessageData(nil), out.Messages...)
+	return &cp
+}
+
+func (r *replayer) ListMetricsPages(in *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	pages, ok := r.fixtures.listMetrics[listMetricsKey(r.region, in)]
+	if !ok {
+		return awserr.New(ErrCodeFixtureNotFound, fmt.Sprintf("the ListMetrics request of the region %s of the metric %s is not recorded", r.region, aws.StringValue(in.MetricName)), nil)
+	}
+
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// tagging is the AWS Resource Groups Tagging client which respond with the fixtures, the other actions are not implemented
+type tagging struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	fixtures *Fixtures
+	region   string
+}
+
+func (t *tagging) GetResourcesPages(in *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool) error {
+	pages, ok := t.fixtures.getResources[getResourcesKey(t.region, in)]
+	if !ok {
+		return awserr.New(ErrCodeFixtureNotFound, fmt.Sprintf("the GetResources request of the region %s is not recorded", t.region), nil)
+	}
+
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// this return the key of the request in of the region, the StartTime and EndTime are ignored so the requests
+// recorded can be replayed at any time, the collector computes them from the current time at every scrape,
+// so the requests replayed never have the time window of the requests recorded
+func key(region string, in *cloudwatch.GetMetricDataInput) string {
+	k := *in
+	k.StartTime, k.EndTime = nil, nil
+	if k.NextToken != nil && len(*k.NextToken) == 0 {
+		k.NextToken = nil
+	}
+	return marshalKey(region, k)
+}
+
+// this return the key of the ListMetrics request in of the region, all its pages are recorded together
+func listMetricsKey(region string, in *cloudwatch.ListMetricsInput) string {
+	k := *in
+	k.NextToken = nil
+	return marshalKey(region, k)
+}
+
+// this return the key of the GetResources request in of the region, all its pages are recorded together
+func getResourcesKey(region string, in *resourcegroupstaggingapi.GetResourcesInput) string {
+	k := *in
+	k.PaginationToken = nil
+	return marshalKey(region, k)
+}
+
+// this return the key of the request in of the region
+func marshalKey(region string, in interface{}) string {
+	bs, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	return strings.Join([]string{region, string(bs)}, ",")
+}
@@ -0,0 +1,257 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replay
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+)
+
+// fakeCloudWatch is an AWS CloudWatch client which return the output out, the ListMetrics pages or the error err
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	out   *cloudwatch.GetMetricDataOutput
+	pages []*cloudwatch.ListMetricsOutput
+	err   error
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(aws.Context, *cloudwatch.GetMetricDataInput, ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	return f.out, f.err
+}
+
+func (f *fakeCloudWatch) ListMetricsPages(_ *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	for i, p := range f.pages {
+		if !fn(p, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// fakeTagging is an AWS Resource Groups Tagging client which return the GetResources pages
+type fakeTagging struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	pages []*resourcegroupstaggingapi.GetResourcesOutput
+}
+
+func (f *fakeTagging) GetResourcesPages(_ *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool) error {
+	for i, p := range f.pages {
+		if !fn(p, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func prepareInput(start time.Time, token string) *cloudwatch.GetMetricDataInput {
+	in := &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(start),
+		EndTime:   aws.Time(start.Add(10 * time.Minute)),
+		ScanBy:    aws.String(cloudwatch.ScanByTimestampDescending),
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{{
+			Id: aws.String("m1"),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{Namespace: aws.String("AWS/EC2"), MetricName: aws.String("CPUUtilization")},
+				Period: aws.Int64(300),
+				Stat:   aws.String("Average"),
+			},
+		}},
+	}
+	if len(token) > 0 {
+		in.NextToken = aws.String(token)
+	}
+	return in
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	recorded := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	pages := []*cloudwatch.GetMetricDataOutput{
+		{
+			MetricDataResults: []*cloudwatch.MetricDataResult{{
+				Id:         aws.String("m1"),
+				StatusCode: aws.String(cloudwatch.StatusCodePartialData),
+				Timestamps: []*time.Time{aws.Time(recorded)},
+				Values:     aws.Float64Slice([]float64{42}),
+			}},
+			NextToken: aws.String("token"),
+		},
+		{
+			MetricDataResults: []*cloudwatch.MetricDataResult{{
+				Id:         aws.String("m1"),
+				StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+				Timestamps: []*time.Time{aws.Time(recorded.Add(-5 * time.Minute))},
+				Values:     aws.Float64Slice([]float64{24}),
+			}},
+		},
+	}
+	for i, tk := range []string{"", "token"} {
+		r := NewRecorder(&fakeCloudWatch{out: pages[i]}, dir, "eu-west-1")
+		if _, err := r.GetMetricData(prepareInput(recorded, tk)); err != nil {
+			t.Fatalf("GetMetricData(): %v", err)
+		}
+	}
+
+	// the failed requests are not recorded
+	r := NewRecorder(&fakeCloudWatch{err: errors.New("failed")}, dir, "eu-west-1")
+	if _, err := r.GetMetricData(prepareInput(recorded, "other")); err == nil {
+		t.Fatalf("GetMetricData(): got: nil --> want: the error of the recorded client")
+	}
+
+	fs, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if len(fs.outputs) != 2 {
+		t.Errorf("Load(): got: %v --> want: %v", len(fs.outputs), 2)
+	}
+
+	// the requests are replayed at any time
+	svc := fs.Client("eu-west-1")
+	for i, tk := range []string{"", "token"} {
+		got, err := svc.GetMetricData(prepareInput(recorded.Add(time.Hour), tk))
+		if err != nil {
+			t.Fatalf("GetMetricData(): %v", err)
+		}
+		if !reflect.DeepEqual(got.MetricDataResults, pages[i].MetricDataResults) || !reflect.DeepEqual(got.NextToken, pages[i].NextToken) {
+			t.Errorf("GetMetricData(): got: %v --> want: %v", got, pages[i])
+		}
+	}
+
+	tests := []struct {
+		name   string
+		region string
+		in     *cloudwatch.GetMetricDataInput
+	}{
+		{name: "OtherRegion", region: "us-east-1", in: prepareInput(recorded, "")},
+		{name: "OtherToken", region: "eu-west-1", in: prepareInput(recorded, "other")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fs.Client(tt.region).GetMetricData(tt.in)
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ErrCodeFixtureNotFound {
+				t.Errorf("GetMetricData(): got: %v --> want: %v", err, ErrCodeFixtureNotFound)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplayDiscovery(t *testing.T) {
+	dir := t.TempDir()
+
+	lmi := &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String("AWS/EC2"),
+		MetricName: aws.String("CPUUtilization"),
+		Dimensions: []*cloudwatch.DimensionFilter{{Name: aws.String("InstanceId")}},
+	}
+	lmPages := []*cloudwatch.ListMetricsOutput{
+		{Metrics: []*cloudwatch.Metric{{MetricName: aws.String("CPUUtilization")}}, NextToken: aws.String("token")},
+		{Metrics: []*cloudwatch.Metric{{MetricName: aws.String("CPUUtilization")}}},
+	}
+	gri := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: aws.StringSlice([]string{"ec2:instance"}),
+	}
+	grPages := []*resourcegroupstaggingapi.GetResourcesOutput{
+		{ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-1")}}},
+	}
+
+	// every page is returned to the caller while it is recorded
+	var got int
+	err := NewRecorder(&fakeCloudWatch{pages: lmPages}, dir, "eu-west-1").ListMetricsPages(lmi, func(*cloudwatch.ListMetricsOutput, bool) bool {
+		got++
+		return true
+	})
+	if err != nil || got != len(lmPages) {
+		t.Fatalf("ListMetricsPages(): got: %v pages, %v --> want: %v pages", got, err, len(lmPages))
+	}
+	err = NewTaggingRecorder(&fakeTagging{pages: grPages}, dir, "eu-west-1").GetResourcesPages(gri, func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatalf("GetResourcesPages(): %v", err)
+	}
+
+	// the failed requests are not recorded
+	other := &cloudwatch.ListMetricsInput{Namespace: aws.String("AWS/RDS")}
+	if err := NewRecorder(&fakeCloudWatch{err: errors.New("failed")}, dir, "eu-west-1").ListMetricsPages(other, nil); err == nil {
+		t.Fatalf("ListMetricsPages(): got: nil --> want: the error of the recorded client")
+	}
+
+	fs, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	if len(fs.listMetrics) != 1 || len(fs.getResources) != 1 {
+		t.Errorf("Load(): got: %v, %v --> want: %v, %v", len(fs.listMetrics), len(fs.getResources), 1, 1)
+	}
+
+	var gotLm []*cloudwatch.ListMetricsOutput
+	err = fs.Client("eu-west-1").ListMetricsPages(lmi, func(p *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		gotLm = append(gotLm, p)
+		return !lastPage
+	})
+	if err != nil || !reflect.DeepEqual(gotLm, lmPages) {
+		t.Errorf("ListMetricsPages(): got: %v, %v --> want: %v", gotLm, err, lmPages)
+	}
+
+	var gotGr []*resourcegroupstaggingapi.GetResourcesOutput
+	err = fs.Tagging("eu-west-1").GetResourcesPages(gri, func(p *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		gotGr = append(gotGr, p)
+		return !lastPage
+	})
+	if err != nil || !reflect.DeepEqual(gotGr, grPages) {
+		t.Errorf("GetResourcesPages(): got: %v, %v --> want: %v", gotGr, err, grPages)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "ListMetricsOtherRequest", err: fs.Client("eu-west-1").ListMetricsPages(other, nil)},
+		{name: "ListMetricsOtherRegion", err: fs.Client("us-east-1").ListMetricsPages(lmi, nil)},
+		{name: "GetResourcesOtherRegion", err: fs.Tagging("us-east-1").GetResourcesPages(gri, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if aerr, ok := tt.err.(awserr.Error); !ok || aerr.Code() != ErrCodeFixtureNotFound {
+				t.Errorf("got: %v --> want: %v", tt.err, ErrCodeFixtureNotFound)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Errorf("Load(): got: nil --> want: an error of the directory without fixtures")
+	}
+	if _, err := Load("testdata/invalid"); err == nil {
+		t.Errorf("Load(): got: nil --> want: an error of the invalid fixture")
+	}
+}
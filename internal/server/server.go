@@ -69,6 +69,21 @@ func (s *Server) ListenOSSignals(done *chan bool) {
 	}(s, done)
 }
 
+// ListenReloadSignal run a go routine which call reload every time the Operating System signal SIGHUP is received,
+// the signal is listened before return, so it doesn't terminate the process anymore
+func (s *Server) ListenReloadSignal(reload func()) {
+	hupSignals := make(chan os.Signal, 1)
+	signal.Notify(hupSignals, syscall.SIGHUP)
+
+	go func() {
+		log.Info("Server is listening Operating System signal SIGHUP to reload the configuration")
+		for sig := range hupSignals {
+			log.Infof("Received signal %s from Operation System, reloading the configuration", sig)
+			reload()
+		}
+	}()
+}
+
 func (s *Server) doGracefullyShutdown() {
 	log.Warnf("Graceful shutdown, wait at least %vs before stop\n", s.c.Server.ShutdownTimeout.Seconds())
 
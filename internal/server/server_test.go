@@ -0,0 +1,48 @@
+//go:build !windows
+
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+func TestServer_ListenReloadSignal(t *testing.T) {
+	s := New(http.NewServeMux(), &config.All{})
+
+	reloads := make(chan bool)
+	s.ListenReloadSignal(func() { reloads <- true })
+
+	// every signal is a reload
+	for i := 0; i < 2; i++ {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("Kill(): %v", err)
+		}
+
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ListenReloadSignal(): got: no reload --> want: reload %v", i+1)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package validation
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_MetricDataQuery.html
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_MetricStat.html
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/Statistics-definitions.html
+
+// The maximum number of dimensions of a metric allowed by AWS CloudWatch
+const MaxDimensions = 30
+
+var (
+	// The rule of AWS CloudWatch for the metrics queries Ids
+	idRegexp = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
+
+	// The statistics and extended statistics (percentiles, trimmed mean, etc.) allowed by AWS CloudWatch
+	statRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^(SampleCount|Average|Sum|Minimum|Maximum|IQM)$`),
+		regexp.MustCompile(`^(p|tm|tc|ts|wm)(100|\d{1,2}(\.\d{1,10})?)$`),
+		regexp.MustCompile(`^(TM|TC|TS|WM|PR)\((\d+(\.\d+)?%?)?:(\d+(\.\d+)?%?)?\)$`),
+	}
+
+	// The high resolution periods allowed by AWS CloudWatch, the others must be multiple of 60
+	highResolutionPeriods = map[int64]bool{1: true, 5: true, 10: true, 30: true}
+)
+
+// The keys allowed into every level of the metrics files
+var (
+	fileKeys         = []string{"MetricDataQueries", "Module", "Region", "AccountId"}
+	queryKeys        = []string{"Id", "Expression", "Label", "ReturnData", "MetricStat", "Region", "Module", "AccountId", "TagDiscovery", "PrometheusName", "Help", "Labels", "LabelRenames", "Type", "UnitConversion", "Scale"}
+	metricStatKeys   = []string{"Metric", "Period", "Stat", "Stats", "Unit"}
+	metricKeys       = []string{"Namespace", "MetricName", "Dimensions"}
+	dimensionKeys    = []string{"Name", "Value", "Regex"}
+	tagDiscoveryKeys = []string{"ResourceType", "TagFilters", "ExportedTags"}
+	tagFilterKeys    = []string{"Key", "Values"}
+)
+
+// Problem is an error found into a metrics file
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// Validator validate the metrics files, the Ids are checked across all the files validated by the same Validator
+type Validator struct {
+	// The position of the Ids already validated, by module and region
+	ids map[string]Problem
+}
+
+func New() *Validator {
+	return &Validator{
+		ids: make(map[string]Problem),
+	}
+}
+
+// ValidateFiles validate all the metrics files and return all the problems found
+func (v *Validator) ValidateFiles(files []string) []Problem {
+	var ps []Problem
+	for _, f := range files {
+		ps = append(ps, v.ValidateFile(f)...)
+	}
+	return ps
+}
+
+// ValidateFile read and validate the metrics file, the json files are parsed as yaml
+func (v *Validator) ValidateFile(file string) []Problem {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []Problem{{File: file, Message: err.Error()}}
+	}
+	return v.Validate(file, bs)
+}
+
+// Validate validate the content bs of the metrics file
+func (v *Validator) Validate(file string, bs []byte) []Problem {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return []Problem{{File: file, Line: errorLine(err), Message: err.Error()}}
+	}
+	// empty file
+	if len(doc.Content) == 0 {
+		return []Problem{{File: file, Message: "the file is empty"}}
+	}
+
+	fv := &fileValidator{file: file, v: v}
+	root := doc.Content[0]
+	if !fv.isMapping(root, "the file") {
+		return fv.problems
+	}
+	fv.checkKeys(root, fileKeys, "the file")
+
+	module := stringValue(mappingValue(root, "Module"))
+	region := stringValue(mappingValue(root, "Region"))
+
+	qs := mappingValue(root, "MetricDataQueries")
+	if qs == nil {
+		fv.add(root, "MetricDataQueries is not defined")
+		return fv.problems
+	}
+	if qs.Kind != yaml.SequenceNode {
+		fv.add(qs, "MetricDataQueries must be a list")
+		return fv.problems
+	}
+
+	for _, q := range qs.Content {
+		fv.checkQuery(q, module, region)
+	}
+
+	return fv.problems
+}
+
+// this validate one file and collect its problems
+type fileValidator struct {
+	file     string
+	v        *Validator
+	problems []Problem
+}
+
+func (fv *fileValidator) add(n *yaml.Node, format string, args ...interface{}) {
+	fv.problems = append(fv.problems, Problem{File: fv.file, Line: n.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (fv *fileValidator) isMapping(n *yaml.Node, what string) bool {
+	if n.Kind != yaml.MappingNode {
+		fv.add(n, "%s must be a map", what)
+		return false
+	}
+	return true
+}
+
+// this check that all the keys of the mapping n are allowed
+func (fv *fileValidator) checkKeys(n *yaml.Node, allowed []string, what string) {
+	for i := 0; i < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if !contains(allowed, k.Value) {
+			fv.add(k, "unknown key %s in %s, allowed keys: %s", k.Value, what, strings.Join(allowed, ", "))
+		}
+	}
+}
+
+func (fv *fileValidator) checkQuery(q *yaml.Node, module, region string) {
+	if !fv.isMapping(q, "the metric query") {
+		return
+	}
+	fv.checkKeys(q, queryKeys, "the metric query")
+
+	idNode := mappingValue(q, "Id")
+	id := stringValue(idNode)
+	switch {
+	case idNode == nil:
+		fv.add(q, "the metric query doesn't have Id")
+	case !idRegexp.MatchString(id):
+		fv.add(idNode, "invalid Id %s, it must match %s", id, idRegexp.String())
+	default:
+		if m := mappingValue(q, "Module"); m != nil {
+			module = stringValue(m)
+		}
+		if r := mappingValue(q, "Region"); r != nil {
+			region = stringValue(r)
+		}
+
+		// the Ids must be unique in the same GetMetricData call, so by module and region,
+		// the metrics queries with Stats are sent with the Ids of its statistics
+		ids := []string{id}
+		if stats := mappingValue(mappingValue(q, "MetricStat"), "Stats"); stats != nil && stats.Kind == yaml.SequenceNode {
+			ids = nil
+			for _, s := range stats.Content {
+				// the duplicated statistics are reported by the Stats validation
+				if sid := id + "_" + config.StatSuffix(s.Value); !contains(ids, sid) {
+					ids = append(ids, sid)
+				}
+			}
+		}
+		for _, id := range ids {
+			key := module + "," + region + "," + id
+			if p, ok := fv.v.ids[key]; ok {
+				fv.add(idNode, "duplicate Id %s, already defined at %s:%d", id, p.File, p.Line)
+			} else {
+				fv.v.ids[key] = Problem{File: fv.file, Line: idNode.Line}
+			}
+		}
+	}
+
+	if rd := mappingValue(q, "ReturnData"); rd != nil {
+		if _, err := strconv.ParseBool(rd.Value); err != nil {
+			fv.add(rd, "invalid ReturnData %s, it must be true or false", rd.Value)
+		}
+	}
+
+	if td := mappingValue(q, "TagDiscovery"); td != nil {
+		fv.checkTagDiscovery(td)
+	}
+
+	if pn := mappingValue(q, "PrometheusName"); pn != nil && !metrics.MetricNameRegexp.MatchString(pn.Value) {
+		fv.add(pn, "invalid PrometheusName %s, it must match %s", pn.Value, metrics.MetricNameRegexp.String())
+	}
+	if ls := mappingValue(q, "Labels"); ls != nil {
+		fv.checkLabels(ls, "Labels", true)
+	}
+	if lr := mappingValue(q, "LabelRenames"); lr != nil {
+		fv.checkLabels(lr, "LabelRenames", false)
+	}
+
+	if tp := mappingValue(q, "Type"); tp != nil && tp.Value != config.MetricTypeGauge && tp.Value != config.MetricTypeCounter {
+		fv.add(tp, "invalid Type %s, it must be %s or %s", tp.Value, config.MetricTypeGauge, config.MetricTypeCounter)
+	}
+	if uc := mappingValue(q, "UnitConversion"); uc != nil {
+		if _, ok := metrics.UnitConversions[uc.Value]; !ok {
+			fv.add(uc, "invalid UnitConversion %s, allowed units: %s", uc.Value, strings.Join(metrics.UnitConversionNames(), ", "))
+		}
+	}
+	if sc := mappingValue(q, "Scale"); sc != nil {
+		if _, err := strconv.ParseFloat(sc.Value, 64); err != nil {
+			fv.add(sc, "invalid Scale %s, it must be a number", sc.Value)
+		}
+	}
+
+	ms := mappingValue(q, "MetricStat")
+	expression := mappingValue(q, "Expression")
+	switch {
+	case ms == nil && expression == nil:
+		fv.add(q, "the metric query %s must have MetricStat or Expression", id)
+	case ms != nil && expression != nil:
+		fv.add(q, "the metric query %s can't have MetricStat and Expression", id)
+	case ms != nil:
+		fv.checkMetricStat(ms)
+
+		// the counters accumulate the value of every period, so only the Sum makes sense
+		if tp := mappingValue(q, "Type"); tp != nil && tp.Value == config.MetricTypeCounter {
+			stat := mappingValue(ms, "Stat")
+			stats := mappingValue(ms, "Stats")
+			if (stat != nil && stat.Value != cloudwatch.StatisticSum) || (stats != nil && !onlySum(stats)) {
+				fv.add(tp, "the metric query %s with Type %s must have Stat %s", id, config.MetricTypeCounter, cloudwatch.StatisticSum)
+			}
+		}
+	}
+}
+
+func (fv *fileValidator) checkMetricStat(ms *yaml.Node) {
+	if !fv.isMapping(ms, "MetricStat") {
+		return
+	}
+	fv.checkKeys(ms, metricStatKeys, "MetricStat")
+
+	stat := mappingValue(ms, "Stat")
+	stats := mappingValue(ms, "Stats")
+	switch {
+	case stat == nil && stats == nil:
+		fv.add(ms, "MetricStat doesn't have Stat or Stats")
+	case stat != nil && stats != nil:
+		fv.add(ms, "MetricStat can't have Stat and Stats")
+	case stat != nil:
+		if !validStat(stat.Value) {
+			fv.add(stat, "unknown Stat %s", stat.Value)
+		}
+	default:
+		fv.checkStats(stats)
+	}
+
+	if unit := mappingValue(ms, "Unit"); unit != nil && len(unit.Value) > 0 && !contains(cloudwatch.StandardUnit_Values(), unit.Value) {
+		fv.add(unit, "invalid Unit %s, allowed units: %s", unit.Value, strings.Join(cloudwatch.StandardUnit_Values(), ", "))
+	}
+
+	if period := mappingValue(ms, "Period"); period != nil {
+		p, err := strconv.ParseInt(period.Value, 10, 64)
+		if err != nil || p <= 0 || (p%60 != 0 && !highResolutionPeriods[p]) {
+			fv.add(period, "invalid Period %s, it must be 1, 5, 10, 30 or a multiple of 60 seconds", period.Value)
+		}
+	}
+
+	m := mappingValue(ms, "Metric")
+	if m == nil {
+		fv.add(ms, "MetricStat doesn't have Metric")
+		return
+	}
+	if !fv.isMapping(m, "Metric") {
+		return
+	}
+	fv.checkKeys(m, metricKeys, "Metric")
+
+	for _, k := range []string{"Namespace", "MetricName"} {
+		if n := mappingValue(m, k); n == nil || len(n.Value) == 0 {
+			fv.add(m, "Metric doesn't have %s", k)
+		}
+	}
+
+	dims := mappingValue(m, "Dimensions")
+	if dims == nil {
+		return
+	}
+	if dims.Kind != yaml.SequenceNode {
+		fv.add(dims, "Dimensions must be a list")
+		return
+	}
+	if len(dims.Content) > MaxDimensions {
+		fv.add(dims, "the metric has %v dimensions, the maximum is %v", len(dims.Content), MaxDimensions)
+	}
+	for _, d := range dims.Content {
+		if fv.isMapping(d, "the dimension") {
+			fv.checkKeys(d, dimensionKeys, "the dimension")
+			if r := mappingValue(d, "Regex"); r != nil {
+				if _, err := regexp.Compile(r.Value); err != nil {
+					fv.add(r, "invalid Regex %s, %v", r.Value, err)
+				}
+			}
+		}
+	}
+}
+
+// this check that the mapping n of labels has valid prometheus labels names, as its keys
+// when keys is true or as its values otherwise
+func (fv *fileValidator) checkLabels(n *yaml.Node, what string, keys bool) {
+	if !fv.isMapping(n, what) {
+		return
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if v.Kind != yaml.ScalarNode {
+			fv.add(v, "the value of %s in %s must be a string", k.Value, what)
+			continue
+		}
+		l := v
+		if keys {
+			l = k
+		}
+		if err := metrics.ValidateLabelName(l.Value); err != nil {
+			fv.add(l, "%v", err)
+		}
+	}
+}
+
+// this check the statistics of Stats, their suffixes are used to create the Ids of the expanded metrics queries
+func (fv *fileValidator) checkStats(stats *yaml.Node) {
+	if stats.Kind != yaml.SequenceNode || len(stats.Content) == 0 {
+		fv.add(stats, "Stats must be a list of statistics")
+		return
+	}
+	suffixes := make(map[string]string)
+	for _, s := range stats.Content {
+		if !validStat(s.Value) {
+			fv.add(s, "unknown Stat %s", s.Value)
+			continue
+		}
+		sf := config.StatSuffix(s.Value)
+		if prev, ok := suffixes[sf]; ok {
+			fv.add(s, "the Stat %s has the same Id suffix %s of the Stat %s", s.Value, sf, prev)
+			continue
+		}
+		suffixes[sf] = s.Value
+	}
+}
+
+func (fv *fileValidator) checkTagDiscovery(td *yaml.Node) {
+	if !fv.isMapping(td, "TagDiscovery") {
+		return
+	}
+	fv.checkKeys(td, tagDiscoveryKeys, "TagDiscovery")
+
+	tfs := mappingValue(td, "TagFilters")
+	if tfs == nil {
+		return
+	}
+	if tfs.Kind != yaml.SequenceNode {
+		fv.add(tfs, "TagFilters must be a list")
+		return
+	}
+	for _, tf := range tfs.Content {
+		if fv.isMapping(tf, "the tag filter") {
+			fv.checkKeys(tf, tagFilterKeys, "the tag filter")
+		}
+	}
+}
+
+// this return if s is a statistic or extended statistic allowed by AWS CloudWatch
+func validStat(s string) bool {
+	for _, r := range statRegexps {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// this return if all the statistics of the sequence node n are Sum
+func onlySum(n *yaml.Node) bool {
+	for _, s := range n.Content {
+		if s.Value != cloudwatch.StatisticSum {
+			return false
+		}
+	}
+	return true
+}
+
+// this return the value node of the key k of the mapping node n or nil when it doesn't exist
+func mappingValue(n *yaml.Node, k string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == k {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// this return the value of the scalar node n or empty
+func stringValue(n *yaml.Node) string {
+	if n == nil || n.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return n.Value
+}
+
+// the yaml errors have the format "yaml: line 3: ..."
+var errorLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// this return the line of the yaml error err or 0 when it doesn't have line
+func errorLine(err error) int {
+	m := errorLineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	l, _ := strconv.Atoi(m[1])
+	return l
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func prepareValidFile() string {
+	return `
+MetricDataQueries:
+  - Id: m1
+    MetricStat:
+      Metric:
+        Namespace: AWS/EC2
+        MetricName: CPUUtilization
+        Dimensions:
+          - Name: InstanceId
+            Value: i-1234567890
+      Period: 300
+      Stat: p99.9
+      Unit: Percent
+  - Id: e1
+    Expression: m1*100
+`
+}
+
+func TestValidator_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "Valid",
+			yaml: prepareValidFile(),
+			want: nil,
+		},
+		{
+			name: "UnknownKey",
+			yaml: strings.Replace(prepareValidFile(), "      Unit: Percent", "      Units: Percent", 1),
+			want: []string{"f.yaml:13: unknown key Units in MetricStat"},
+		},
+		{
+			name: "InvalidId",
+			yaml: strings.Replace(prepareValidFile(), "Id: m1", "Id: M1", 1),
+			want: []string{"f.yaml:3: invalid Id M1"},
+		},
+		{
+			name: "UnknownStat",
+			yaml: strings.Replace(prepareValidFile(), "Stat: p99.9", "Stat: Avg", 1),
+			want: []string{"f.yaml:12: unknown Stat Avg"},
+		},
+		{
+			name: "InvalidUnit",
+			yaml: strings.Replace(prepareValidFile(), "Unit: Percent", "Unit: percent", 1),
+			want: []string{"f.yaml:13: invalid Unit percent"},
+		},
+		{
+			name: "InvalidPeriod",
+			yaml: strings.Replace(prepareValidFile(), "Period: 300", "Period: 90", 1),
+			want: []string{"f.yaml:11: invalid Period 90"},
+		},
+		{
+			name: "DuplicateId",
+			yaml: strings.Replace(prepareValidFile(), "Id: e1", "Id: m1", 1),
+			want: []string{"f.yaml:14: duplicate Id m1, already defined at f.yaml:3"},
+		},
+		{
+			name: "InvalidPrometheusName",
+			yaml: strings.Replace(prepareValidFile(), "Expression: m1*100", "Expression: m1*100\n    PrometheusName: cpu-percent", 1),
+			want: []string{"f.yaml:16: invalid PrometheusName cpu-percent"},
+		},
+		{
+			name: "InvalidLabels",
+			yaml: strings.Replace(prepareValidFile(), "Expression: m1*100", "Expression: m1*100\n    Labels:\n      team: payments\n      __team: payments", 1),
+			want: []string{"f.yaml:18: invalid prometheus label name __team"},
+		},
+		{
+			name: "InvalidLabelRenames",
+			yaml: strings.Replace(prepareValidFile(), "Expression: m1*100", "Expression: m1*100\n    LabelRenames:\n      label: 1label", 1),
+			want: []string{"f.yaml:17: invalid prometheus label name 1label"},
+		},
+		{
+			name: "InvalidType",
+			yaml: strings.Replace(prepareValidFile(), "Expression: m1*100", "Expression: m1*100\n    Type: histogram", 1),
+			want: []string{"f.yaml:16: invalid Type histogram"},
+		},
+		{
+			name: "CounterWithoutSum",
+			yaml: strings.Replace(prepareValidFile(), "  - Id: m1\n", "  - Id: m1\n    Type: counter\n", 1),
+			want: []string{"f.yaml:4: the metric query m1 with Type counter must have Stat Sum"},
+		},
+		{
+			name: "InvalidUnitConversion",
+			yaml: strings.Replace(prepareValidFile(), "Expression: m1*100", "Expression: m1*100\n    UnitConversion: Hours\n    Scale: ten", 1),
+			want: []string{"f.yaml:16: invalid UnitConversion Hours", "f.yaml:17: invalid Scale ten"},
+		},
+		{
+			name: "Stats",
+			yaml: strings.Replace(prepareValidFile(), "Stat: p99.9", "Stats: [Average, p99.9, TM(10%:90%)]", 1),
+			want: nil,
+		},
+		{
+			name: "StatAndStats",
+			yaml: strings.Replace(prepareValidFile(), "Stat: p99.9", "Stat: p99.9\n      Stats: [Average]", 1),
+			want: []string{"f.yaml:5: MetricStat can't have Stat and Stats"},
+		},
+		{
+			name: "InvalidStats",
+			yaml: strings.Replace(prepareValidFile(), "Stat: p99.9", "Stats: [Average, avg, p99, p99]", 1),
+			want: []string{"f.yaml:12: unknown Stat avg", "f.yaml:12: the Stat p99 has the same Id suffix p99 of the Stat p99"},
+		},
+		{
+			name: "StatsDuplicateId",
+			yaml: strings.Replace(strings.Replace(prepareValidFile(), "Stat: p99.9", "Stats: [Average, Maximum]", 1), "Id: e1", "Id: m1_maximum", 1),
+			want: []string{"f.yaml:14: duplicate Id m1_maximum, already defined at f.yaml:3"},
+		},
+		{
+			name: "InvalidYaml",
+			yaml: "MetricDataQueries:\n  - Id: m1\n   MetricStat:",
+			want: []string{"f.yaml:1: yaml: line 1:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := New().Validate("f.yaml", []byte(tt.yaml))
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Validate(): got: %v --> want: %v", got, tt.want)
+			}
+			for i, p := range got {
+				if !strings.HasPrefix(p.String(), tt.want[i]) {
+					t.Errorf("Validate(): got: %v --> want: %v", p.String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidator_ValidateTooManyDimensions(t *testing.T) {
+	var dims []string
+	for i := 0; i <= MaxDimensions; i++ {
+		dims = append(dims, fmt.Sprintf("          - Name: D%v\n            Value: v", i))
+	}
+	y := strings.Replace(prepareValidFile(), "          - Name: InstanceId\n            Value: i-1234567890", strings.Join(dims, "\n"), 1)
+
+	got := New().Validate("f.yaml", []byte(y))
+	if len(got) != 1 || !strings.Contains(got[0].Message, "the maximum is 30") {
+		t.Errorf("Validate(): got: %v --> want: one problem with the maximum number of dimensions", got)
+	}
+}
+
+func TestValidator_DuplicateIdAcrossFiles(t *testing.T) {
+	v := New()
+	v.Validate("a.yaml", []byte(prepareValidFile()))
+	got := v.Validate("b.yaml", []byte(prepareValidFile()))
+
+	want := []Problem{
+		{File: "b.yaml", Line: 3, Message: "duplicate Id m1, already defined at a.yaml:3"},
+		{File: "b.yaml", Line: 14, Message: "duplicate Id e1, already defined at a.yaml:14"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate(): got: %v --> want: %v", got, want)
+	}
+}
+
+func Test_validStat(t *testing.T) {
+	tests := []struct {
+		stat string
+		want bool
+	}{
+		{stat: "Average", want: true},
+		{stat: "p99", want: true},
+		{stat: "p99.99", want: true},
+		{stat: "tm90", want: true},
+		{stat: "TM(10%:90%)", want: true},
+		{stat: "PR(:300)", want: true},
+		{stat: "IQM", want: true},
+		{stat: "average", want: false},
+		{stat: "p999", want: false},
+		{stat: "TM(10%)", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stat, func(t *testing.T) {
+			if got := validStat(tt.stat); got != tt.want {
+				t.Errorf("validStat(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
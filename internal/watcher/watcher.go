@@ -0,0 +1,120 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// https://pkg.go.dev/github.com/fsnotify/fsnotify
+
+// Watch run a go routine which call onChange when the files of the paths are created, changed or removed,
+// until the ctx is done. The paths could be files, directories or glob patterns, the directories
+// containing them are watched, so the files added later are watched too, i.e.: the Kubernetes ConfigMaps.
+// The events are grouped, onChange is called once when there are no more events during delay.
+func Watch(ctx context.Context, paths []string, delay time.Duration, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range Dirs(paths) {
+		if err := w.Add(dir); err != nil {
+			// the directories created later can't be watched
+			if errors.Is(err, os.ErrNotExist) {
+				log.Warnf("The directory: %s doesn't exist, it can't be watched", dir)
+				continue
+			}
+			w.Close()
+			return err
+		}
+		log.Infof("Watching directory: %s", dir)
+	}
+
+	go func() {
+		defer w.Close()
+
+		timer := time.NewTimer(delay)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// only the permissions changes are ignored
+				if e.Op == fsnotify.Chmod {
+					continue
+				}
+				log.Debugf("File event: %s", e)
+				timer.Reset(delay)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Error watching files: %v", err)
+			case <-timer.C:
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Dirs return the sorted directories to be watched for the paths, the directory of a file or glob pattern
+// is its parent directory. The glob patterns with meta characters into the directory are not supported.
+func Dirs(paths []string) []string {
+	unique := make(map[string]bool)
+	for _, p := range paths {
+		dir := p
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			dir = filepath.Dir(p)
+		}
+
+		if hasMeta(dir) {
+			log.Warnf("The directory of the path: %s has glob meta characters, it can't be watched", p)
+			continue
+		}
+		unique[dir] = true
+	}
+
+	var dirs []string
+	for d := range unique {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	return dirs
+}
+
+// this return if the path p has glob meta characters, see filepath.Match
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[`)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDirs(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{name: "Directory", paths: []string{dir}, want: []string{dir}},
+		{name: "File", paths: []string{filepath.Join(dir, "m1.yaml")}, want: []string{dir}},
+		{name: "Glob", paths: []string{filepath.Join(dir, "*.yaml"), filepath.Join(dir, "m1.yaml")}, want: []string{dir}},
+		{name: "GlobInDirectory", paths: []string{filepath.Join(dir, "*", "m1.yaml")}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Dirs(tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Dirs(): got: %v --> want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan bool, 1)
+	err := Watch(ctx, []string{filepath.Join(dir, "*.yaml")}, 50*time.Millisecond, func() {
+		changes <- true
+	})
+	if err != nil {
+		t.Fatalf("Watch(): got error: %v --> want: nil", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "m1.yaml"), []byte("MetricDataQueries: []"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Watch(): got no change --> want: one change after the file was created")
+	}
+}
@@ -16,25 +16,79 @@ limitations under the License.
 package web
 
 import (
+	"container/list"
 	"net/http"
+	"path"
+	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/awshelper"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/collector"
 	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
 
 	"text/template"
 )
 
+// The maximum number of collectors of the probes kept, the least recently used ones are removed
+const MaxProbeCollectors = 100
+
 type Handlers struct {
-	conf *config.All
+	conf    *config.All
+	sess    *session.Session
+	clients collector.Clients
+
+	// The collectors of the probes, reused by the probes of the same module, region and role, the
+	// list has the keys of the collectors sorted from the most recently used one
+	mutex              sync.Mutex
+	maxProbeCollectors int
+	probeCollectors    map[string]*list.Element
+	probeKeys          *list.List
+}
+
+// the collector of a probe and its key into the collectors of the probes
+type probeEntry struct {
+	key       string
+	collector *collector.Collector
 }
 
-func NewHandlers(c *config.All) *Handlers {
+// NewHandlers create the handlers of the configuration c, the collectors of the probes use the AWS clients
+// returned by clients, when it is nil the AWS clients are used
+func NewHandlers(c *config.All, sess *session.Session, clients collector.Clients) *Handlers {
 	return &Handlers{
-		conf: c,
+		conf:               c,
+		sess:               sess,
+		clients:            clients,
+		maxProbeCollectors: MaxProbeCollectors,
+		probeCollectors:    make(map[string]*list.Element),
+		probeKeys:          list.New(),
 	}
 }
 
+// SetConfig replace the configuration of the handlers with c, the collectors of the
+// probes are created again with the metrics queries of c in the next probes
+func (h *Handlers) SetConfig(c *config.All) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.conf = c
+	h.probeCollectors = make(map[string]*list.Element)
+	h.probeKeys = list.New()
+}
+
+// this return the configuration of the handlers, it is replaced when the configuration is reloaded
+func (h *Handlers) getConf() *config.All {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.conf
+}
+
 func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
+	conf := h.getConf()
+
 	indexHTMLTmpl := `
 <html>
 <head>
@@ -47,6 +101,7 @@ func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
 	<ul>
 		<li><a href="{{.MetricsPath}}">{{.MetricsPath}}</a></li>
 		<li><a href="{{.HealthPath}}">{{.HealthPath}}</a></li>
+		<li>{{.ProbePath}}?module=[name]&region=[region]&role=[role arn]</li>
 	</ul>
 
 	<h2>Version</h2>
@@ -73,18 +128,20 @@ func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
 		GitRepository string
 		MetricsPath   string
 		HealthPath    string
+		ProbePath     string
 		VersionInfo   string
 		BuildInfo     string
 		ProfileLinks  []string
 	}{
-		h.conf.Application.Name,
-		h.conf.Application.Name,
-		h.conf.Application.Description,
-		h.conf.Application.GitRepository,
-		h.conf.Application.MetricsPath,
-		h.conf.Application.HealthPath,
-		h.conf.Application.VersionInfo,
-		h.conf.Application.BuildInfo,
+		conf.Application.Name,
+		conf.Application.Name,
+		conf.Application.Description,
+		conf.Application.GitRepository,
+		conf.Application.MetricsPath,
+		conf.Application.HealthPath,
+		conf.Application.ProbePath,
+		conf.Application.VersionInfo,
+		conf.Application.BuildInfo,
 		[]string{
 			"/debug/pprof/",
 			"/debug/pprof/heap",
@@ -108,3 +165,106 @@ func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
 }
+
+// Probe serve only the metrics of the metrics queries of a module, the parameters region and role are optional
+// and they are the default region of the metrics queries and the role assumed to scrape them, the role must be
+// allowed by the application probeRoles,
+// i.e.: /probe?module=rds&region=eu-west-1&role=arn:aws:iam::123456789012:role/cloudwatch-exporter
+func (h *Handlers) Probe(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	module := params.Get("module")
+	region := params.Get("region")
+	role := params.Get("role")
+
+	if len(module) == 0 {
+		http.Error(w, "The parameter module is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(region) > 0 && !awshelper.IsRegion(region) {
+		http.Error(w, "Invalid region: "+region, http.StatusBadRequest)
+		return
+	}
+
+	if len(role) > 0 && len(awshelper.AccountID(role)) == 0 {
+		http.Error(w, "Invalid role: "+role, http.StatusBadRequest)
+		return
+	}
+
+	if len(role) > 0 && !allowedRole(h.getConf().Application.ProbeRoles, role) {
+		http.Error(w, "Role not allowed: "+role, http.StatusForbidden)
+		return
+	}
+
+	c, ok := h.probeCollector(module, region, role)
+	if !ok {
+		http.Error(w, "Unknown module: "+module, http.StatusBadRequest)
+		return
+	}
+
+	// the registry is created for every probe, so only the metrics of the module are served
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		log.Errorf("Error registering the collector of the module: %s, %v", module, err)
+		http.Error(w, "Error registering the collector of the module: "+module, http.StatusInternalServerError)
+		return
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// this return true when the role is one of the roles, or it match one of them as pattern,
+// i.e.: arn:aws:iam::*:role/cloudwatch-exporter
+func allowedRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if ok, err := path.Match(r, role); ok && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// this return the collector of the metrics queries of the module for the region and role, or false when the module
+// doesn't exist. It is created the first time and reused by the next probes, so the discovered metrics are kept,
+// only the most recently used collectors are kept
+func (h *Handlers) probeCollector(module, region, role string) (*collector.Collector, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := module + "," + region + "," + role
+	if e, ok := h.probeCollectors[key]; ok {
+		h.probeKeys.MoveToFront(e)
+		return e.Value.(*probeEntry).collector, true
+	}
+
+	qs := config.ByModule(h.conf.MetricDataQueries)[module]
+	if len(qs) == 0 {
+		return nil, false
+	}
+
+	// the probes are scraped on every request, and only in the target of the request
+	conf := *h.conf
+	conf.MetricDataQueriesConf = config.MetricDataQueriesConf{MetricDataQueries: qs}
+	conf.TargetsConf = config.TargetsConf{}
+	conf.Application.BackgroundPolling = false
+
+	sess := h.sess
+	if len(role) > 0 {
+		conf.Targets = []config.Target{{RoleArn: role, Region: region}}
+	} else if len(region) > 0 {
+		sess = h.sess.Copy(aws.NewConfig().WithRegion(region))
+	}
+
+	log.Infof("Creating the collector of the module: %s, region: %s, role: %s", module, region, role)
+	c := collector.NewWithClients(&conf, sess, h.clients)
+	h.probeCollectors[key] = h.probeKeys.PushFront(&probeEntry{key: key, collector: c})
+
+	for h.probeKeys.Len() > h.maxProbeCollectors {
+		e := h.probeKeys.Back()
+		log.Infof("Removing the collector of the probe: %s, it is the least recently used", e.Value.(*probeEntry).key)
+		h.probeKeys.Remove(e)
+		delete(h.probeCollectors, e.Value.(*probeEntry).key)
+	}
+
+	return c, true
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2020 Christian González Di Antonio christian@slashdevops.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/slashdevops/aws_cloudwatch_exporter/internal/config"
+)
+
+// fakeCloudWatch is an AWS CloudWatch client which return the value 1 for every metric query
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(_ aws.Context, in *cloudwatch.GetMetricDataInput, _ ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	out := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range in.MetricDataQueries {
+		out.MetricDataResults = append(out.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Label:      q.Id,
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(time.Now())},
+			Values:     []*float64{aws.Float64(1)},
+		})
+	}
+	return out, nil
+}
+
+// fakeClients count the AWS clients created by region, one for every collector of the probes
+type fakeClients struct {
+	mutex   sync.Mutex
+	regions map[string]int
+}
+
+func (f *fakeClients) clients(_ *session.Session, r string) (cloudwatchiface.CloudWatchAPI, resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.regions[r]++
+	return &fakeCloudWatch{}, nil
+}
+
+func prepareHandlers(t *testing.T) (*Handlers, *fakeClients) {
+	t.Helper()
+
+	c := &config.All{}
+	c.Application.MetricStatPeriod = "5m"
+	c.Application.MetricTimeWindow = "10m"
+	c.Application.ProbeRoles = []string{"arn:aws:iam::*:role/cloudwatch-exporter"}
+	c.MetricDataQueries = []config.MetricDataQuery{{
+		ID:     "m1",
+		Module: "ec2",
+		MetricStat: config.MetricStat{
+			Metric: config.Metric{
+				Namespace:  "AWS/EC2",
+				MetricName: "CPUUtilization",
+				Dimensions: []config.Dimension{{Name: "InstanceId", Value: "i-1234567890"}},
+			},
+			Period: 300,
+			Stat:   "Average",
+		},
+	}}
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("eu-west-1").WithCredentials(credentials.AnonymousCredentials))
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	fc := &fakeClients{regions: make(map[string]int)}
+	return NewHandlers(c, sess, fc.clients), fc
+}
+
+// this return the status code and the body of the probe with the query string q
+func probe(h *Handlers, q string) (int, string) {
+	w := httptest.NewRecorder()
+	h.Probe(w, httptest.NewRequest(http.MethodGet, "/probe?"+q, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHandlers_Probe(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "MissingModule",
+			query:      "region=eu-west-1",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "The parameter module is required",
+		},
+		{
+			name:       "UnknownModule",
+			query:      "module=rds",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Unknown module: rds",
+		},
+		{
+			name:       "InvalidRegion",
+			query:      "module=ec2&region=moon-base-1",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Invalid region: moon-base-1",
+		},
+		{
+			name:       "InvalidRole",
+			query:      "module=ec2&role=cloudwatch-exporter",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Invalid role: cloudwatch-exporter",
+		},
+		{
+			name:       "RoleNotAllowed",
+			query:      "module=ec2&role=arn:aws:iam::123456789012:role/admin",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "Role not allowed: arn:aws:iam::123456789012:role/admin",
+		},
+		{
+			name:       "DefaultRegion",
+			query:      "module=ec2",
+			wantStatus: http.StatusOK,
+			wantBody:   `aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="eu-west-1"} 1`,
+		},
+		{
+			name:       "Region",
+			query:      "module=ec2&region=us-east-1",
+			wantStatus: http.StatusOK,
+			wantBody:   `aws_ec_2_cpu_utilization_average{dimension_value="i-1234567890",instance_id="i-1234567890",region="us-east-1"} 1`,
+		},
+		{
+			name:       "AllowedRole",
+			query:      "module=ec2&region=us-east-1&role=arn:aws:iam::123456789012:role/cloudwatch-exporter",
+			wantStatus: http.StatusOK,
+			wantBody:   `aws_ec_2_cpu_utilization_average{account_id="123456789012",dimension_value="i-1234567890",instance_id="i-1234567890",region="us-east-1"} 1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := prepareHandlers(t)
+
+			status, body := probe(h, tt.query)
+			if status != tt.wantStatus || !strings.Contains(body, tt.wantBody) {
+				t.Errorf("Probe(): got: %v, %s --> want: %v, %s", status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandlers_probeCollector(t *testing.T) {
+	h, fc := prepareHandlers(t)
+	h.maxProbeCollectors = 2
+
+	// the collectors are reused by the probes of the same module, region and role
+	c1, _ := h.probeCollector("ec2", "eu-west-1", "")
+	if c, _ := h.probeCollector("ec2", "eu-west-1", ""); c != c1 {
+		t.Errorf("probeCollector(): got: a new collector --> want: the collector of the first probe")
+	}
+	h.probeCollector("ec2", "us-east-1", "")
+	if got := fc.regions; got["eu-west-1"] != 1 || got["us-east-1"] != 1 {
+		t.Errorf("probeCollector(): got: %v --> want: one collector by region", got)
+	}
+
+	// the least recently used collector is removed, it was eu-west-1 before using it again
+	h.probeCollector("ec2", "eu-west-1", "")
+	h.probeCollector("ec2", "ap-south-1", "")
+	if len(h.probeCollectors) != 2 || h.probeKeys.Len() != 2 {
+		t.Fatalf("probeCollector(): got: %v collectors --> want: %v", len(h.probeCollectors), 2)
+	}
+	if c, _ := h.probeCollector("ec2", "eu-west-1", ""); c != c1 {
+		t.Errorf("probeCollector(): got: a new collector --> want: the collector of the first probe")
+	}
+	h.probeCollector("ec2", "us-east-1", "")
+	if got := fc.regions["us-east-1"]; got != 2 {
+		t.Errorf("probeCollector(): got: %v collectors of us-east-1 --> want: %v", got, 2)
+	}
+
+	// the collectors are created again with the new configuration
+	h.SetConfig(h.getConf())
+	if c, _ := h.probeCollector("ec2", "eu-west-1", ""); c == c1 {
+		t.Errorf("probeCollector(): got: the collector of the first probe --> want: a new collector")
+	}
+}